@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/psarna/fuss/pkg/overlay"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	commitTarget string
+	commitDryRun bool
+	commitForce  bool
+)
+
+func newCommitCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "commit [flags]",
+		Short: "Apply the upper layer onto the topmost lower layer or a new directory",
+		Long: `commit squashes the upper directory into a target: by default the topmost
+lower directory, or with --target a missing or empty directory, which first
+gets a copy of the lower directories merged. Files are copied with their
+permissions, owner, extended attributes and timestamps. Whiteouts become
+deletions, or whiteouts in the target where the lower directories below it
+still have the path, and opaque directories replace the ones in the target.
+
+fuss records when the first session over an upper directory started, and
+commit refuses to proceed if a lower path the upper directory changes was
+modified, deleted or created since then, or for a directory had entries
+added or removed, unless --force is given. The upper directory is left as
+it is.
+
+Example:
+  fuss commit --upperdir /tmp/build --lowerdir /src --dry-run
+  fuss commit --upperdir /tmp/build --lowerdir /layers/app:/layers/base --target /tmp/flat`,
+		Args: cobra.NoArgs,
+		RunE: runCommit,
+	}
+	cmd.Flags().StringVar(&commitTarget, "target", "", "Directory to apply the upper layer onto (default: the topmost lower layer)")
+	cmd.Flags().BoolVarP(&commitDryRun, "dry-run", "n", false, "Print the changes that would be applied without applying them")
+	cmd.Flags().BoolVar(&commitForce, "force", false, "Commit even if the lower layers changed since the session started")
+	return cmd
+}
+
+func runCommit(cmd *cobra.Command, args []string) error {
+	if err := applyConfig(); err != nil {
+		return err
+	}
+	fs, lowerDirs, err := newOverlay()
+	if err != nil {
+		return err
+	}
+	target := commitTarget
+	if target == "" {
+		if len(lowerDirs) == 0 {
+			return fmt.Errorf("no lower layer to commit to (use --target)")
+		}
+		target = lowerDirs[0]
+	}
+
+	cmd.SilenceUsage = true
+	changes, err := fs.Commit(overlay.CommitOptions{
+		Target: target,
+		DryRun: commitDryRun,
+		Force:  commitForce,
+	})
+	if errors.Is(err, overlay.ErrNoSession) || errors.Is(err, overlay.ErrLowerChanged) {
+		return fmt.Errorf("%w (use --force to commit anyway)", err)
+	}
+	if err != nil {
+		return err
+	}
+	if commitDryRun {
+		printChanges(cmd.OutOrStdout(), changes)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/psarna/fuss/pkg/overlay"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffJSON       bool
+	diffNameStatus bool
+	diffPatch      bool
+)
+
+func newDiffCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff [flags] [path...]",
+		Short: "Show what the upper layer changes in the lower layers",
+		Long: `diff walks the upper directory and reports the paths it adds, modifies,
+deletes or only changes the metadata of (permissions, owner, modification
+time or extended attributes) relative to the lower directories. Whiteouts of both styles and
+opaque directories are reported as the deletions they stand for. Paths are
+as seen under the mountpoint; given paths limit the report to them.
+
+With --name-status, each line is a status letter and a path: A (added),
+M (modified), D (deleted) or P (metadata only).
+
+Example:
+  fuss diff --upperdir /tmp/changes --lowerdir /layers/base
+  fuss diff --sandbox-host --upperdir /tmp/try --patch /etc`,
+		RunE: runDiff,
+	}
+	cmd.Flags().BoolVar(&diffJSON, "json", false, "Print the changes as a JSON array")
+	cmd.Flags().BoolVar(&diffNameStatus, "name-status", false, "Print a status letter and the path of each change")
+	cmd.Flags().BoolVarP(&diffPatch, "patch", "p", false, "Also print a unified diff of changed text files")
+	return cmd
+}
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	if diffJSON && diffNameStatus {
+		return fmt.Errorf("--json and --name-status are mutually exclusive")
+	}
+	if diffPatch && (diffJSON || diffNameStatus) {
+		return fmt.Errorf("--patch only goes with the default output")
+	}
+	if err := applyConfig(); err != nil {
+		return err
+	}
+	fs, _, err := newOverlay()
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+	changes, err := fs.Diff()
+	if err != nil {
+		return err
+	}
+	changes = filterChanges(changes, args)
+
+	out := cmd.OutOrStdout()
+	switch {
+	case diffJSON:
+		return printChangesJSON(out, changes)
+	case diffNameStatus:
+		for _, c := range changes {
+			fmt.Fprintf(out, "%s\t%s\n", statusLetter(c.Kind), c.Path)
+		}
+	default:
+		printChanges(out, changes)
+		if diffPatch {
+			for _, c := range changes {
+				if err := printPatch(out, c); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func printChanges(w io.Writer, changes []overlay.Change) {
+	for _, c := range changes {
+		line := fmt.Sprintf("%-9s %s", c.Kind, displayPath(c))
+		if len(c.Details) > 0 {
+			line += " (" + strings.Join(c.Details, ", ") + ")"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// filterChanges keeps the changes at or below the given overlay paths.
+func filterChanges(changes []overlay.Change, paths []string) []overlay.Change {
+	if len(paths) == 0 {
+		return changes
+	}
+	var kept []overlay.Change
+	for _, c := range changes {
+		for _, p := range paths {
+			p = filepath.Clean("/" + p)
+			if p == "/" || c.Path == p || strings.HasPrefix(c.Path, p+"/") {
+				kept = append(kept, c)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+func statusLetter(kind overlay.ChangeKind) string {
+	switch kind {
+	case overlay.Added:
+		return "A"
+	case overlay.Modified:
+		return "M"
+	case overlay.Deleted:
+		return "D"
+	case overlay.MetadataChanged:
+		return "P"
+	}
+	return "?"
+}
+
+func displayPath(c overlay.Change) string {
+	if c.Mode.IsDir() {
+		return c.Path + "/"
+	}
+	return c.Path
+}
+
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeCharDevice != 0:
+		return "chardev"
+	case mode&os.ModeDevice != 0:
+		return "blockdev"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	}
+	return "unknown"
+}
+
+func printChangesJSON(w io.Writer, changes []overlay.Change) error {
+	type jsonChange struct {
+		Path    string   `json:"path"`
+		Change  string   `json:"change"`
+		Type    string   `json:"type"`
+		Details []string `json:"details,omitempty"`
+	}
+	list := make([]jsonChange, 0, len(changes))
+	for _, c := range changes {
+		list = append(list, jsonChange{
+			Path:    c.Path,
+			Change:  c.Kind.String(),
+			Type:    fileType(c.Mode),
+			Details: c.Details,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(list)
+}
+
+// printPatch writes the unified diff of a regular file the change adds,
+// modifies or deletes.
+func printPatch(w io.Writer, c overlay.Change) error {
+	if c.Kind == overlay.MetadataChanged {
+		return nil
+	}
+	nameA, nameB := "a"+c.Path, "b"+c.Path
+	var a, b []byte
+	var err error
+	if c.Lower != "" {
+		if info, err := os.Lstat(c.Lower); err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if a, err = os.ReadFile(c.Lower); err != nil {
+			return err
+		}
+	} else {
+		nameA = "/dev/null"
+	}
+	if c.Upper != "" {
+		if !c.Mode.IsRegular() {
+			return nil
+		}
+		if b, err = os.ReadFile(c.Upper); err != nil {
+			return err
+		}
+	} else {
+		nameB = "/dev/null"
+	}
+
+	if !isText(a) || !isText(b) {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", nameA, nameB)
+		return nil
+	}
+	writeUnified(w, nameA, nameB, a, b)
+	return nil
+}
@@ -19,13 +19,25 @@ var (
 	lowerdir      string
 	upperdir      string
 	whiteoutStyle string
+	waitPolicy    string
+	deferCopyUp   bool
+	sandboxHost   bool
+	passthrough   string
+	attachPid     int
 )
 
+// Paths left to the host in --sandbox-host mode whatever --passthrough says.
+var defaultPassthrough = []string{"/proc", "/sys", "/dev"}
+
 type config struct {
-	Mountpoint string `yaml:"mountpoint"`
-	Lowerdir   string `yaml:"lowerdir"`
-	Upperdir   string `yaml:"upperdir"`
-	Whiteout   string `yaml:"whiteout"`
+	Mountpoint  string `yaml:"mountpoint"`
+	Lowerdir    string `yaml:"lowerdir"`
+	Upperdir    string `yaml:"upperdir"`
+	Whiteout    string `yaml:"whiteout"`
+	Wait        string `yaml:"wait"`
+	DeferCopyUp bool   `yaml:"defer_copyup"`
+	SandboxHost bool   `yaml:"sandbox_host"`
+	Passthrough string `yaml:"passthrough"`
 }
 
 func configPath() string {
@@ -70,19 +82,62 @@ Configuration:
     upperdir: /tmp/changes
     lowerdir: /layers/base:/layers/extra
     whiteout: fileprefix
+    wait: all
+    defer_copyup: true
+
+Sandbox mode:
+  With --sandbox-host, the whole host is the lower layer and / the
+  mountpoint: every write anywhere lands in the upper directory, except
+  under /proc, /sys, /dev and the --passthrough paths, which are left to
+  the host.
 
 Example:
   fuss --mountpoint /app --upperdir /tmp/changes --lowerdir /layers/base -- ls -la /app
-  fuss -- ls -la /app  # uses ~/.fuss config`,
+  fuss -- ls -la /app  # uses ~/.fuss config
+  fuss --sandbox-host --upperdir /tmp/try -- ./install.sh`,
 		Args:               cobra.MinimumNArgs(1),
 		DisableFlagParsing: false,
 		RunE:               run,
 	}
 
-	rootCmd.Flags().StringVar(&mountpoint, "mountpoint", "", "Virtual mount point")
-	rootCmd.Flags().StringVar(&lowerdir, "lowerdir", "", "Read-only lower layers, colon-separated (rightmost = bottom)")
-	rootCmd.Flags().StringVar(&upperdir, "upperdir", "", "Writable upper layer directory")
-	rootCmd.Flags().StringVar(&whiteoutStyle, "whiteout", "", "Whiteout style: chardev or fileprefix (default: fileprefix)")
+	rootCmd.PersistentFlags().StringVar(&mountpoint, "mountpoint", "", "Virtual mount point")
+	rootCmd.PersistentFlags().StringVar(&lowerdir, "lowerdir", "", "Read-only lower layers, colon-separated (rightmost = bottom)")
+	rootCmd.PersistentFlags().StringVar(&upperdir, "upperdir", "", "Writable upper layer directory")
+	rootCmd.PersistentFlags().StringVar(&whiteoutStyle, "whiteout", "", "Whiteout style: chardev or fileprefix (default: fileprefix)")
+	rootCmd.PersistentFlags().StringVar(&waitPolicy, "wait", "", "When the command exits: all (wait for descendants), main (detach them) or kill (kill them) (default: all)")
+	rootCmd.PersistentFlags().BoolVar(&deferCopyUp, "defer-copyup", false, "Copy lower files up on the first write instead of when they are opened for writing")
+	rootCmd.PersistentFlags().BoolVar(&sandboxHost, "sandbox-host", false, "Overlay the whole host: / is the mountpoint and the only lower layer")
+	rootCmd.PersistentFlags().StringVar(&passthrough, "passthrough", "", "Paths left to the host with --sandbox-host, colon-separated (besides /proc, /sys and /dev)")
+
+	attachCmd := &cobra.Command{
+		Use:   "attach --pid PID",
+		Short: "Attach to a running process tree and redirect the mountpoint",
+		Long: `attach seizes an already-running process together with all its threads and
+descendants. From that moment on, paths under the mountpoint are redirected
+through the overlay. Interrupting fuss, or running "fuss detach", releases
+the whole tree and leaves it running.
+
+Example:
+  fuss attach --pid 1234 --mountpoint /app --upperdir /tmp/changes --lowerdir /layers/base`,
+		Args: cobra.NoArgs,
+		RunE: runAttach,
+	}
+	attachCmd.Flags().IntVar(&attachPid, "pid", 0, "Process to attach to")
+	attachCmd.MarkFlagRequired("pid")
+
+	detachCmd := &cobra.Command{
+		Use:   "detach --pid PID",
+		Short: "Release a process tree previously attached with fuss attach",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return tracer.Detach(attachPid)
+		},
+	}
+	detachCmd.Flags().IntVar(&attachPid, "pid", 0, "Any process in the attached tree")
+	detachCmd.MarkFlagRequired("pid")
+
+	rootCmd.AddCommand(attachCmd, detachCmd, newDiffCommand(), newCommitCommand())
 
 	if err := rootCmd.Execute(); err != nil {
 		var exitErr interface {
@@ -95,21 +150,35 @@ Example:
 	}
 }
 
-func run(cmd *cobra.Command, args []string) error {
+// applyConfig fills in the flags not given on the command line from
+// ~/.fuss.
+func applyConfig() error {
 	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
 
-	if mountpoint == "" && cfg != nil {
+	if !sandboxHost && cfg != nil {
+		sandboxHost = cfg.SandboxHost
+	}
+	if mountpoint == "" && !sandboxHost && cfg != nil {
 		mountpoint = cfg.Mountpoint
 	}
 	if upperdir == "" && cfg != nil {
 		upperdir = cfg.Upperdir
 	}
-	if lowerdir == "" && cfg != nil {
+	if lowerdir == "" && !sandboxHost && cfg != nil {
 		lowerdir = cfg.Lowerdir
 	}
+	if passthrough == "" && sandboxHost && cfg != nil {
+		passthrough = cfg.Passthrough
+	}
+	if waitPolicy == "" && cfg != nil {
+		waitPolicy = cfg.Wait
+	}
+	if !deferCopyUp && cfg != nil {
+		deferCopyUp = cfg.DeferCopyUp
+	}
 	if whiteoutStyle == "" {
 		if cfg != nil && cfg.Whiteout != "" {
 			whiteoutStyle = cfg.Whiteout
@@ -117,27 +186,36 @@ func run(cmd *cobra.Command, args []string) error {
 			whiteoutStyle = "fileprefix"
 		}
 	}
+	return nil
+}
 
-	if mountpoint == "" {
-		return fmt.Errorf("mountpoint is required (use --mountpoint or set in %s)", configPath())
+// newOverlay checks the upper and lower layers and stacks them.
+func newOverlay() (*overlay.OverlayFS, []string, error) {
+	var lowerDirs []string
+	if sandboxHost {
+		if mountpoint != "" || lowerdir != "" {
+			return nil, nil, fmt.Errorf("--sandbox-host uses the host root as mountpoint and lower layer, and takes no --mountpoint or --lowerdir")
+		}
+		mountpoint = "/"
+		lowerDirs = []string{"/"}
 	}
+
 	if upperdir == "" {
-		return fmt.Errorf("upperdir is required (use --upperdir or set in %s)", configPath())
+		return nil, nil, fmt.Errorf("upperdir is required (use --upperdir or set in %s)", configPath())
 	}
 
-	var lowerDirs []string
 	if lowerdir != "" {
 		lowerDirs = strings.Split(lowerdir, ":")
 	}
 
 	for _, dir := range lowerDirs {
 		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
-			return fmt.Errorf("lower directory does not exist: %s", dir)
+			return nil, nil, fmt.Errorf("lower directory does not exist: %s", dir)
 		}
 	}
 
 	if info, err := os.Stat(upperdir); err != nil || !info.IsDir() {
-		return fmt.Errorf("upper directory does not exist: %s", upperdir)
+		return nil, nil, fmt.Errorf("upper directory does not exist: %s", upperdir)
 	}
 
 	var style overlay.WhiteoutStyle
@@ -147,7 +225,7 @@ func run(cmd *cobra.Command, args []string) error {
 	case "fileprefix":
 		style = overlay.WhiteoutFilePrefix
 	default:
-		return fmt.Errorf("unknown whiteout style: %s", whiteoutStyle)
+		return nil, nil, fmt.Errorf("unknown whiteout style: %s", whiteoutStyle)
 	}
 
 	vfs := overlay.New(overlay.Config{
@@ -155,12 +233,69 @@ func run(cmd *cobra.Command, args []string) error {
 		UpperDir:      upperdir,
 		WhiteoutStyle: style,
 	})
+	return vfs, lowerDirs, nil
+}
+
+func newTracer() (*tracer.Tracer, error) {
+	if err := applyConfig(); err != nil {
+		return nil, err
+	}
+
+	var passthroughPaths []string
+	if sandboxHost {
+		passthroughPaths = append(passthroughPaths, defaultPassthrough...)
+		// The upper directory is under the lower one, /. Copying its files
+		// up would nest them in it again.
+		passthroughPaths = append(passthroughPaths, upperdir)
+		if passthrough != "" {
+			passthroughPaths = append(passthroughPaths, strings.Split(passthrough, ":")...)
+		}
+	} else if passthrough != "" {
+		return nil, fmt.Errorf("--passthrough needs --sandbox-host")
+	}
+
+	if mountpoint == "" && !sandboxHost {
+		return nil, fmt.Errorf("mountpoint is required (use --mountpoint or set in %s)", configPath())
+	}
+	vfs, lowerDirs, err := newOverlay()
+	if err != nil {
+		return nil, err
+	}
+	if err := vfs.StartSession(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot record the session start in %s: %v (fuss commit will need --force)\n", upperdir, err)
+	}
+
+	policy, err := tracer.ParseWaitPolicy(waitPolicy)
+	if err != nil {
+		return nil, err
+	}
 
 	backingPaths := append([]string{}, lowerDirs...)
 	backingPaths = append(backingPaths, upperdir)
 	t := tracer.NewTracer(vfs, mountpoint, backingPaths...)
+	t.SetWaitPolicy(policy)
+	t.SetDeferCopyUp(deferCopyUp)
+	t.SetPassthrough(passthroughPaths...)
+	return t, nil
+}
+
+func run(cmd *cobra.Command, args []string) error {
+	t, err := newTracer()
+	if err != nil {
+		return err
+	}
 
 	// Child process failures should propagate as exit status without printing fuss usage.
 	cmd.SilenceUsage = true
 	return t.Run(args)
 }
+
+func runAttach(cmd *cobra.Command, args []string) error {
+	t, err := newTracer()
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+	return t.Attach(attachPid)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Lines of context around each hunk, as in diff -u.
+const diffContext = 3
+
+type edit struct {
+	op   byte // ' ', '-' or '+'
+	line string
+}
+
+// splitLines splits text after each newline. The last line may lack one.
+func splitLines(text []byte) []string {
+	if len(text) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// isText guesses whether data is text the way diff does: by the absence of
+// NUL bytes.
+func isText(data []byte) bool {
+	return bytes.IndexByte(data, 0) < 0
+}
+
+// diffLines returns the shortest edit script from a to b, found with the
+// linear-space variant of Myers' algorithm.
+func diffLines(a, b []string) []edit {
+	var edits []edit
+	diffRange(a, b, &edits)
+	return edits
+}
+
+// diffRange appends the edits from a to b. Past their common prefix and
+// suffix, the problem is split at the middle snake of its shortest edit
+// script, so that only the two frontiers of the search are kept in memory.
+func diffRange(a, b []string, edits *[]edit) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for _, line := range a[:prefix] {
+		*edits = append(*edits, edit{' ', line})
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	if x, y, ok := middleSnake(a, b); ok {
+		diffRange(a[:x], b[:y], edits)
+		diffRange(a[x:], b[y:], edits)
+	} else {
+		for _, line := range a {
+			*edits = append(*edits, edit{'-', line})
+		}
+		for _, line := range b {
+			*edits = append(*edits, edit{'+', line})
+		}
+	}
+	for _, line := range common {
+		*edits = append(*edits, edit{' ', line})
+	}
+}
+
+// middleSnake searches for the shortest edit script from a to b from both
+// ends at once and returns where the two searches meet. It returns false
+// when a and b have no line in common, or one of them is empty.
+func middleSnake(a, b []string) (x, y int, ok bool) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	// forward[offset+k] is the furthest x reached on diagonal k = x - y
+	// from the start, backward[offset+k] the same from the end, with x
+	// and y counted backwards.
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := n - m
+	// With an odd delta, the forward search is the one to meet the other.
+	front := delta%2 != 0
+	// Diagonals that ran off an edge and need not be searched any more.
+	kStart, kEnd, rStart, rEnd := 0, 0, 0, 0
+
+	for d := 0; d < maxD; d++ {
+		for k := -d + kStart; k <= d-kEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && forward[i-1] < forward[i+1]) {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[i] = x
+			switch {
+			case x > n:
+				kEnd += 2
+			case y > m:
+				kStart += 2
+			case front:
+				j := offset + delta - k
+				if j >= 0 && j < len(backward) && backward[j] != -1 && x >= n-backward[j] {
+					return x, y, true
+				}
+			}
+		}
+
+		for k := -d + rStart; k <= d-rEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && backward[i-1] < backward[i+1]) {
+				x = backward[i+1]
+			} else {
+				x = backward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[i] = x
+			switch {
+			case x > n:
+				rEnd += 2
+			case y > m:
+				rStart += 2
+			case !front:
+				j := offset + delta - k
+				if j >= 0 && j < len(forward) && forward[j] != -1 {
+					fx := forward[j]
+					fy := offset + fx - j
+					if fx >= n-x {
+						return fx, fy, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// writeUnified writes the unified diff of a and b under the given names.
+// Nothing is written when they are equal.
+func writeUnified(w io.Writer, nameA, nameB string, a, b []byte) {
+	edits := diffLines(splitLines(a), splitLines(b))
+
+	changed := false
+	for _, e := range edits {
+		if e.op != ' ' {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+
+	// lineA and lineB count the lines of a and b before edits[i].
+	lineA, lineB := 0, 0
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			lineA++
+			lineB++
+			i++
+			continue
+		}
+
+		// A hunk starts diffContext lines before the change and runs until
+		// more than twice that many unchanged lines follow one.
+		start := i
+		for start > 0 && i-start < diffContext && edits[start-1].op == ' ' {
+			start--
+		}
+		startA, startB := lineA-(i-start), lineB-(i-start)
+		end := i
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(edits) && edits[run].op == ' ' {
+				run++
+			}
+			if run == len(edits) || run-end > 2*diffContext {
+				end = min(end+diffContext, run)
+				break
+			}
+			end = run
+		}
+
+		countA, countB := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				countA++
+			}
+			if e.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(startA, countA), hunkRange(startB, countB))
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(w, "%c%s", e.op, e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+
+		for _, e := range edits[i:end] {
+			if e.op != '+' {
+				lineA++
+			}
+			if e.op != '-' {
+				lineB++
+			}
+		}
+		i = end
+	}
+}
+
+// hunkRange formats the lines of a hunk starting after line start.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/psarna/fuss/pkg/overlay"
+)
+
+// numbered returns the lines 1 to n, with the given ones replaced.
+func numbered(n int, replace map[int]string) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		if line, ok := replace[i]; ok {
+			sb.WriteString(line + "\n")
+			continue
+		}
+		fmt.Fprintf(&sb, "%d\n", i)
+	}
+	return sb.String()
+}
+
+func TestWriteUnified(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "equal",
+			a:    "same\n",
+			b:    "same\n",
+			want: "",
+		},
+		{
+			name: "one line",
+			a:    numbered(10, nil),
+			b:    numbered(10, map[int]string{5: "five"}),
+			want: "--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name: "from empty",
+			a:    "",
+			b:    "x\ny\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n",
+		},
+		{
+			name: "to empty",
+			a:    "x\n",
+			b:    "",
+			want: "--- a\n+++ b\n@@ -1 +0,0 @@\n-x\n",
+		},
+		{
+			name: "missing final newline",
+			a:    "a\n",
+			b:    "a",
+			want: "--- a\n+++ b\n@@ -1 +1 @@\n-a\n+a\n\\ No newline at end of file\n",
+		},
+		{
+			name: "separate hunks",
+			a:    numbered(20, nil),
+			b:    numbered(20, map[int]string{2: "two", 18: "eighteen"}),
+			want: "--- a\n+++ b\n@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n" +
+				"@@ -15,6 +15,6 @@\n 15\n 16\n 17\n-18\n+eighteen\n 19\n 20\n",
+		},
+		{
+			name: "merged hunks",
+			a:    numbered(20, nil),
+			b:    numbered(20, map[int]string{2: "two", 9: "nine"}),
+			want: "--- a\n+++ b\n@@ -1,12 +1,12 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n 8\n-9\n+nine\n 10\n 11\n 12\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			writeUnified(&out, "a", "b", []byte(tt.a), []byte(tt.b))
+			if got := out.String(); got != tt.want {
+				t.Errorf("writeUnified() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// lcsLen is the length of the longest common subsequence of a and b, which
+// a shortest edit script keeps.
+func lcsLen(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func TestDiffLinesShortest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(30))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(4)))
+		}
+		return lines
+	}
+
+	for i := 0; i < 2000; i++ {
+		a, b := randomLines(), randomLines()
+		var gotA, gotB []string
+		kept := 0
+		for _, e := range diffLines(a, b) {
+			if e.op != '+' {
+				gotA = append(gotA, e.line)
+			}
+			if e.op != '-' {
+				gotB = append(gotB, e.line)
+			}
+			if e.op == ' ' {
+				kept++
+			}
+		}
+		if strings.Join(gotA, ",") != strings.Join(a, ",") || strings.Join(gotB, ",") != strings.Join(b, ",") {
+			t.Fatalf("diffLines(%q, %q) does not turn one into the other", a, b)
+		}
+		if want := lcsLen(a, b); kept != want {
+			t.Fatalf("diffLines(%q, %q) keeps %d lines, want %d", a, b, kept, want)
+		}
+	}
+}
+
+func TestPrintPatch(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	lower := write("lower", "old\n")
+	upper := write("upper", "new\n")
+	binary := write("binary", "\x00\x01")
+
+	tests := []struct {
+		name   string
+		change overlay.Change
+		want   string
+	}{
+		{
+			name:   "added",
+			change: overlay.Change{Path: "/f", Kind: overlay.Added, Upper: upper, Mode: 0644},
+			want:   "--- /dev/null\n+++ b/f\n@@ -0,0 +1 @@\n+new\n",
+		},
+		{
+			name:   "deleted",
+			change: overlay.Change{Path: "/f", Kind: overlay.Deleted, Lower: lower, Mode: 0644},
+			want:   "--- a/f\n+++ /dev/null\n@@ -1 +0,0 @@\n-old\n",
+		},
+		{
+			name:   "modified",
+			change: overlay.Change{Path: "/f", Kind: overlay.Modified, Upper: upper, Lower: lower, Mode: 0644},
+			want:   "--- a/f\n+++ b/f\n@@ -1 +1 @@\n-old\n+new\n",
+		},
+		{
+			name:   "binary",
+			change: overlay.Change{Path: "/f", Kind: overlay.Modified, Upper: binary, Lower: lower, Mode: 0644},
+			want:   "Binary files a/f and b/f differ\n",
+		},
+		{
+			name:   "metadata only",
+			change: overlay.Change{Path: "/f", Kind: overlay.MetadataChanged, Upper: upper, Lower: lower, Mode: 0600},
+			want:   "",
+		},
+		{
+			name:   "directory",
+			change: overlay.Change{Path: "/d", Kind: overlay.Added, Upper: dir, Mode: os.ModeDir | 0755},
+			want:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := printPatch(&out, tt.change); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("printPatch() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
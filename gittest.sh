@@ -109,6 +109,64 @@ test -f "$upper/dir/file"
 test -f "$upper/dir/file.link"
 test "$(stat -c %i "$upper/dir/file")" = "$(stat -c %i "$upper/dir/file.link")"
 
+lower_chroot="$(mktemp -d /tmp/fuss-gittest-lower-chroot.XXXXXX)"
+mkdir -p "$lower_chroot/root/etc"
+cp --parents -L /bin/sh $(ldd /bin/sh | grep -o '/[^ ]*') "$lower_chroot/root"
+printf 'inside\n' > "$lower_chroot/root/etc/chroot-file"
+ln -s /etc/chroot-file "$lower_chroot/root/etc/abslink"
+
+go run ./cmd/fuss --lowerdir "$lower_chroot" --upperdir "$upper" --mountpoint "$mountpoint" -- \
+  sh -c 'chroot "$1/root" /bin/sh -c "read line < /etc/abslink && test \"\$line\" = inside"' -- "$mountpoint"
+
+lower_commit="$(mktemp -d /tmp/fuss-gittest-lower-commit.XXXXXX)"
+upper_commit="$(mktemp -d /tmp/fuss-gittest-upper-commit.XXXXXX)"
+target_commit="$(mktemp -d /tmp/fuss-gittest-target-commit.XXXXXX)"
+cleanup() {
+  rm -rf "$upper" "$mountpoint" "$lower_rename" "$lower_copyup" "$lower_chroot" \
+    "$lower_commit" "$upper_commit" "$target_commit"
+}
+mkdir "$lower_commit/opaque"
+printf 'base\n' > "$lower_commit/gone"
+printf 'old\n' > "$lower_commit/opaque/old"
+printf 'meta\n' > "$lower_commit/meta"
+chmod 644 "$lower_commit/meta"
+# An opaque directory as overlayfs leaves it after the lower one is replaced.
+mkdir "$upper_commit/opaque"
+: > "$upper_commit/opaque/.wh..wh..opq"
+go run ./cmd/fuss --lowerdir "$lower_commit" --upperdir "$upper_commit" --mountpoint "$mountpoint" -- \
+  sh -c 'rm "$1/gone" && printf "new\n" > "$1/opaque/new" && chmod 600 "$1/meta"' -- "$mountpoint"
+
+status="$(go run ./cmd/fuss diff --lowerdir "$lower_commit" --upperdir "$upper_commit" --mountpoint "$mountpoint" \
+  --name-status | sort)"
+test "$status" = "$(printf 'A\t/opaque/new\nD\t/gone\nD\t/opaque/old\nP\t/meta\n')"
+
+go run ./cmd/fuss commit --lowerdir "$lower_commit" --upperdir "$upper_commit" --mountpoint "$mountpoint" \
+  --target "$target_commit"
+test ! -e "$target_commit/gone"
+test ! -e "$target_commit/opaque/old"
+grep -qx new "$target_commit/opaque/new"
+test "$(stat -c %a "$target_commit/meta")" = 600
+test -f "$lower_commit/gone"
+
+# A lower path the upper directory changes was modified after the session.
+printf 'modified\n' > "$lower_commit/meta"
+! go run ./cmd/fuss commit --lowerdir "$lower_commit" --upperdir "$upper_commit" --mountpoint "$mountpoint"
+grep -qx modified "$lower_commit/meta"
+test -f "$lower_commit/gone"
+
+go run ./cmd/fuss commit --lowerdir "$lower_commit" --upperdir "$upper_commit" --mountpoint "$mountpoint" --force
+test ! -e "$lower_commit/gone"
+test ! -e "$lower_commit/opaque/old"
+grep -qx new "$lower_commit/opaque/new"
+grep -qx meta "$lower_commit/meta"
+test "$(stat -c %a "$lower_commit/meta")" = 600
+
+# strace sizes PTRACE_GET_SYSCALL_INFO by asking with a size of 0.
+if command -v strace >/dev/null; then
+  go run ./cmd/fuss --lowerdir "$lower_copyup" --upperdir "$upper" --mountpoint "$mountpoint" -- \
+    strace -f -o /dev/null true
+fi
+
 set +x
 
 echo "--------------"
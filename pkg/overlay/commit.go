@@ -0,0 +1,404 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sessionXattr records on the upper directory when the first session over
+// it started. Being private, it is not visible through the overlay.
+const sessionXattr = "user.overlay.fuss.session"
+
+// StartSession records that a session over the upper layer starts now,
+// unless an earlier one is recorded already. Commit refuses lower paths
+// changed after that.
+func (fs *OverlayFS) StartSession() error {
+	if _, ok := fs.sessionStart(); ok {
+		return nil
+	}
+	return fs.setSessionStart()
+}
+
+func (fs *OverlayFS) sessionStart() (time.Time, bool) {
+	val := make([]byte, 32)
+	n, err := unix.Getxattr(fs.upperDir, sessionXattr, val)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(string(val[:n]), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// setSessionStart records the session start as the ctime the xattr change
+// gives the upper directory. The kernel stamps ctimes from a clock that can
+// lag time.Now by a tick, so lower ctimes are compared with one from it.
+// Until the second write, the start reads as the epoch, which makes every
+// lower path look changed rather than none.
+func (fs *OverlayFS) setSessionStart() error {
+	if err := unix.Setxattr(fs.upperDir, sessionXattr, []byte("0"), 0); err != nil {
+		return err
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(fs.upperDir, &st); err != nil {
+		return err
+	}
+	return unix.Setxattr(fs.upperDir, sessionXattr, []byte(strconv.FormatInt(st.Ctim.Nano(), 10)), 0)
+}
+
+var (
+	ErrNoSession    = errors.New("no session start is recorded")
+	ErrLowerChanged = errors.New("lower layers changed since the session started")
+)
+
+type CommitOptions struct {
+	// Target is the topmost lower layer, or a directory that is missing or
+	// empty, which first gets a copy of the lower layers merged.
+	Target string
+	// DryRun only checks the target and returns the changes.
+	DryRun bool
+	// Force commits even if the lower layers changed since the session
+	// started, or no session start is recorded.
+	Force bool
+}
+
+// Commit applies the upper layer onto a target directory and returns the
+// changes applied, as Diff reports them. Whiteouts become deletions, or
+// whiteouts in the target where the layers below it still have the path,
+// and opaque directories replace the ones in the target.
+func (fs *OverlayFS) Commit(opts CommitOptions) ([]Change, error) {
+	target, err := filepath.Abs(opts.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	fresh := true
+	for i, lower := range fs.lowerDirs {
+		if !sameFile(target, lower) {
+			continue
+		}
+		if i > 0 {
+			return nil, fmt.Errorf("%s is not the topmost lower layer", opts.Target)
+		}
+		fresh = false
+	}
+	if fresh {
+		entries, err := os.ReadDir(target)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			return nil, fmt.Errorf("%s is neither the topmost lower layer nor an empty directory", opts.Target)
+		}
+	}
+
+	changes, err := fs.Diff()
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.Force {
+		since, ok := fs.sessionStart()
+		if !ok {
+			return nil, fmt.Errorf("%w in %s", ErrNoSession, fs.upperDir)
+		}
+		if changed := fs.changedSince(changes, since); len(changed) > 0 {
+			if len(changed) > 5 {
+				changed = append(changed[:5], "...")
+			}
+			return nil, fmt.Errorf("%w: %s", ErrLowerChanged, strings.Join(changed, ", "))
+		}
+	}
+
+	if opts.DryRun {
+		return changes, nil
+	}
+
+	var below []string
+	if fresh {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return nil, err
+		}
+		if err := fs.copyLowers("/", target); err != nil {
+			return nil, err
+		}
+	} else {
+		below = fs.lowerDirs[1:]
+	}
+
+	if err := fs.commitDir("/", target, below); err != nil {
+		return nil, err
+	}
+	if !fresh {
+		// The lower layers now hold what the upper layer was based on.
+		if err := fs.setSessionStart(); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
+
+// changedSince returns the paths a change touches that changed in a lower
+// layer after since. A path is checked in every layer, through the nearest
+// of it and its parents that exists there: a directory's ctime moves when
+// entries are added, removed or renamed in it, so this also catches lower
+// files deleted or created since, including under opaque directories.
+func (fs *OverlayFS) changedSince(changes []Change, since time.Time) []string {
+	var changed []string
+	for _, c := range changes {
+		if fs.lowerChangedSince(c.Path, since) {
+			changed = append(changed, c.Path)
+		}
+	}
+	return changed
+}
+
+// lowerChangedSince reports whether path, or its closest existing parent, was
+// changed in a lower layer since the session start. A change stamped with the
+// same tick as the start may have come after it, so it counts.
+func (fs *OverlayFS) lowerChangedSince(path string, since time.Time) bool {
+	for _, lower := range fs.lowerDirs {
+		for p := path; ; p = filepath.Dir(p) {
+			var st syscall.Stat_t
+			if err := syscall.Lstat(filepath.Join(lower, p), &st); err == nil {
+				if !time.Unix(st.Ctim.Unix()).Before(since) {
+					return true
+				}
+				break
+			}
+			if p == "/" {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// copyLowers copies dir of the lower layers merged into target.
+func (fs *OverlayFS) copyLowers(dir, target string) error {
+	for _, name := range layerNames(fs.lowerDirs, dir) {
+		path := filepath.Join(dir, name)
+		src, ok := layerPath(fs.lowerDirs, path)
+		if !ok {
+			continue
+		}
+		dst := filepath.Join(target, path)
+		if err := commitEntry(src, dst); err != nil {
+			return err
+		}
+		if info, err := os.Lstat(src); err == nil && info.IsDir() {
+			if err := fs.copyLowers(path, target); err != nil {
+				return err
+			}
+			commitTimes(src, dst)
+		}
+	}
+	return nil
+}
+
+// commitDir applies the upper directory of dir onto target. below are the
+// layers under the target, whose paths need whiteouts to be deleted.
+func (fs *OverlayFS) commitDir(dir, target string, below []string) error {
+	upperDir := filepath.Join(fs.upperDir, dir)
+	targetDir := filepath.Join(target, dir)
+	entries, err := os.ReadDir(upperDir)
+	if err != nil {
+		return err
+	}
+
+	opaque := dir != "/" && isOpaqueDir(upperDir)
+	if opaque {
+		old, err := os.ReadDir(targetDir)
+		if err != nil {
+			return err
+		}
+		for _, e := range old {
+			if err := os.RemoveAll(filepath.Join(targetDir, e.Name())); err != nil {
+				return err
+			}
+		}
+		if len(layerNames(below, dir)) > 0 {
+			if err := setOpaqueDir(targetDir, fs.whiteoutStyle); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(dir, name)
+		upperPath := filepath.Join(upperDir, name)
+		targetPath := filepath.Join(targetDir, name)
+
+		if name == opaqueMarkerFile {
+			continue
+		}
+		if isWhiteoutName(name) || isWhiteoutCharDev(upperPath) {
+			if isWhiteoutName(name) {
+				path = filepath.Join(dir, whiteoutTarget(name))
+				targetPath = filepath.Join(target, path)
+			}
+			if err := os.RemoveAll(targetPath); err != nil {
+				return err
+			}
+			if _, ok := layerPath(below, path); ok && !opaque {
+				if err := createWhiteout(targetPath, fs.whiteoutStyle); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		info, err := os.Lstat(upperPath)
+		if err != nil {
+			return err
+		}
+		removeWhiteout(targetPath, fs.whiteoutStyle)
+
+		if !info.IsDir() {
+			if err := os.RemoveAll(targetPath); err != nil {
+				return err
+			}
+			if err := commitEntry(upperPath, targetPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if ti, err := os.Lstat(targetPath); err == nil && !ti.IsDir() {
+			if err := os.RemoveAll(targetPath); err != nil {
+				return err
+			}
+		}
+		if err := commitEntry(upperPath, targetPath); err != nil {
+			return err
+		}
+		if err := fs.commitDir(path, target, below); err != nil {
+			return err
+		}
+		commitTimes(upperPath, targetPath)
+	}
+	return nil
+}
+
+// commitEntry copies src to dst with its type, permissions, owner, extended
+// attributes and timestamps. A directory at dst is kept, with only its
+// metadata replaced.
+func commitEntry(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	st := info.Sys().(*syscall.Stat_t)
+
+	switch info.Mode().Type() {
+	case os.ModeDir:
+		if err := os.Mkdir(dst, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case os.ModeSymlink:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+	case 0:
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+	default:
+		if err := unix.Mknod(dst, st.Mode, int(st.Rdev)); err != nil {
+			return err
+		}
+	}
+
+	os.Lchown(dst, int(st.Uid), int(st.Gid))
+	if info.Mode()&os.ModeSymlink == 0 {
+		if err := unix.Fchmodat(unix.AT_FDCWD, dst, st.Mode&07777, 0); err != nil {
+			return err
+		}
+	}
+	if err := commitXattrs(src, dst); err != nil {
+		return err
+	}
+	commitTimes(src, dst)
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// commitXattrs makes the extended attributes of dst those of src, leaving
+// the private ones of the overlay alone. Nothing is removed unless both
+// could be listed.
+func commitXattrs(src, dst string) error {
+	want, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+	have, err := listXattrs(dst)
+	if err != nil {
+		return err
+	}
+	for name := range have {
+		if _, ok := want[name]; !ok {
+			if err := unix.Lremovexattr(dst, name); err != nil {
+				return &os.PathError{Op: "lremovexattr " + name, Path: dst, Err: err}
+			}
+		}
+	}
+	for name, val := range want {
+		if err := unix.Lsetxattr(dst, name, []byte(val), 0); err != nil {
+			return &os.PathError{Op: "lsetxattr " + name, Path: dst, Err: err}
+		}
+	}
+	return nil
+}
+
+func commitTimes(src, dst string) {
+	var st unix.Stat_t
+	if err := unix.Lstat(src, &st); err != nil {
+		return
+	}
+	unix.UtimesNanoAt(unix.AT_FDCWD, dst, []unix.Timespec{st.Atim, st.Mtim}, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,342 @@
+package overlay
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readTree lists the files under root the way writeTree takes them:
+// directories with a trailing "/", and files with their content.
+func readTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	tree := map[string]string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		name, _ := filepath.Rel(root, path)
+		if info.IsDir() {
+			tree[name+"/"] = ""
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		tree[name] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// setSession records at as the session start of upper.
+func setSession(t *testing.T, upper string, at time.Time) {
+	t.Helper()
+	if err := unix.Setxattr(upper, sessionXattr, []byte(strconv.FormatInt(at.UnixNano(), 10)), 0); err != nil {
+		t.Skipf("cannot record a session start here: %v", err)
+	}
+}
+
+// nextTick waits until the kernel stamps changes with a later ctime than
+// everything under dir got so far.
+func nextTick(t *testing.T, dir string) {
+	t.Helper()
+	var last int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			last = max(last, info.Sys().(*syscall.Stat_t).Ctim.Nano())
+		}
+		return nil
+	})
+	probe := filepath.Join(t.TempDir(), "probe")
+	for {
+		if err := os.WriteFile(probe, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(probe, &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Ctim.Nano() > last {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func fileMode(t *testing.T, path string) os.FileMode {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Mode().Perm()
+}
+
+func TestCommit(t *testing.T) {
+	tests := []struct {
+		name   string
+		bottom map[string]string
+		top    map[string]string
+		upper  map[string]string
+		fresh  bool
+		want   map[string]string
+	}{
+		{
+			name: "top lower",
+			top:  map[string]string{"gone": "gone\n", "kept": "kept\n", "file": "old\n", "dir/old": "old\n"},
+			upper: map[string]string{
+				whiteoutName("gone"): "", "file": "new\n", "added": "added\n",
+				"dir/" + opaqueMarkerFile: "", "dir/new": "new\n",
+			},
+			want: map[string]string{"kept": "kept\n", "file": "new\n", "added": "added\n", "dir/": "", "dir/new": "new\n"},
+		},
+		{
+			name:   "top lower over a layer with the deleted paths",
+			bottom: map[string]string{"gone": "gone\n", "dir/old": "old\n"},
+			top:    map[string]string{"gone": "gone\n", "dir/": ""},
+			upper: map[string]string{
+				whiteoutName("gone"):      "",
+				"dir/" + opaqueMarkerFile: "",
+				"dir/new":                 "new\n",
+			},
+			want: map[string]string{
+				whiteoutName("gone"):      "",
+				"dir/":                    "",
+				"dir/" + opaqueMarkerFile: "",
+				"dir/new":                 "new\n",
+			},
+		},
+		{
+			name:   "fresh target",
+			bottom: map[string]string{"hidden": "bottom\n", "shadowed": "bottom\n", "dir/old": "old\n"},
+			top:    map[string]string{whiteoutName("hidden"): "", "shadowed": "top\n", "gone": "gone\n"},
+			upper: map[string]string{
+				whiteoutName("gone"): "", "added": "added\n",
+				"dir/" + opaqueMarkerFile: "", "dir/new": "new\n",
+			},
+			fresh: true,
+			want:  map[string]string{"shadowed": "top\n", "added": "added\n", "dir/": "", "dir/new": "new\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			top, upper := t.TempDir(), t.TempDir()
+			writeTree(t, top, tt.top)
+			writeTree(t, upper, tt.upper)
+			lowers := []string{top}
+			if tt.bottom != nil {
+				bottom := t.TempDir()
+				writeTree(t, bottom, tt.bottom)
+				lowers = append(lowers, bottom)
+			}
+			start := time.Now().Add(time.Hour)
+			setSession(t, upper, start)
+
+			target := top
+			if tt.fresh {
+				target = filepath.Join(t.TempDir(), "target")
+			}
+			topBefore := readTree(t, top)
+
+			fs := New(Config{LowerDirs: lowers, UpperDir: upper})
+			if _, err := fs.Commit(CommitOptions{Target: target}); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTree(t, target); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("target = %q, want %q", got, tt.want)
+			}
+
+			since, _ := fs.sessionStart()
+			if tt.fresh {
+				if got := readTree(t, top); !reflect.DeepEqual(got, topBefore) {
+					t.Errorf("top lower = %q, want it untouched: %q", got, topBefore)
+				}
+				if !since.Equal(start) {
+					t.Errorf("session start = %v after committing to a fresh target, want %v kept", since, start)
+				}
+			} else if !since.Before(start) {
+				t.Errorf("session start = %v after committing to the top lower, want it reset", since)
+			}
+		})
+	}
+}
+
+func TestCommitMetadata(t *testing.T) {
+	lower, upper := t.TempDir(), t.TempDir()
+	writeTree(t, lower, map[string]string{"file": "same\n"})
+	writeTree(t, upper, map[string]string{"file": "same\n"})
+	if err := os.Chmod(filepath.Join(upper, "file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(upper, "file"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	setSession(t, upper, time.Now().Add(time.Hour))
+
+	fs := New(Config{LowerDirs: []string{lower}, UpperDir: upper})
+	if _, err := fs.Commit(CommitOptions{Target: lower}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(lower, "file")
+	if mode := fileMode(t, path); mode != 0600 {
+		t.Errorf("mode = %04o, want 0600", mode)
+	}
+	if info, err := os.Lstat(path); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("mtime = %v (%v), want %v", info.ModTime(), err, mtime)
+	}
+}
+
+func TestCommitDryRun(t *testing.T) {
+	lower, upper := t.TempDir(), t.TempDir()
+	writeTree(t, lower, map[string]string{"gone": "gone\n"})
+	writeTree(t, upper, map[string]string{whiteoutName("gone"): "", "added": "added\n"})
+	setSession(t, upper, time.Now().Add(time.Hour))
+
+	fs := New(Config{LowerDirs: []string{lower}, UpperDir: upper})
+	changes, err := fs.Commit(CommitOptions{Target: lower, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("Commit() = %+v, want the addition and the deletion", changes)
+	}
+	if got, want := readTree(t, lower), map[string]string{"gone": "gone\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lower = %q, want %q", got, want)
+	}
+}
+
+func TestCommitTarget(t *testing.T) {
+	top, bottom, upper := t.TempDir(), t.TempDir(), t.TempDir()
+	full := t.TempDir()
+	writeTree(t, full, map[string]string{"file": "file\n"})
+	fs := New(Config{LowerDirs: []string{top, bottom}, UpperDir: upper})
+
+	for _, target := range []string{bottom, full} {
+		if _, err := fs.Commit(CommitOptions{Target: target, Force: true}); err == nil {
+			t.Errorf("Commit() onto %s succeeded, want it refused", target)
+		}
+	}
+	if got, want := readTree(t, full), map[string]string{"file": "file\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("target = %q, want it untouched: %q", got, want)
+	}
+}
+
+func TestCommitStaleLower(t *testing.T) {
+	tests := []struct {
+		name  string
+		upper map[string]string
+		// edit changes the lower layer once the session started.
+		edit  func(t *testing.T, lower string)
+		force bool
+		want  error
+	}{
+		{
+			name:  "modified",
+			upper: map[string]string{"file": "new\n"},
+			edit: func(t *testing.T, lower string) {
+				writeTree(t, lower, map[string]string{"file": "edited\n"})
+			},
+			want: ErrLowerChanged,
+		},
+		{
+			name:  "deleted",
+			upper: map[string]string{"file": "new\n"},
+			edit: func(t *testing.T, lower string) {
+				if err := os.Remove(filepath.Join(lower, "file")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: ErrLowerChanged,
+		},
+		{
+			name:  "created",
+			upper: map[string]string{"dir/new": "new\n"},
+			edit: func(t *testing.T, lower string) {
+				writeTree(t, lower, map[string]string{"dir/new": "edited\n"})
+			},
+			want: ErrLowerChanged,
+		},
+		{
+			name:  "directory entries",
+			upper: map[string]string{"dir/" + opaqueMarkerFile: ""},
+			edit: func(t *testing.T, lower string) {
+				writeTree(t, lower, map[string]string{"dir/other": "other\n"})
+			},
+			want: ErrLowerChanged,
+		},
+		{
+			name:  "path the upper layer leaves alone",
+			upper: map[string]string{"file": "new\n"},
+			edit: func(t *testing.T, lower string) {
+				writeTree(t, lower, map[string]string{"other": "other\n"})
+			},
+		},
+		{
+			name:  "forced",
+			upper: map[string]string{"file": "new\n"},
+			edit: func(t *testing.T, lower string) {
+				writeTree(t, lower, map[string]string{"file": "edited\n"})
+			},
+			force: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lower, upper := t.TempDir(), t.TempDir()
+			writeTree(t, lower, map[string]string{"file": "old\n", "dir/old": "old\n"})
+			writeTree(t, upper, tt.upper)
+			fs := New(Config{LowerDirs: []string{lower}, UpperDir: upper})
+			// The lower layer as it was must predate the session, but edits
+			// that follow the start at once, within the same clock tick,
+			// have to count.
+			nextTick(t, lower)
+			if err := fs.StartSession(); err != nil {
+				t.Skipf("cannot record a session start here: %v", err)
+			}
+			tt.edit(t, lower)
+			before := readTree(t, lower)
+
+			_, err := fs.Commit(CommitOptions{Target: lower, Force: tt.force})
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Commit() = %v, want success", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Commit() = %v, want %v", err, tt.want)
+			}
+			if got := readTree(t, lower); !reflect.DeepEqual(got, before) {
+				t.Errorf("lower = %q after a refused commit, want it untouched: %q", got, before)
+			}
+		})
+	}
+}
+
+func TestCommitNoSession(t *testing.T) {
+	lower, upper := t.TempDir(), t.TempDir()
+	writeTree(t, upper, map[string]string{"added": "added\n"})
+	fs := New(Config{LowerDirs: []string{lower}, UpperDir: upper})
+
+	if _, err := fs.Commit(CommitOptions{Target: lower}); !errors.Is(err, ErrNoSession) {
+		t.Fatalf("Commit() = %v, want %v", err, ErrNoSession)
+	}
+	if _, err := fs.Commit(CommitOptions{Target: lower, Force: true}); err != nil {
+		t.Fatalf("Commit() with Force = %v, want success", err)
+	}
+	if got, want := readTree(t, lower), map[string]string{"added": "added\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lower = %q, want %q", got, want)
+	}
+}
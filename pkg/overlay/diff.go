@@ -0,0 +1,407 @@
+package overlay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/psarna/fuss/pkg/vfs"
+
+	"golang.org/x/sys/unix"
+)
+
+// ChangeKind says how a path of the overlay differs from the lower layers
+// alone.
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Modified
+	Deleted
+	MetadataChanged
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Modified:
+		return "modified"
+	case Deleted:
+		return "deleted"
+	case MetadataChanged:
+		return "metadata"
+	}
+	return "unknown"
+}
+
+// Change is a path the upper layer adds, modifies, deletes or changes the
+// metadata of.
+type Change struct {
+	Path string
+	Kind ChangeKind
+	// Upper is the path in the upper layer, empty for deletions, and Lower
+	// the one in the lower layers, empty for additions.
+	Upper string
+	Lower string
+	// Mode is the file type and permissions in the overlay, or in the lower
+	// layers for deletions.
+	Mode os.FileMode
+	// Details describes metadata changes, such as "mode 0644 -> 0600".
+	Details []string
+}
+
+// Diff walks the upper layer and returns how it changes the lower layers,
+// sorted by path. Whiteouts of both styles and opaque directories are
+// reported as the deletions they stand for.
+func (fs *OverlayFS) Diff() ([]Change, error) {
+	var changes []Change
+	if err := fs.diffDir("/", false, false, &changes); err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// diffDir compares the upper directory of dir with the lower layers. added
+// is set below directories the lower layers lack, and opaque below opaque
+// directories, where lower entries missing from the upper layer are gone.
+func (fs *OverlayFS) diffDir(dir string, added, opaque bool, changes *[]Change) error {
+	upperDir := filepath.Join(fs.upperDir, dir)
+	entries, err := os.ReadDir(upperDir)
+	if err != nil {
+		return err
+	}
+
+	opaque = !added && (opaque || isOpaqueDir(upperDir))
+	if opaque {
+		names := map[string]bool{}
+		for _, e := range entries {
+			if !isWhiteoutName(e.Name()) && !isWhiteoutCharDev(filepath.Join(upperDir, e.Name())) {
+				names[e.Name()] = true
+			}
+		}
+		for _, name := range layerNames(fs.lowerDirs, dir) {
+			if !names[name] {
+				fs.diffDeleted(filepath.Join(dir, name), changes)
+			}
+		}
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(dir, name)
+		upperPath := filepath.Join(upperDir, name)
+
+		if name == opaqueMarkerFile {
+			continue
+		}
+		if isWhiteoutName(name) {
+			if !added && !opaque {
+				fs.diffDeleted(filepath.Join(dir, whiteoutTarget(name)), changes)
+			}
+			continue
+		}
+		if isWhiteoutCharDev(upperPath) {
+			if !added && !opaque {
+				fs.diffDeleted(path, changes)
+			}
+			continue
+		}
+
+		info, err := os.Lstat(upperPath)
+		if err != nil {
+			return err
+		}
+		var lowerPath string
+		var lowerInfo os.FileInfo
+		if !added {
+			if p, ok := layerPath(fs.lowerDirs, path); ok {
+				if li, err := os.Lstat(p); err == nil {
+					lowerPath, lowerInfo = p, li
+				}
+			}
+		}
+
+		change := Change{Path: path, Upper: upperPath, Lower: lowerPath, Mode: info.Mode()}
+		if lowerInfo == nil || info.Mode().Type() != lowerInfo.Mode().Type() {
+			change.Kind = Modified
+			if lowerInfo == nil {
+				change.Kind = Added
+			}
+			*changes = append(*changes, change)
+			if info.IsDir() {
+				if err := fs.diffDir(path, true, false, changes); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		same, err := sameContent(upperPath, lowerPath, info, lowerInfo)
+		if err != nil {
+			return err
+		}
+		details, err := metadataDiff(upperPath, lowerPath, info, lowerInfo)
+		if err != nil {
+			return err
+		}
+		if !same {
+			change.Kind = Modified
+			change.Details = details
+			*changes = append(*changes, change)
+		} else if len(details) > 0 {
+			change.Kind = MetadataChanged
+			change.Details = details
+			*changes = append(*changes, change)
+		}
+		if info.IsDir() {
+			if err := fs.diffDir(path, false, opaque, changes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// diffDeleted records the deletion of path if the lower layers have it.
+func (fs *OverlayFS) diffDeleted(path string, changes *[]Change) {
+	lowerPath, ok := layerPath(fs.lowerDirs, path)
+	if !ok {
+		return
+	}
+	info, err := os.Lstat(lowerPath)
+	if err != nil {
+		return
+	}
+	*changes = append(*changes, Change{Path: path, Kind: Deleted, Lower: lowerPath, Mode: info.Mode()})
+}
+
+// layerPath returns where path is in a stack of layers, honouring their
+// whiteouts.
+func layerPath(layers []string, path string) (string, bool) {
+	for _, lower := range layers {
+		lowerPath := filepath.Join(lower, path)
+		if isWhiteout(lowerPath) {
+			return "", false
+		}
+		if _, err := os.Lstat(lowerPath); err == nil {
+			return lowerPath, true
+		}
+	}
+	return "", false
+}
+
+// layerNames lists dir as a stack of layers shows it.
+func layerNames(layers []string, dir string) []string {
+	merger := NewDirMerger()
+	for _, lower := range layers {
+		entries, err := os.ReadDir(filepath.Join(lower, dir))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if isWhiteoutName(name) {
+				merger.AddWhiteout(whiteoutTarget(name))
+				continue
+			}
+			if isWhiteoutCharDev(filepath.Join(lower, dir, name)) {
+				merger.AddWhiteout(name)
+				continue
+			}
+			merger.Add(vfs.DirEntry{Name: name})
+		}
+	}
+	var names []string
+	for _, e := range merger.Entries() {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+// sameContent compares two files of the same type. Directories always
+// match; their entries are compared one by one.
+func sameContent(a, b string, ai, bi os.FileInfo) (bool, error) {
+	switch {
+	case ai.IsDir():
+		return true, nil
+	case ai.Mode()&os.ModeSymlink != 0:
+		at, err := os.Readlink(a)
+		if err != nil {
+			return false, err
+		}
+		bt, err := os.Readlink(b)
+		if err != nil {
+			return false, err
+		}
+		return at == bt, nil
+	case ai.Mode()&(os.ModeDevice|os.ModeCharDevice) != 0:
+		return ai.Sys().(*syscall.Stat_t).Rdev == bi.Sys().(*syscall.Stat_t).Rdev, nil
+	case !ai.Mode().IsRegular():
+		return true, nil
+	}
+
+	if ai.Size() != bi.Size() {
+		return false, nil
+	}
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// metadataDiff describes how the permissions, owner, modification time and
+// extended attributes of a differ from those of b. The modification time of
+// a directory is left out: it follows the entries, which are compared one
+// by one.
+func metadataDiff(a, b string, ai, bi os.FileInfo) ([]string, error) {
+	var details []string
+	as := ai.Sys().(*syscall.Stat_t)
+	bs := bi.Sys().(*syscall.Stat_t)
+
+	if ai.Mode()&os.ModeSymlink == 0 {
+		if am, bm := as.Mode&^syscall.S_IFMT, bs.Mode&^syscall.S_IFMT; am != bm {
+			details = append(details, fmt.Sprintf("mode %04o -> %04o", bm, am))
+		}
+	}
+	if as.Uid != bs.Uid || as.Gid != bs.Gid {
+		details = append(details, fmt.Sprintf("owner %d:%d -> %d:%d", bs.Uid, bs.Gid, as.Uid, as.Gid))
+	}
+	if !ai.IsDir() && !ai.ModTime().Equal(bi.ModTime()) {
+		details = append(details, fmt.Sprintf("mtime %s -> %s",
+			bi.ModTime().Format(time.RFC3339Nano), ai.ModTime().Format(time.RFC3339Nano)))
+	}
+
+	ax, err := listXattrs(a)
+	if err != nil {
+		return nil, err
+	}
+	bx, err := listXattrs(b)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, val := range ax {
+		if bv, ok := bx[name]; !ok || bv != val {
+			names = append(names, name)
+		}
+	}
+	for name := range bx {
+		if _, ok := ax[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		details = append(details, "xattr "+name)
+	}
+	return details, nil
+}
+
+// listXattrs returns the extended attributes of path, without the private
+// ones of the overlay.
+func listXattrs(path string) (map[string]string, error) {
+	xattrs := map[string]string{}
+	names, err := xattrNames(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if isPrivateXattr(name) {
+			continue
+		}
+		val, err := xattrValue(path, name)
+		if err == unix.ENODATA {
+			// Removed since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr " + name, Path: path, Err: err}
+		}
+		xattrs[name] = string(val)
+	}
+	return xattrs, nil
+}
+
+// xattrNames lists the extended attributes of path, none if its filesystem
+// does not support them. The list is sized by asking for its length first,
+// and asked for again should it grow in between.
+func xattrNames(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := unix.Llistxattr(path, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+		}
+		return splitXattrList(buf[:n]), nil
+	}
+}
+
+// xattrValue returns the value of the extended attribute name of path,
+// sized like xattrNames.
+func xattrValue(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := unix.Lgetxattr(path, name, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
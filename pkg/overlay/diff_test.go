@@ -0,0 +1,222 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// writeTree creates the files of tree under root, with modes 0755 and 0644
+// whatever the umask. A name ending in "/" is a directory; any other gets
+// its value as content.
+func writeTree(t *testing.T, root string, tree map[string]string) {
+	t.Helper()
+	for name, content := range tree {
+		path := filepath.Join(root, name)
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sameTimes gives the upper copy of path the times of the lower one, as a
+// copy-up does.
+func sameTimes(t *testing.T, lower, upper, path string) {
+	t.Helper()
+	info, err := os.Lstat(filepath.Join(lower, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(upper, path), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustStyle skips the test when the environment cannot create a marker it
+// needs, e.g. a char device whiteout without CAP_MKNOD.
+func mustStyle(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Skipf("cannot create overlay markers here: %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name  string
+		lower map[string]string
+		upper map[string]string
+		setup func(t *testing.T, lower, upper string)
+		want  []string
+	}{
+		{
+			name:  "added",
+			lower: map[string]string{"kept": "kept\n"},
+			upper: map[string]string{"new": "new\n", "dir/": "", "dir/file": "file\n"},
+			want:  []string{"added /dir", "added /dir/file", "added /new"},
+		},
+		{
+			name:  "modified",
+			lower: map[string]string{"file": "old\n"},
+			upper: map[string]string{"file": "new\n"},
+			want:  []string{"modified /file"},
+		},
+		{
+			name:  "file prefix whiteout",
+			lower: map[string]string{"gone": "gone\n", "dir/": "", "dir/file": "file\n"},
+			upper: map[string]string{whiteoutName("gone"): "", whiteoutName("dir"): ""},
+			want:  []string{"deleted /dir", "deleted /gone"},
+		},
+		{
+			name:  "char device whiteout",
+			lower: map[string]string{"gone": "gone\n"},
+			setup: func(t *testing.T, lower, upper string) {
+				mustStyle(t, createWhiteout(filepath.Join(upper, "gone"), WhiteoutCharDevice))
+			},
+			want: []string{"deleted /gone"},
+		},
+		{
+			name:  "whiteout of a path the lower layers lack",
+			upper: map[string]string{whiteoutName("never"): ""},
+		},
+		{
+			name:  "file prefix opaque directory",
+			lower: map[string]string{"dir/old": "old\n", "dir/kept": "kept\n"},
+			upper: map[string]string{"dir/" + opaqueMarkerFile: "", "dir/kept": "changed\n", "dir/new": "new\n"},
+			want:  []string{"modified /dir/kept", "added /dir/new", "deleted /dir/old"},
+		},
+		{
+			name:  "xattr opaque directory",
+			lower: map[string]string{"dir/old": "old\n"},
+			upper: map[string]string{"dir/new": "new\n"},
+			setup: func(t *testing.T, lower, upper string) {
+				mustStyle(t, setOpaqueDir(filepath.Join(upper, "dir"), WhiteoutCharDevice))
+			},
+			want: []string{"added /dir/new", "deleted /dir/old"},
+		},
+		{
+			name:  "whiteouts below an opaque directory",
+			lower: map[string]string{"dir/old": "old\n"},
+			upper: map[string]string{"dir/" + opaqueMarkerFile: "", "dir/" + whiteoutName("old"): ""},
+			want:  []string{"deleted /dir/old"},
+		},
+		{
+			name:  "mode only",
+			lower: map[string]string{"file": "same\n"},
+			upper: map[string]string{"file": "same\n"},
+			setup: func(t *testing.T, lower, upper string) {
+				if err := os.Chmod(filepath.Join(upper, "file"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				sameTimes(t, lower, upper, "file")
+			},
+			want: []string{"metadata /file (mode 0644 -> 0600)"},
+		},
+		{
+			name:  "mtime only",
+			lower: map[string]string{"file": "same\n"},
+			upper: map[string]string{"file": "same\n"},
+			setup: func(t *testing.T, lower, upper string) {
+				mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+				if err := os.Chtimes(filepath.Join(lower, "file"), mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(filepath.Join(upper, "file"), mtime.Add(time.Second), mtime.Add(time.Second)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"metadata /file (mtime 2020-01-02T03:04:05Z -> 2020-01-02T03:04:06Z)"},
+		},
+		{
+			name:  "xattr only",
+			lower: map[string]string{"file": "same\n"},
+			upper: map[string]string{"file": "same\n"},
+			setup: func(t *testing.T, lower, upper string) {
+				mustStyle(t, unix.Setxattr(filepath.Join(upper, "file"), "user.test", []byte("1"), 0))
+				sameTimes(t, lower, upper, "file")
+			},
+			want: []string{"metadata /file (xattr user.test)"},
+		},
+		{
+			name:  "directory times are not compared",
+			lower: map[string]string{"dir/": ""},
+			upper: map[string]string{"dir/": ""},
+			setup: func(t *testing.T, lower, upper string) {
+				old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+				if err := os.Chtimes(filepath.Join(lower, "dir"), old, old); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lower, upper := t.TempDir(), t.TempDir()
+			writeTree(t, lower, tt.lower)
+			writeTree(t, upper, tt.upper)
+			if tt.setup != nil {
+				tt.setup(t, lower, upper)
+			}
+
+			fs := New(Config{LowerDirs: []string{lower}, UpperDir: upper})
+			changes, err := fs.Diff()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range changes {
+				// Modified files also carry details, among them the times
+				// the test did not set.
+				line := c.Kind.String() + " " + c.Path
+				if c.Kind == MetadataChanged {
+					line += " (" + strings.Join(c.Details, ", ") + ")"
+				}
+				got = append(got, line)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLayers(t *testing.T) {
+	top, bottom, upper := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTree(t, bottom, map[string]string{"hidden": "bottom\n", "shadowed": "bottom\n"})
+	writeTree(t, top, map[string]string{whiteoutName("hidden"): "", "shadowed": "top\n"})
+	writeTree(t, upper, map[string]string{"hidden": "new\n", whiteoutName("shadowed"): ""})
+
+	fs := New(Config{LowerDirs: []string{top, bottom}, UpperDir: upper})
+	changes, err := fs.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Path: "/hidden", Kind: Added, Upper: filepath.Join(upper, "hidden"), Mode: 0644},
+		{Path: "/shadowed", Kind: Deleted, Lower: filepath.Join(top, "shadowed"), Mode: 0644},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Diff() = %+v, want %+v", changes, want)
+	}
+}
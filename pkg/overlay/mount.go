@@ -0,0 +1,91 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// A host directory can be mounted over a directory of the overlay, as by
+// mount --bind or a tmpfs. Paths below it bypass the layers and are
+// resolved in the host directory as they are.
+
+// Mount shows the host directory source at path, which must be a directory.
+func (fs *OverlayFS) Mount(path, source string) error {
+	realPath, err := fs.ResolvePath(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		return errnoFromPathError(err)
+	}
+	if !info.IsDir() {
+		return syscall.ENOTDIR
+	}
+	if fs.mounts == nil {
+		fs.mounts = make(map[string][]string)
+	}
+	path = filepath.Clean(path)
+	fs.mounts[path] = append(fs.mounts[path], source)
+	return nil
+}
+
+// Unmount removes the last mount at path.
+func (fs *OverlayFS) Unmount(path string) error {
+	path = filepath.Clean(path)
+	sources := fs.mounts[path]
+	if len(sources) == 0 {
+		return syscall.EINVAL
+	}
+	if len(sources) == 1 {
+		delete(fs.mounts, path)
+	} else {
+		fs.mounts[path] = sources[:len(sources)-1]
+	}
+	return nil
+}
+
+// mounted returns where path is on the host if a mount covers it.
+func (fs *OverlayFS) mounted(path string) (string, bool) {
+	if len(fs.mounts) == 0 {
+		return "", false
+	}
+	path = filepath.Clean(path)
+	for target := path; ; target = filepath.Dir(target) {
+		if sources := fs.mounts[target]; len(sources) > 0 {
+			rel := strings.TrimPrefix(path, target)
+			return filepath.Join(sources[len(sources)-1], rel), true
+		}
+		if target == "/" || target == "." {
+			return "", false
+		}
+	}
+}
+
+// mountedPair resolves two paths of a rename or link if either is covered by
+// a mount. Both have to be on the same one.
+func (fs *OverlayFS) mountedPair(oldpath, newpath string) (oldReal, newReal string, ok bool, err error) {
+	oldReal, oldMounted := fs.mounted(oldpath)
+	newReal, newMounted := fs.mounted(newpath)
+	if !oldMounted && !newMounted {
+		return "", "", false, nil
+	}
+	if !oldMounted || !newMounted || fs.mountOf(oldpath) != fs.mountOf(newpath) {
+		return "", "", true, syscall.EXDEV
+	}
+	return oldReal, newReal, true, nil
+}
+
+func (fs *OverlayFS) mountOf(path string) string {
+	path = filepath.Clean(path)
+	for target := path; ; target = filepath.Dir(target) {
+		if len(fs.mounts[target]) > 0 {
+			return target
+		}
+		if target == "/" || target == "." {
+			return ""
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/psarna/fuss/pkg/vfs"
@@ -15,6 +16,15 @@ type OverlayFS struct {
 	lowerDirs     []string
 	upperDir      string
 	whiteoutStyle WhiteoutStyle
+	// Host directories mounted over overlay directories, the last one on
+	// top.
+	mounts map[string][]string
+	// Called with the directories copied up, see OnCopyUp.
+	copiedUp func(path, upperPath string)
+	// The layers as the kernel names paths inside them: absolute, with
+	// symlinks resolved.
+	realLowerDirs []string
+	realUpperDir  string
 }
 
 type Config struct {
@@ -24,14 +34,38 @@ type Config struct {
 }
 
 func New(cfg Config) *OverlayFS {
+	realLowerDirs := make([]string, len(cfg.LowerDirs))
+	for i, lower := range cfg.LowerDirs {
+		realLowerDirs[i] = realDir(lower)
+	}
 	return &OverlayFS{
 		lowerDirs:     cfg.LowerDirs,
 		upperDir:      cfg.UpperDir,
 		whiteoutStyle: cfg.WhiteoutStyle,
+		realLowerDirs: realLowerDirs,
+		realUpperDir:  realDir(cfg.UpperDir),
+	}
+}
+
+// realDir returns dir absolute and with symlinks resolved.
+func realDir(dir string) string {
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
 	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return dir
 }
 
 func (fs *OverlayFS) resolve(path string) (realPath string, inUpper bool, err error) {
+	if realPath, ok := fs.mounted(path); ok {
+		if _, err := os.Lstat(realPath); err != nil {
+			return "", false, errnoFromPathError(err)
+		}
+		return realPath, true, nil
+	}
+
 	upperPath := filepath.Join(fs.upperDir, path)
 
 	if isWhiteout(upperPath) {
@@ -82,6 +116,10 @@ func (fs *OverlayFS) resolve(path string) (realPath string, inUpper bool, err er
 }
 
 func (fs *OverlayFS) ResolveForOpen(path string, flags vfs.OpenFlags, mode uint32) (string, error) {
+	if realPath, ok := fs.mounted(path); ok {
+		return realPath, nil
+	}
+
 	realPath, inUpper, err := fs.resolve(path)
 
 	if flags.IsCreate() && err == syscall.ENOENT {
@@ -120,6 +158,9 @@ func (fs *OverlayFS) ResolvePath(path string) (string, error) {
 }
 
 func (fs *OverlayFS) PrepareCreate(path string) (string, error) {
+	if realPath, ok := fs.mounted(path); ok {
+		return realPath, nil
+	}
 	if err := fs.copyUpParents(path); err != nil {
 		return "", err
 	}
@@ -129,13 +170,79 @@ func (fs *OverlayFS) PrepareCreate(path string) (string, error) {
 }
 
 func (fs *OverlayFS) PrepareWrite(path string) (string, error) {
+	if realPath, ok := fs.mounted(path); ok {
+		return realPath, nil
+	}
+	if err := fs.copyUp(path); err != nil {
+		return "", err
+	}
+	return filepath.Join(fs.upperDir, path), nil
+}
+
+// NeedsCopyUp reports whether path is a regular file that only exists in a
+// lower layer, so that writing to it requires a copy-up first.
+func (fs *OverlayFS) NeedsCopyUp(path string) bool {
+	realPath, inUpper, err := fs.resolve(path)
+	if err != nil || inUpper {
+		return false
+	}
+	info, err := os.Lstat(realPath)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// InLowerLayer reports whether realPath, as the kernel names it, lies inside
+// one of the lower layers. A lower layer may contain the upper one, as /
+// does, whose files are not in it.
+func (fs *OverlayFS) InLowerLayer(realPath string) bool {
+	if pathWithin(realPath, fs.realUpperDir) {
+		return false
+	}
+	for _, lower := range fs.realLowerDirs {
+		if pathWithin(realPath, lower) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathWithin reports whether path is dir or below it.
+func pathWithin(path, dir string) bool {
+	return path == dir || dir == "/" && strings.HasPrefix(path, "/") || strings.HasPrefix(path, dir+"/")
+}
+
+// MountOptions describes the layers the way overlayfs mount options do.
+func (fs *OverlayFS) MountOptions() string {
+	lowers := make([]string, len(fs.lowerDirs))
+	for i, lower := range fs.lowerDirs {
+		lowers[i], _ = filepath.Abs(lower)
+	}
+	upper, _ := filepath.Abs(fs.upperDir)
+	return "lowerdir=" + strings.Join(lowers, ":") + ",upperdir=" + upper
+}
+
+// PrepareXattr copies path up so that its extended attributes can be
+// changed without touching the lower layers.
+func (fs *OverlayFS) PrepareXattr(path string) (string, error) {
+	if realPath, ok := fs.mounted(path); ok {
+		return realPath, nil
+	}
 	if err := fs.copyUp(path); err != nil {
 		return "", err
 	}
 	return filepath.Join(fs.upperDir, path), nil
 }
 
+// HiddenXattr reports whether name is one of the overlay's own markers,
+// which are neither listed nor accessible through the overlay.
+func (fs *OverlayFS) HiddenXattr(name string) bool {
+	return isPrivateXattr(name)
+}
+
 func (fs *OverlayFS) PrepareUnlink(path string) error {
+	if realPath, ok := fs.mounted(path); ok {
+		return syscall.Unlink(realPath)
+	}
+
 	realPath, inUpper, err := fs.resolve(path)
 	if err != nil {
 		return err
@@ -164,6 +271,10 @@ func (fs *OverlayFS) PrepareUnlink(path string) error {
 }
 
 func (fs *OverlayFS) PrepareRmdir(path string) error {
+	if realPath, ok := fs.mounted(path); ok {
+		return syscall.Rmdir(realPath)
+	}
+
 	realPath, inUpper, err := fs.resolve(path)
 	if err != nil {
 		return err
@@ -192,6 +303,10 @@ func (fs *OverlayFS) PrepareRmdir(path string) error {
 }
 
 func (fs *OverlayFS) PrepareRename(oldpath, newpath string) (string, string, error) {
+	if oldReal, newReal, ok, err := fs.mountedPair(oldpath, newpath); ok {
+		return oldReal, newReal, err
+	}
+
 	if realNewPath, _, err := fs.resolve(newpath); err == nil {
 		info, statErr := os.Lstat(realNewPath)
 		if statErr != nil {
@@ -230,6 +345,10 @@ func (fs *OverlayFS) PrepareRename(oldpath, newpath string) (string, string, err
 }
 
 func (fs *OverlayFS) PrepareLink(oldpath, newpath string) (string, string, error) {
+	if oldReal, newReal, ok, err := fs.mountedPair(oldpath, newpath); ok {
+		return oldReal, newReal, err
+	}
+
 	if err := fs.copyUp(oldpath); err != nil {
 		return "", "", err
 	}
@@ -246,6 +365,10 @@ func (fs *OverlayFS) PrepareLink(oldpath, newpath string) (string, string, error
 }
 
 func (fs *OverlayFS) PrepareSymlink(linkpath string) (string, error) {
+	if realPath, ok := fs.mounted(linkpath); ok {
+		return realPath, nil
+	}
+
 	if err := fs.copyUpParents(linkpath); err != nil {
 		return "", err
 	}
@@ -260,6 +383,10 @@ func (fs *OverlayFS) ReadDir(path string) ([]vfs.DirEntry, error) {
 	merger := NewDirMerger()
 
 	upperPath := filepath.Join(fs.upperDir, path)
+	realPath, mounted := fs.mounted(path)
+	if mounted {
+		upperPath = realPath
+	}
 	if entries, err := os.ReadDir(upperPath); err == nil {
 		for _, e := range entries {
 			name := e.Name()
@@ -280,7 +407,7 @@ func (fs *OverlayFS) ReadDir(path string) ([]vfs.DirEntry, error) {
 		}
 	}
 
-	if isOpaqueDir(upperPath) {
+	if mounted || isOpaqueDir(upperPath) {
 		return merger.Entries(), nil
 	}
 
@@ -333,7 +460,12 @@ func (fs *OverlayFS) copyUp(path string) error {
 		return nil
 	}
 
-	return copyUp(realPath, filepath.Join(fs.upperDir, path))
+	upperPath := filepath.Join(fs.upperDir, path)
+	if err := copyUp(realPath, upperPath); err != nil {
+		return err
+	}
+	fs.notifyCopyUp(path, upperPath)
+	return nil
 }
 
 func (fs *OverlayFS) copyUpParents(path string) error {
@@ -363,6 +495,7 @@ func (fs *OverlayFS) copyUpParents(path string) error {
 		if err := copyUp(realPath, upperPath); err != nil {
 			return err
 		}
+		fs.notifyCopyUp("/"+current, upperPath)
 	}
 
 	return nil
@@ -432,25 +565,22 @@ func copyUp(src, dst string) error {
 	}
 
 	copyXattrs(src, dst)
+	unix.UtimesNanoAt(unix.AT_FDCWD, dst, []unix.Timespec{unix.Timespec(st.Atim), unix.Timespec(st.Mtim)}, unix.AT_SYMLINK_NOFOLLOW)
 
 	return nil
 }
 
 func copyXattrs(src, dst string) {
-	list := make([]byte, 4096)
-	n, err := unix.Llistxattr(src, list)
-	if err != nil || n == 0 {
+	names, err := xattrNames(src)
+	if err != nil {
 		return
 	}
-
-	names := splitXattrList(list[:n])
 	for _, name := range names {
-		val := make([]byte, 4096)
-		vn, err := unix.Lgetxattr(src, name, val)
+		val, err := xattrValue(src, name)
 		if err != nil {
 			continue
 		}
-		unix.Lsetxattr(dst, name, val[:vn], 0)
+		unix.Lsetxattr(dst, name, val, 0)
 	}
 }
 
@@ -494,6 +624,7 @@ func (fs *OverlayFS) existsInLower(path string) bool {
 }
 
 func (fs *OverlayFS) PlanRemove(path string, isDir bool) (realPath string, needsWhiteout bool, skipSyscall bool, err error) {
+	_, mounted := fs.mounted(path)
 	realPath, inUpper, err := fs.resolve(path)
 	if err != nil {
 		return "", false, false, err
@@ -514,7 +645,7 @@ func (fs *OverlayFS) PlanRemove(path string, isDir bool) (realPath string, needs
 		}
 	}
 
-	existsInLower := fs.existsInLower(path)
+	existsInLower := !mounted && fs.existsInLower(path)
 	if inUpper {
 		return realPath, existsInLower, false, nil
 	}
@@ -527,7 +658,7 @@ func (fs *OverlayFS) PlanRemove(path string, isDir bool) (realPath string, needs
 }
 
 func (fs *OverlayFS) FinalizeRemove(path string, isDir bool) error {
-	if !fs.existsInLower(path) {
+	if _, mounted := fs.mounted(path); mounted || !fs.existsInLower(path) {
 		return nil
 	}
 
@@ -543,3 +674,121 @@ func (fs *OverlayFS) FinalizeRemove(path string, isDir bool) error {
 
 	return fs.createWhiteout(path)
 }
+
+// PlanRename prepares a renameat2 with flags. Directories that still have
+// lower-layer contents cannot be moved and fail with EXDEV, as they do on
+// overlayfs without redirect_dir. Whiteouts the rename leaves behind are
+// created by FinalizeRename once it has succeeded.
+func (fs *OverlayFS) PlanRename(oldpath, newpath string, flags uint) (string, string, error) {
+	const known = unix.RENAME_NOREPLACE | unix.RENAME_EXCHANGE | unix.RENAME_WHITEOUT
+	if flags&^known != 0 {
+		return "", "", syscall.EINVAL
+	}
+	if flags&unix.RENAME_EXCHANGE != 0 && flags&(unix.RENAME_NOREPLACE|unix.RENAME_WHITEOUT) != 0 {
+		return "", "", syscall.EINVAL
+	}
+
+	if oldReal, newReal, ok, err := fs.mountedPair(oldpath, newpath); ok {
+		if err == nil && flags&unix.RENAME_NOREPLACE != 0 {
+			if _, statErr := os.Lstat(newReal); statErr == nil {
+				return "", "", syscall.EEXIST
+			}
+		}
+		return oldReal, newReal, err
+	}
+
+	oldReal, _, err := fs.resolve(oldpath)
+	if err != nil {
+		return "", "", err
+	}
+	oldIsDir, err := fs.movableDir(oldpath, oldReal)
+	if err != nil {
+		return "", "", err
+	}
+
+	newReal, _, err := fs.resolve(newpath)
+	newExists := err == nil
+	if err != nil && err != syscall.ENOENT {
+		return "", "", err
+	}
+	if flags&unix.RENAME_NOREPLACE != 0 && newExists {
+		return "", "", syscall.EEXIST
+	}
+
+	oldUpper := filepath.Join(fs.upperDir, oldpath)
+	newUpper := filepath.Join(fs.upperDir, newpath)
+
+	if flags&unix.RENAME_EXCHANGE != 0 {
+		if !newExists {
+			return "", "", syscall.ENOENT
+		}
+		newIsDir, err := fs.movableDir(newpath, newReal)
+		if err != nil {
+			return "", "", err
+		}
+		if err := fs.copyUp(oldpath); err != nil {
+			return "", "", err
+		}
+		if err := fs.copyUp(newpath); err != nil {
+			return "", "", err
+		}
+		// Each directory lands on the other's name and must not pick up
+		// lower-layer entries found there.
+		if oldIsDir && fs.existsInLower(newpath) {
+			if err := setOpaqueDir(oldUpper, fs.whiteoutStyle); err != nil {
+				return "", "", err
+			}
+		}
+		if newIsDir && fs.existsInLower(oldpath) {
+			if err := setOpaqueDir(newUpper, fs.whiteoutStyle); err != nil {
+				return "", "", err
+			}
+		}
+		return oldUpper, newUpper, nil
+	}
+
+	if err := fs.copyUp(oldpath); err != nil {
+		return "", "", err
+	}
+	if err := fs.copyUpParents(newpath); err != nil {
+		return "", "", err
+	}
+	removeWhiteout(newUpper, fs.whiteoutStyle)
+	if oldIsDir && fs.existsInLower(newpath) {
+		if err := setOpaqueDir(oldUpper, fs.whiteoutStyle); err != nil {
+			return "", "", err
+		}
+	}
+	return oldUpper, newUpper, nil
+}
+
+// FinalizeRename hides lower-layer entries at oldpath after a successful
+// rename, and leaves a whiteout there in any case for RENAME_WHITEOUT.
+func (fs *OverlayFS) FinalizeRename(oldpath, newpath string, flags uint) error {
+	if flags&unix.RENAME_EXCHANGE != 0 {
+		return nil
+	}
+	if _, mounted := fs.mounted(oldpath); mounted {
+		return nil
+	}
+	if flags&unix.RENAME_WHITEOUT == 0 && !fs.existsInLower(oldpath) {
+		return nil
+	}
+	return fs.createWhiteout(oldpath)
+}
+
+// movableDir reports whether path is a directory, failing with EXDEV for
+// one that merges lower-layer contents.
+func (fs *OverlayFS) movableDir(path, realPath string) (bool, error) {
+	info, err := os.Lstat(realPath)
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return false, nil
+	}
+	if fs.existsInLower(path) && !isOpaqueDir(filepath.Join(fs.upperDir, path)) {
+		return true, syscall.EXDEV
+	}
+	return true, nil
+}
@@ -0,0 +1,104 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WatchPaths returns the real paths a watch on path has to cover, topmost
+// layer first. A directory only present in lower layers is watched there;
+// upperMissing reports that its upper copy, once a copy-up creates one, has
+// to be watched too.
+func (fs *OverlayFS) WatchPaths(path string) (paths []string, upperMissing bool, err error) {
+	if realPath, ok := fs.mounted(path); ok {
+		return []string{realPath}, false, nil
+	}
+	realPath, inUpper, err := fs.resolve(path)
+	if err != nil {
+		return nil, false, err
+	}
+	info, err := os.Lstat(realPath)
+	if err != nil {
+		return nil, false, errnoFromPathError(err)
+	}
+	if !info.IsDir() {
+		return []string{realPath}, false, nil
+	}
+
+	paths = []string{realPath}
+	if isOpaqueDir(realPath) {
+		return paths, !inUpper, nil
+	}
+
+	lowers := fs.lowerDirs
+	if !inUpper {
+		for i, lower := range lowers {
+			if filepath.Join(lower, path) == realPath {
+				lowers = lowers[i+1:]
+				break
+			}
+		}
+	}
+	for _, lower := range lowers {
+		lowerPath := filepath.Join(lower, path)
+		if isWhiteout(lowerPath) {
+			break
+		}
+		info, err := os.Lstat(lowerPath)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() {
+			break
+		}
+		paths = append(paths, lowerPath)
+		if isOpaqueDir(lowerPath) {
+			break
+		}
+	}
+	return paths, !inUpper, nil
+}
+
+// OnCopyUp makes fs call fn with the overlay path and upper path of every
+// directory it copies up.
+func (fs *OverlayFS) OnCopyUp(fn func(path, upperPath string)) {
+	fs.copiedUp = fn
+}
+
+func (fs *OverlayFS) notifyCopyUp(path, upperPath string) {
+	if fs.copiedUp == nil {
+		return
+	}
+	if info, err := os.Lstat(upperPath); err == nil && info.IsDir() {
+		fs.copiedUp(path, upperPath)
+	}
+}
+
+// WatchedName maps the name of an entry that changed in realDir, one of the
+// WatchPaths of path, to its name in the overlay. A whiteout in the upper
+// layer maps to the name it hides. Markers and lower-layer entries shadowed
+// by a higher layer are not visible.
+func (fs *OverlayFS) WatchedName(path, realDir, name string) (overlayName string, whiteout, visible bool) {
+	if name == opaqueMarkerFile {
+		return "", false, false
+	}
+
+	if realDir == filepath.Join(fs.upperDir, path) {
+		if isWhiteoutName(name) {
+			return whiteoutTarget(name), true, true
+		}
+		if isWhiteoutCharDev(filepath.Join(realDir, name)) {
+			return name, true, true
+		}
+		return name, false, true
+	}
+
+	if isWhiteoutName(name) {
+		return "", false, false
+	}
+	realPath, _, err := fs.resolve(filepath.Join(path, name))
+	if err == nil && realPath != filepath.Join(realDir, name) {
+		return "", false, false
+	}
+	return name, false, true
+}
@@ -22,6 +22,17 @@ const (
 	opaqueXattrName  = "trusted.overlay.opaque"
 )
 
+var privateXattrPrefixes = []string{"trusted.overlay.", "user.overlay."}
+
+func isPrivateXattr(name string) bool {
+	for _, prefix := range privateXattrPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func whiteoutName(name string) string {
 	return whiteoutPrefix + name
 }
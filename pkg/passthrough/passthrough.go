@@ -42,6 +42,10 @@ func (fs *PassthroughFS) PrepareWrite(path string) (string, error) {
 	return fs.realPath(path), nil
 }
 
+func (fs *PassthroughFS) PrepareXattr(path string) (string, error) {
+	return fs.realPath(path), nil
+}
+
 func (fs *PassthroughFS) PrepareUnlink(path string) error {
 	return syscall.Unlink(fs.realPath(path))
 }
@@ -1,74 +1,216 @@
 package tracer
 
-import "syscall"
+import (
+	"syscall"
+	"unsafe"
+)
 
 const (
-	SYS_OPEN       = 2
-	SYS_CLOSE      = 3
-	SYS_STAT       = 4
-	SYS_FSTAT      = 5
-	SYS_LSTAT      = 6
-	SYS_ACCESS     = 21
-	SYS_DUP        = 32
-	SYS_DUP2       = 33
-	SYS_GETPID     = 39
-	SYS_EXECVE     = 59
-	SYS_FCNTL      = 72
-	SYS_TRUNCATE   = 76
-	SYS_GETCWD     = 79
-	SYS_CHDIR      = 80
-	SYS_FCHDIR     = 81
-	SYS_RENAME     = 82
-	SYS_MKDIR      = 83
-	SYS_RMDIR      = 84
-	SYS_CREAT      = 85
-	SYS_LINK       = 86
-	SYS_UNLINK     = 87
-	SYS_SYMLINK    = 88
-	SYS_READLINK   = 89
-	SYS_CHMOD      = 90
-	SYS_CHOWN      = 92
-	SYS_LCHOWN     = 94
-	SYS_UTIME      = 132
-	SYS_MKNOD      = 133
-	SYS_STATFS     = 137
-	SYS_GETXATTR   = 191
-	SYS_LGETXATTR  = 192
-	SYS_LISTXATTR  = 194
-	SYS_LLISTXATTR = 195
-	SYS_GETDENTS64 = 217
-	SYS_UTIMES     = 235
-	SYS_OPENAT     = 257
-	SYS_MKDIRAT    = 258
-	SYS_MKNODAT    = 259
-	SYS_FCHOWNAT   = 260
-	SYS_FUTIMESAT  = 261
-	SYS_NEWFSTATAT = 262
-	SYS_UNLINKAT   = 263
-	SYS_RENAMEAT   = 264
-	SYS_LINKAT     = 265
-	SYS_SYMLINKAT  = 266
-	SYS_READLINKAT = 267
-	SYS_FACCESSAT  = 269
-	SYS_FCHMODAT   = 268
-	SYS_UTIMENSAT  = 280
-	SYS_DUP3       = 292
-	SYS_RENAMEAT2  = 316
-	SYS_EXECVEAT   = 322
-	SYS_STATX      = 332
-	SYS_FACCESSAT2 = 439
+	SYS_READ              = 0
+	SYS_WRITE             = 1
+	SYS_OPEN              = 2
+	SYS_CLOSE             = 3
+	SYS_LSEEK             = 8
+	SYS_MMAP              = 9
+	SYS_MPROTECT          = 10
+	SYS_PWRITE64          = 18
+	SYS_WRITEV            = 20
+	SYS_STAT              = 4
+	SYS_FSTAT             = 5
+	SYS_LSTAT             = 6
+	SYS_ACCESS            = 21
+	SYS_DUP               = 32
+	SYS_DUP2              = 33
+	SYS_GETPID            = 39
+	SYS_SENDFILE          = 40
+	SYS_CONNECT           = 42
+	SYS_ACCEPT            = 43
+	SYS_SENDTO            = 44
+	SYS_RECVFROM          = 45
+	SYS_SENDMSG           = 46
+	SYS_RECVMSG           = 47
+	SYS_BIND              = 49
+	SYS_GETSOCKNAME       = 51
+	SYS_GETPEERNAME       = 52
+	SYS_EXECVE            = 59
+	SYS_WAIT4             = 61
+	SYS_FCNTL             = 72
+	SYS_TRUNCATE          = 76
+	SYS_FTRUNCATE         = 77
+	SYS_GETDENTS          = 78
+	SYS_GETCWD            = 79
+	SYS_CHDIR             = 80
+	SYS_FCHDIR            = 81
+	SYS_RENAME            = 82
+	SYS_MKDIR             = 83
+	SYS_RMDIR             = 84
+	SYS_CREAT             = 85
+	SYS_LINK              = 86
+	SYS_UNLINK            = 87
+	SYS_SYMLINK           = 88
+	SYS_READLINK          = 89
+	SYS_CHMOD             = 90
+	SYS_FCHMOD            = 91
+	SYS_CHOWN             = 92
+	SYS_FCHOWN            = 93
+	SYS_LCHOWN            = 94
+	SYS_PTRACE            = 101
+	SYS_UTIME             = 132
+	SYS_MKNOD             = 133
+	SYS_STATFS            = 137
+	SYS_PIVOT_ROOT        = 155
+	SYS_CHROOT            = 161
+	SYS_MOUNT             = 165
+	SYS_UMOUNT2           = 166
+	SYS_SETXATTR          = 188
+	SYS_LSETXATTR         = 189
+	SYS_FSETXATTR         = 190
+	SYS_GETXATTR          = 191
+	SYS_LGETXATTR         = 192
+	SYS_FGETXATTR         = 193
+	SYS_LISTXATTR         = 194
+	SYS_LLISTXATTR        = 195
+	SYS_FLISTXATTR        = 196
+	SYS_REMOVEXATTR       = 197
+	SYS_LREMOVEXATTR      = 198
+	SYS_FREMOVEXATTR      = 199
+	SYS_GETDENTS64        = 217
+	SYS_UTIMES            = 235
+	SYS_WAITID            = 247
+	SYS_INOTIFY_ADD_WATCH = 254
+	SYS_INOTIFY_RM_WATCH  = 255
+	SYS_OPENAT            = 257
+	SYS_MKDIRAT           = 258
+	SYS_MKNODAT           = 259
+	SYS_FCHOWNAT          = 260
+	SYS_FUTIMESAT         = 261
+	SYS_NEWFSTATAT        = 262
+	SYS_UNLINKAT          = 263
+	SYS_RENAMEAT          = 264
+	SYS_LINKAT            = 265
+	SYS_SYMLINKAT         = 266
+	SYS_READLINKAT        = 267
+	SYS_FACCESSAT         = 269
+	SYS_FCHMODAT          = 268
+	SYS_UTIMENSAT         = 280
+	SYS_SPLICE            = 275
+	SYS_VMSPLICE          = 278
+	SYS_FALLOCATE         = 285
+	SYS_ACCEPT4           = 288
+	SYS_FANOTIFY_MARK     = 301
+	SYS_NAME_TO_HANDLE_AT = 303
+	SYS_DUP3              = 292
+	SYS_PWRITEV           = 296
+	SYS_RENAMEAT2         = 316
+	SYS_MEMFD_CREATE      = 319
+	SYS_EXECVEAT          = 322
+	SYS_COPY_FILE_RANGE   = 326
+	SYS_PWRITEV2          = 328
+	SYS_PKEY_MPROTECT     = 329
+	SYS_STATX             = 332
+	SYS_OPEN_TREE         = 428
+	SYS_MOVE_MOUNT        = 429
+	SYS_FSOPEN            = 430
+	SYS_FSCONFIG          = 431
+	SYS_FSMOUNT           = 432
+	SYS_OPENAT2           = 437
+	SYS_FACCESSAT2        = 439
+	SYS_FCHMODAT2         = 452
 )
 
-func sysno(regs *syscall.PtraceRegs) uint64        { return regs.Orig_rax }
-func setSysno(regs *syscall.PtraceRegs, v uint64)  { regs.Orig_rax = v }
+func sysno(regs *syscall.PtraceRegs) uint64 { return nativeSysno(regs, regs.Orig_rax) }
+
+func setSysno(regs *syscall.PtraceRegs, v uint64) {
+	if isCompat(regs) {
+		v = compatSysno(regs, v)
+	}
+	regs.Orig_rax = v
+}
+
 func retval(regs *syscall.PtraceRegs) uint64       { return regs.Rax }
 func setRetval(regs *syscall.PtraceRegs, v uint64) { regs.Rax = v }
-func arg0(regs *syscall.PtraceRegs) uint64         { return regs.Rdi }
-func setArg0(regs *syscall.PtraceRegs, v uint64)   { regs.Rdi = v }
-func arg1(regs *syscall.PtraceRegs) uint64         { return regs.Rsi }
-func setArg1(regs *syscall.PtraceRegs, v uint64)   { regs.Rsi = v }
-func arg2(regs *syscall.PtraceRegs) uint64         { return regs.Rdx }
-func setArg2(regs *syscall.PtraceRegs, v uint64)   { regs.Rdx = v }
-func arg3(regs *syscall.PtraceRegs) uint64         { return regs.R10 }
-func setArg3(regs *syscall.PtraceRegs, v uint64)   { regs.R10 = v }
 func sp(regs *syscall.PtraceRegs) uint64           { return regs.Rsp }
+func pc(regs *syscall.PtraceRegs) uint64           { return regs.Rip }
+
+// Compat syscalls take their arguments in ebx, ecx, edx, esi, edi and ebp.
+
+func arg0(regs *syscall.PtraceRegs) uint64 { return argReg(regs, regs.Rdi, regs.Rbx) }
+func arg1(regs *syscall.PtraceRegs) uint64 { return argReg(regs, regs.Rsi, regs.Rcx) }
+func arg2(regs *syscall.PtraceRegs) uint64 { return argReg(regs, regs.Rdx, regs.Rdx) }
+func arg3(regs *syscall.PtraceRegs) uint64 { return argReg(regs, regs.R10, regs.Rsi) }
+func arg4(regs *syscall.PtraceRegs) uint64 { return argReg(regs, regs.R8, regs.Rdi) }
+func arg5(regs *syscall.PtraceRegs) uint64 { return argReg(regs, regs.R9, regs.Rbp) }
+
+func setArg0(regs *syscall.PtraceRegs, v uint64) { setArgReg(regs, &regs.Rdi, &regs.Rbx, v) }
+func setArg1(regs *syscall.PtraceRegs, v uint64) { setArgReg(regs, &regs.Rsi, &regs.Rcx, v) }
+func setArg2(regs *syscall.PtraceRegs, v uint64) { setArgReg(regs, &regs.Rdx, &regs.Rdx, v) }
+func setArg3(regs *syscall.PtraceRegs, v uint64) { setArgReg(regs, &regs.R10, &regs.Rsi, v) }
+func setArg4(regs *syscall.PtraceRegs, v uint64) { setArgReg(regs, &regs.R8, &regs.Rdi, v) }
+func setArg5(regs *syscall.PtraceRegs, v uint64) { setArgReg(regs, &regs.R9, &regs.Rbp, v) }
+
+func argReg(regs *syscall.PtraceRegs, native, compat uint64) uint64 {
+	if isCompat(regs) {
+		return uint64(uint32(compat))
+	}
+	return native
+}
+
+// The upper half of a compat argument register is kept: it is zero in
+// 32-bit code, but 64-bit code making an int 0x80 syscall may have a value
+// there that it needs once the syscall returns.
+func setArgReg(regs *syscall.PtraceRegs, native, compat *uint64, v uint64) {
+	if isCompat(regs) {
+		*compat = *compat&^0xffffffff | uint64(uint32(v))
+		return
+	}
+	*native = v
+}
+
+// The syscall instruction, as found at the tracee's instruction pointer. int
+// 0x80 and sysenter, which compat code uses, are as long.
+var syscallInsn = []byte{0x0f, 0x05}
+
+func restoreEntryArgs(regs *syscall.PtraceRegs, nr uint64, args [6]uint64) {
+	setSysno(regs, nr)
+	for i, arg := range args {
+		setArgN(regs, i, arg)
+	}
+}
+
+// rewindSyscall makes a tracee stopped at syscall exit execute the same
+// syscall again once resumed.
+func rewindSyscall(regs *syscall.PtraceRegs, nr uint64, args [6]uint64) {
+	restoreEntryArgs(regs, nr, args)
+	regs.Rax = regs.Orig_rax
+	regs.Rip -= uint64(len(syscallInsn))
+}
+
+// syscall.PtraceGetRegs uses PTRACE_GETREGSET, which gives a compat tracee's
+// registers in the i386 layout. PTRACE_GETREGS always gives the 64-bit one.
+
+func ptraceGetRegs(pid int, regs *syscall.PtraceRegs) error {
+	if err := ptraceRegs(syscall.PTRACE_GETREGS, pid, regs); err != nil {
+		return err
+	}
+	if _, ok := int80Tracees[pid]; ok {
+		regs.Cs = compatCS
+	}
+	return nil
+}
+
+func ptraceSetRegs(pid int, regs *syscall.PtraceRegs) error {
+	if cs, ok := int80Tracees[pid]; ok {
+		real := *regs
+		real.Cs = cs
+		return ptraceRegs(syscall.PTRACE_SETREGS, pid, &real)
+	}
+	return ptraceRegs(syscall.PTRACE_SETREGS, pid, regs)
+}
+
+func ptraceRegs(req, pid int, regs *syscall.PtraceRegs) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, uintptr(req), uintptr(pid), 0, uintptr(unsafe.Pointer(regs)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
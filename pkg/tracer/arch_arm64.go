@@ -1,41 +1,99 @@
 package tracer
 
-import "syscall"
+import (
+	"syscall"
+	"unsafe"
+)
 
 const (
-	SYS_GETXATTR   = 8
-	SYS_GETCWD     = 17
-	SYS_LGETXATTR  = 9
-	SYS_LISTXATTR  = 11
-	SYS_LLISTXATTR = 12
-	SYS_DUP        = 23
-	SYS_DUP3       = 24
-	SYS_FCNTL      = 25
-	SYS_MKNODAT    = 33
-	SYS_MKDIRAT    = 34
-	SYS_UNLINKAT   = 35
-	SYS_SYMLINKAT  = 36
-	SYS_LINKAT     = 37
-	SYS_RENAMEAT   = 38
-	SYS_RENAMEAT2  = 276
-	SYS_STATFS     = 43
-	SYS_CHDIR      = 49
-	SYS_FCHDIR     = 50
-	SYS_FACCESSAT  = 48
-	SYS_FCHMODAT   = 53
-	SYS_FCHOWNAT   = 54
-	SYS_OPENAT     = 56
-	SYS_CLOSE      = 57
-	SYS_GETDENTS64 = 61
-	SYS_READLINKAT = 78
-	SYS_NEWFSTATAT = 79
-	SYS_FSTAT      = 80
-	SYS_UTIMENSAT  = 88
-	SYS_GETPID     = 172
-	SYS_EXECVE     = 221
-	SYS_EXECVEAT   = 281
-	SYS_STATX      = 291
-	SYS_FACCESSAT2 = 439
+	SYS_SETXATTR          = 5
+	SYS_LSETXATTR         = 6
+	SYS_FSETXATTR         = 7
+	SYS_GETXATTR          = 8
+	SYS_GETCWD            = 17
+	SYS_LGETXATTR         = 9
+	SYS_FGETXATTR         = 10
+	SYS_LISTXATTR         = 11
+	SYS_LLISTXATTR        = 12
+	SYS_FLISTXATTR        = 13
+	SYS_REMOVEXATTR       = 14
+	SYS_LREMOVEXATTR      = 15
+	SYS_FREMOVEXATTR      = 16
+	SYS_DUP               = 23
+	SYS_DUP3              = 24
+	SYS_FCNTL             = 25
+	SYS_INOTIFY_ADD_WATCH = 27
+	SYS_INOTIFY_RM_WATCH  = 28
+	SYS_MKNODAT           = 33
+	SYS_MKDIRAT           = 34
+	SYS_UNLINKAT          = 35
+	SYS_SYMLINKAT         = 36
+	SYS_LINKAT            = 37
+	SYS_RENAMEAT          = 38
+	SYS_UMOUNT2           = 39
+	SYS_MOUNT             = 40
+	SYS_PIVOT_ROOT        = 41
+	SYS_CHROOT            = 51
+	SYS_BIND              = 200
+	SYS_ACCEPT            = 202
+	SYS_CONNECT           = 203
+	SYS_GETSOCKNAME       = 204
+	SYS_GETPEERNAME       = 205
+	SYS_SENDTO            = 206
+	SYS_RECVFROM          = 207
+	SYS_SENDMSG           = 211
+	SYS_RECVMSG           = 212
+	SYS_ACCEPT4           = 242
+	SYS_RENAMEAT2         = 276
+	SYS_FTRUNCATE         = 46
+	SYS_FALLOCATE         = 47
+	SYS_STATFS            = 43
+	SYS_CHDIR             = 49
+	SYS_FCHDIR            = 50
+	SYS_FACCESSAT         = 48
+	SYS_FCHMOD            = 52
+	SYS_FCHMODAT          = 53
+	SYS_FCHOWNAT          = 54
+	SYS_FCHOWN            = 55
+	SYS_OPENAT            = 56
+	SYS_CLOSE             = 57
+	SYS_GETDENTS64        = 61
+	SYS_LSEEK             = 62
+	SYS_READ              = 63
+	SYS_WRITE             = 64
+	SYS_WRITEV            = 66
+	SYS_PWRITE64          = 68
+	SYS_PWRITEV           = 70
+	SYS_SENDFILE          = 71
+	SYS_VMSPLICE          = 75
+	SYS_SPLICE            = 76
+	SYS_READLINKAT        = 78
+	SYS_NEWFSTATAT        = 79
+	SYS_FSTAT             = 80
+	SYS_UTIMENSAT         = 88
+	SYS_WAITID            = 95
+	SYS_PTRACE            = 117
+	SYS_GETPID            = 172
+	SYS_EXECVE            = 221
+	SYS_MMAP              = 222
+	SYS_MPROTECT          = 226
+	SYS_WAIT4             = 260
+	SYS_FANOTIFY_MARK     = 263
+	SYS_NAME_TO_HANDLE_AT = 264
+	SYS_MEMFD_CREATE      = 279
+	SYS_EXECVEAT          = 281
+	SYS_COPY_FILE_RANGE   = 285
+	SYS_PWRITEV2          = 287
+	SYS_PKEY_MPROTECT     = 288
+	SYS_STATX             = 291
+	SYS_OPEN_TREE         = 428
+	SYS_MOVE_MOUNT        = 429
+	SYS_FSOPEN            = 430
+	SYS_FSCONFIG          = 431
+	SYS_FSMOUNT           = 432
+	SYS_OPENAT2           = 437
+	SYS_FACCESSAT2        = 439
+	SYS_FCHMODAT2         = 452
 
 	SYS_OPEN      = 0xFFFF
 	SYS_STAT      = 0xFFFF - 1
@@ -58,6 +116,7 @@ const (
 	SYS_UTIMES    = 0xFFFF - 19
 	SYS_FUTIMESAT = 0xFFFF - 20
 	SYS_MKNOD     = 0xFFFF - 21
+	SYS_GETDENTS  = 0xFFFF - 22
 )
 
 func sysno(regs *syscall.PtraceRegs) uint64        { return regs.Regs[8] }
@@ -72,4 +131,91 @@ func arg2(regs *syscall.PtraceRegs) uint64         { return regs.Regs[2] }
 func setArg2(regs *syscall.PtraceRegs, v uint64)   { regs.Regs[2] = v }
 func arg3(regs *syscall.PtraceRegs) uint64         { return regs.Regs[3] }
 func setArg3(regs *syscall.PtraceRegs, v uint64)   { regs.Regs[3] = v }
+func arg4(regs *syscall.PtraceRegs) uint64         { return regs.Regs[4] }
+func setArg4(regs *syscall.PtraceRegs, v uint64)   { regs.Regs[4] = v }
+func arg5(regs *syscall.PtraceRegs) uint64         { return regs.Regs[5] }
+func setArg5(regs *syscall.PtraceRegs, v uint64)   { regs.Regs[5] = v }
 func sp(regs *syscall.PtraceRegs) uint64           { return regs.Sp }
+func pc(regs *syscall.PtraceRegs) uint64           { return regs.Pc }
+
+// fuss does not handle AArch32 tracees.
+func isCompat(*syscall.PtraceRegs) bool { return false }
+
+func nativeSysno(_ *syscall.PtraceRegs, nr uint64) uint64 { return nr }
+
+func markSyscallArch(int, *syscall.PtraceRegs, uint32) {}
+
+func unmarkSyscallArch(int) {}
+
+type lowScratchMap struct{}
+
+func (t *Tracer) startLowScratch(*ProcessState, *syscall.PtraceRegs, uint64, [6]uint64) bool {
+	return false
+}
+
+func (t *Tracer) finishLowScratch(*ProcessState, *syscall.PtraceRegs) {}
+
+func lowScratchTop(*ProcessState) uintptr { return 0 }
+
+func expandSocketcall(int, *syscall.PtraceRegs) bool { return false }
+
+func restoreSocketcall(int, *syscall.PtraceRegs, [6]uint64) {}
+
+// seekSyscall returns the lseek that sets the offset of fd to pos.
+func seekSyscall(_ *syscall.PtraceRegs, fd int, pos int64, _ uintptr) (uint64, [6]uint64) {
+	return SYS_LSEEK, [6]uint64{uint64(fd), uint64(pos), SEEK_SET}
+}
+
+// statNlink returns where st_nlink is in struct stat.
+func statNlink(*syscall.PtraceRegs) (offset uintptr, size int) { return 20, 4 }
+
+// svc #0, as found at the tracee's program counter.
+var syscallInsn = []byte{0x01, 0x00, 0x00, 0xd4}
+
+// x0 carries the return value at syscall exit, so only x1-x5 are restored.
+func restoreEntryArgs(regs *syscall.PtraceRegs, nr uint64, args [6]uint64) {
+	regs.Regs[8] = nr
+	copy(regs.Regs[1:6], args[1:])
+}
+
+// rewindSyscall makes a tracee stopped at syscall exit execute the same
+// syscall again once resumed.
+func rewindSyscall(regs *syscall.PtraceRegs, nr uint64, args [6]uint64) {
+	restoreEntryArgs(regs, nr, args)
+	regs.Regs[0] = args[0]
+	regs.Pc -= uint64(len(syscallInsn))
+}
+
+func ptraceGetRegs(pid int, regs *syscall.PtraceRegs) error {
+	return syscall.PtraceGetRegs(pid, regs)
+}
+
+// The kernel takes the syscall number from x8 only at svc: a tracee stopped
+// in a syscall keeps its own copy, which NT_ARM_SYSTEM_CALL reads and sets.
+// It is -1 outside a syscall, where it is left alone.
+const NT_ARM_SYSTEM_CALL = 0x404
+
+func ptraceSetRegs(pid int, regs *syscall.PtraceRegs) error {
+	if err := syscall.PtraceSetRegs(pid, regs); err != nil {
+		return err
+	}
+	var nr int32
+	if err := ptraceSyscallNr(PTRACE_GETREGSET, pid, &nr); err != nil {
+		return err
+	}
+	if nr == -1 || uint32(nr) == uint32(regs.Regs[8]) {
+		return nil
+	}
+	nr = int32(regs.Regs[8])
+	return ptraceSyscallNr(PTRACE_SETREGSET, pid, &nr)
+}
+
+func ptraceSyscallNr(req, pid int, nr *int32) error {
+	iov := syscall.Iovec{Base: (*byte)(unsafe.Pointer(nr))}
+	iov.SetLen(int(unsafe.Sizeof(*nr)))
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, uintptr(req), uintptr(pid), NT_ARM_SYSTEM_CALL, uintptr(unsafe.Pointer(&iov)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package tracer
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Sent to a tracee to wake the trace loop out of wait4 when a detach is
+// requested. It has no side effect at send time and is swallowed on delivery.
+const wakeSignal = syscall.SIGURG
+
+// Sent by Detach to an attached fuss. Unlike SIGTERM, it is not a signal a
+// fuss running a command forwards to it, and Detach refuses such an instance
+// anyway.
+const detachSignal = syscall.SIGUSR1
+
+// Attach seizes pid together with all its threads and descendants and starts
+// redirecting the mountpoint for them. SIGINT, SIGTERM, SIGHUP and
+// detachSignal make the tracer detach from the whole tree and return.
+func (t *Tracer) Attach(pid int) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	opts := t.ptraceOptions()
+	seen := make(map[int]bool)
+	for {
+		added := 0
+		for _, tgid := range processTree(pid) {
+			for _, tid := range threadsOf(tgid) {
+				if seen[tid] {
+					continue
+				}
+				seen[tid] = true
+				if err := ptraceSeize(tid, opts); err != nil {
+					if tid == pid {
+						return fmt.Errorf("failed to attach to pid %d: %w", pid, err)
+					}
+					debugf("attach: seize tid=%d failed: %v", tid, err)
+					continue
+				}
+				t.procs[tid] = seedProcessState(tgid, tid)
+				if err := ptraceInterrupt(tid); err != nil {
+					debugf("attach: interrupt tid=%d failed: %v", tid, err)
+				}
+				added++
+			}
+		}
+		// Tasks forked before their parent was seized are picked up by the
+		// next pass; anything forked afterwards is auto-attached.
+		if added == 0 {
+			break
+		}
+	}
+	if len(t.procs) == 0 {
+		return fmt.Errorf("failed to attach to pid %d: %w", pid, syscall.ESRCH)
+	}
+	t.wakePid.Store(int64(pid))
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, detachSignal)
+	defer signal.Stop(sigs)
+	go func() {
+		for range sigs {
+			t.RequestDetach()
+		}
+	}()
+
+	return t.traceLoop(pid)
+}
+
+// RequestDetach makes the trace loop release every tracee at its next stop.
+// It is safe to call from any goroutine.
+func (t *Tracer) RequestDetach() {
+	t.detachRequested.Store(true)
+	if pid := t.wakePid.Load(); pid > 0 {
+		syscall.Kill(int(pid), wakeSignal)
+	}
+}
+
+// Detach asks the fuss instance tracing pid to release its process tree.
+func Detach(pid int) error {
+	tracerPid, err := tracerOf(pid)
+	if err != nil {
+		return err
+	}
+	if tracerPid == 0 {
+		return fmt.Errorf("pid %d is not traced", pid)
+	}
+	if !isFussProcess(tracerPid) {
+		return fmt.Errorf("pid %d is traced by pid %d, which is not fuss", pid, tracerPid)
+	}
+	if !isAttached(tracerPid) {
+		return fmt.Errorf("pid %d is traced by a fuss running it, not by fuss attach", pid)
+	}
+	return syscall.Kill(tracerPid, detachSignal)
+}
+
+// detachAll releases every tracee, starting with pid whose wait status has
+// just been collected. swallowWake drops the first wakeSignal seen, which was
+// sent by RequestDetach.
+func (t *Tracer) detachAll(pid int, ws syscall.WaitStatus, swallowWake bool) error {
+	t.detached = true
+	for other, proc := range t.procs {
+		if other == pid {
+			continue
+		}
+		if proc.parked {
+			// Already stopped; no further stop will be reported for it.
+			t.releaseParked(proc)
+			if err := ptraceDetach(other, 0); err != nil {
+				debugf("detach: pid=%d failed: %v", other, err)
+			}
+			t.removeProc(other)
+			continue
+		}
+		ptraceInterrupt(other)
+	}
+
+	for {
+		t.detachStopped(pid, ws, &swallowWake)
+		if len(t.procs) == 0 {
+			return nil
+		}
+
+		var err error
+		pid, err = syscall.Wait4(-1, &ws, syscall.WALL, nil)
+		if err != nil {
+			if err == syscall.ECHILD {
+				return nil
+			}
+			return fmt.Errorf("wait4 failed during detach: %w", err)
+		}
+	}
+}
+
+// detachStopped releases one tracee. Syscall exits we still owe a fixup to
+// are completed first; syscall entries are let through unmodified.
+func (t *Tracer) detachStopped(pid int, ws syscall.WaitStatus, swallowWake *bool) {
+	if ws.Exited() || ws.Signaled() {
+		t.removeProc(pid)
+		return
+	}
+	if !ws.Stopped() {
+		return
+	}
+
+	proc, ok := t.procs[pid]
+	if !ok {
+		// An auto-attached child we have not registered yet.
+		proc = &ProcessState{pid: pid, fdPaths: make(map[int]string), fdReal: make(map[int]string)}
+		t.procs[pid] = proc
+	}
+
+	deliver := 0
+	sig := ws.StopSignal()
+	switch {
+	case sig == syscall.SIGTRAP|SIGTRAP_MASK:
+		// Injected syscalls are driven to completion, entries included.
+		if proc.injecting() || (proc.inSyscall && t.atSyscallExit(proc)) {
+			t.handleSyscall(proc)
+		}
+	case sig == syscall.SIGTRAP:
+		event := int(ws>>16) & 0xff
+		if event == 1 || event == 2 || event == 3 {
+			if childPid, err := syscall.PtraceGetEventMsg(pid); err == nil {
+				t.registerChild(proc, int(childPid))
+			}
+		}
+	case int(ws>>16)&0xff == PTRACE_EVENT_STOP:
+		// Group-stop of a seized tracee; it stays stopped after detach.
+	case sig == wakeSignal && *swallowWake:
+		*swallowWake = false
+	default:
+		deliver = int(sig)
+	}
+
+	if proc.injecting() || (proc.inSyscall && proc.needsExit()) {
+		syscall.PtraceSyscall(pid, deliver)
+		return
+	}
+
+	if err := ptraceDetach(pid, deliver); err != nil {
+		debugf("detach: pid=%d failed: %v", pid, err)
+	}
+	t.removeProc(pid)
+}
+
+func (t *Tracer) atSyscallExit(proc *ProcessState) bool {
+	if t.noSyscallInfo {
+		return true
+	}
+	info, err := getSyscallInfo(proc.pid)
+	return err == nil && info.op == PTRACE_SYSCALL_INFO_EXIT
+}
+
+func (p *ProcessState) needsExit() bool {
+	return p.skipResult != nil || p.pendingGetdents != nil || p.pendingRemove != nil ||
+		p.pendingRename != nil || p.pendingXattrList != nil || p.pendingWatch != nil ||
+		p.pendingInotifyRead != nil || p.pendingProcFile != nil ||
+		p.pendingMountParent != nil || p.pendingSockaddr != nil || p.pendingMountFd != nil
+}
+
+// injecting reports whether the tracee is running syscalls injected by fuss.
+func (p *ProcessState) injecting() bool {
+	return p.fdSwap != nil || p.watchSpread != nil || p.lowScratchMap != nil
+}
+
+func seedProcessState(tgid, tid int) *ProcessState {
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/task/%d/cwd", tgid, tid))
+	if err != nil {
+		cwd = "/"
+	}
+
+	fdPaths := make(map[int]string)
+	fdDir := fmt.Sprintf("/proc/%d/fd", tgid)
+	entries, _ := os.ReadDir(fdDir)
+	for _, e := range entries {
+		fd, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(fdDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		target = strings.TrimSuffix(target, " (deleted)")
+		if !filepath.IsAbs(target) {
+			continue
+		}
+		fdPaths[fd] = filepath.Clean(target)
+	}
+
+	return &ProcessState{
+		pid:     tid,
+		cwd:     cwd,
+		fdPaths: fdPaths,
+		fdReal:  make(map[int]string),
+	}
+}
+
+// processTree returns root followed by every live descendant.
+func processTree(root int) []int {
+	children := make(map[int][]int)
+	entries, _ := os.ReadDir("/proc")
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if ppid, ok := parentOf(pid); ok {
+			children[ppid] = append(children[ppid], pid)
+		}
+	}
+
+	tree := []int{root}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree
+}
+
+func parentOf(pid int) (int, bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, false
+	}
+	// The comm field may contain spaces and parentheses; fields after the
+	// last ')' are "state ppid ...".
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, false
+	}
+	return ppid, true
+}
+
+func threadsOf(tgid int) []int {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", tgid))
+	if err != nil {
+		return nil
+	}
+	tids := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if tid, err := strconv.Atoi(e.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids
+}
+
+func tracerOf(pid int) (int, error) {
+	return statusField(pid, "TracerPid:")
+}
+
+func statusField(pid int, key string) (int, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, key); ok {
+			return strconv.Atoi(strings.TrimSpace(rest))
+		}
+	}
+	return 0, fmt.Errorf("no %s in /proc/%d/status", strings.TrimSuffix(key, ":"), pid)
+}
+
+func isFussProcess(pid int) bool {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return false
+	}
+	if self, err := os.Executable(); err == nil && filepath.Clean(self) == filepath.Clean(exe) {
+		return true
+	}
+	return strings.HasPrefix(filepath.Base(exe), "fuss")
+}
+
+// isAttached reports whether the fuss instance pid was started as fuss
+// attach, rather than to run a command.
+func isAttached(pid int) bool {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+	for _, arg := range args[1:] {
+		if arg == "--" {
+			break
+		}
+		if arg == "attach" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package tracer
+
+import (
+	"os"
+	"syscall"
+)
+
+// chroot needs CAP_SYS_CHROOT, which unprivileged builds of root
+// filesystems do not have. A chroot or pivot_root into a directory under the
+// mountpoint is emulated instead: the process gets a virtual root, which
+// absolute paths and ".." are resolved against, and which its children
+// inherit. Every path below such a root is under the mountpoint and goes
+// through the VFS, so nothing needs the kernel's help. Any other directory
+// is left to the kernel.
+
+// chrootTarget resolves the directory at the path argument arg for use as a
+// root. It returns false if the kernel is to handle the call, or if the
+// call has been failed.
+func (h *SyscallHandler) chrootTarget(arg int) (string, bool) {
+	path, err := ReadString(h.proc.pid, uintptr(argN(h.regs, arg)), 4096)
+	if err != nil || path == "" {
+		return "", false
+	}
+	resolved := h.resolvePath(path)
+	if !h.tracer.resolver.ShouldIntercept(resolved) {
+		return "", false
+	}
+
+	realPath, err := h.tracer.vfs.ResolveForStat(h.tracer.resolver.TranslatePath(resolved), true)
+	if err != nil {
+		h.skipSyscall(errnoFromError(err))
+		return "", false
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		h.skipSyscall(errnoFromError(err))
+		return "", false
+	}
+	if !info.IsDir() {
+		h.skipSyscall(negErrno(syscall.ENOTDIR))
+		return "", false
+	}
+	if syscall.Access(realPath, X_OK) != nil {
+		h.skipSyscall(negErrno(syscall.EACCES))
+		return "", false
+	}
+	return resolved, true
+}
+
+func (h *SyscallHandler) handleChrootEntry() {
+	root, ok := h.chrootTarget(0)
+	if !ok {
+		return
+	}
+	debugf("chroot: root now %q", root)
+	h.proc.root = root
+	h.skipSyscall(0)
+}
+
+// handlePivotRootEntry moves every process that shares the caller's root,
+// and every working directory at that root, to the new root. The old root
+// is not made reachable through put_old.
+func (h *SyscallHandler) handlePivotRootEntry() {
+	newRoot, ok := h.chrootTarget(0)
+	if !ok {
+		return
+	}
+	putOld, ok := h.chrootTarget(1)
+	if !ok {
+		if h.proc.skipResult == nil {
+			h.skipSyscall(negErrno(syscall.EINVAL))
+		}
+		return
+	}
+	if _, ok := pathWithinRoot(putOld, newRoot); !ok {
+		h.skipSyscall(negErrno(syscall.EINVAL))
+		return
+	}
+	oldRoot := h.proc.root
+	if newRoot == joinRoot(oldRoot, "/") {
+		h.skipSyscall(negErrno(syscall.EBUSY))
+		return
+	}
+
+	for _, proc := range h.tracer.procs {
+		if proc.root != oldRoot {
+			continue
+		}
+		proc.root = newRoot
+		if proc.cwd == joinRoot(oldRoot, "/") {
+			proc.cwd = newRoot
+		}
+	}
+	debugf("pivot_root: root now %q", newRoot)
+	h.skipSyscall(0)
+}
+
+// resolveAt resolves path, relative to dirfd, for the syscall being entered.
+// Inside a virtual root the lexical path is not enough: the kernel would
+// follow symlinks on the way through the layers, with absolute targets
+// landing on the host. The path is walked through the VFS instead, with
+// symlinks resolved against the root as the kernel does against a real
+// one.
+func (h *SyscallHandler) resolveAt(dirfd int, path string) string {
+	lexical := h.tracer.resolver.ResolveAt(dirfd, path, h.proc.root, h.proc.cwd, h.proc.fdPaths)
+	if h.proc.root == "" {
+		return lexical
+	}
+	rel, ok := pathWithinRoot(lexical, h.proc.root)
+	if !ok {
+		return lexical
+	}
+	resolved, err := h.walkOpenat2(h.proc.root, rel, RESOLVE_IN_ROOT, h.followsFinalLink())
+	if err != nil {
+		// Let the syscall fail on the lexical path.
+		return lexical
+	}
+	return resolved
+}
+
+func (h *SyscallHandler) resolvePath(path string) string {
+	return h.resolveAt(AT_FDCWD, path)
+}
+
+// followsFinalLink reports whether the syscall being entered follows a
+// symlink in the last component of its path.
+func (h *SyscallHandler) followsFinalLink() bool {
+	args := h.proc.entryArgs
+	switch h.proc.entryNr {
+	case SYS_OPEN:
+		return openFollows(args[1])
+	case SYS_OPENAT:
+		return openFollows(args[2])
+	case SYS_EXECVEAT:
+		return args[4]&AT_SYMLINK_NOFOLLOW == 0
+	case SYS_LINKAT:
+		return args[4]&AT_SYMLINK_FOLLOW != 0
+	case SYS_FCHOWNAT, SYS_UTIMENSAT, SYS_FACCESSAT2, SYS_FCHMODAT2:
+		spec := syscallTable[h.proc.entryNr]
+		return args[spec.flags]&AT_SYMLINK_NOFOLLOW == 0
+	case SYS_UNLINK, SYS_UNLINKAT, SYS_RMDIR, SYS_RENAME, SYS_RENAMEAT, SYS_RENAMEAT2,
+		SYS_LINK, SYS_BIND, SYS_LCHOWN, SYS_LSETXATTR, SYS_LGETXATTR, SYS_LLISTXATTR,
+		SYS_LREMOVEXATTR:
+		return false
+	}
+	spec, ok := syscallTable[h.proc.entryNr]
+	if !ok {
+		return true
+	}
+	inverted := spec.symlink != 0 && spec.flags != none && args[spec.flags]&spec.symlink != 0
+	switch spec.op {
+	case opLstat:
+		return inverted
+	case opStat, opWatch:
+		return !inverted
+	case opReadlink, opCreate, opSymlink:
+		return false
+	}
+	return true
+}
+
+func openFollows(flags uint64) bool {
+	if flags&syscall.O_NOFOLLOW != 0 {
+		return false
+	}
+	return flags&(syscall.O_CREAT|syscall.O_EXCL) != syscall.O_CREAT|syscall.O_EXCL
+}
@@ -0,0 +1,361 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+// A 32-bit program runs in compat mode, with the i386 code segment selector
+// in CS. Its syscalls take their number and arguments in the i386 registers
+// and use the i386 numbering, which fuss maps onto the native syscalls it
+// handles them as. The register accessors do both translations, so handlers
+// see a compat syscall as its native counterpart; structs whose layout
+// differs go by wordSize and isCompat. A syscall made with int 0x80 from
+// 64-bit code is an i386 one too, but leaves CS as it is; the audit arch
+// PTRACE_GET_SYSCALL_INFO reports tells it apart.
+
+const (
+	compatCS = 0x23
+
+	AUDIT_ARCH_I386 = 0x40000003
+)
+
+// int80Tracees holds the real CS of tracees stopped in an i386 syscall made
+// from 64-bit code. ptraceGetRegs shows them with compatCS for the register
+// accessors to go by, and ptraceSetRegs puts the real one back.
+var int80Tracees = make(map[int]uint64)
+
+// markSyscallArch notes whether the syscall pid is stopped in, with regs
+// and of audit arch arch, is an i386 one made from 64-bit code.
+func markSyscallArch(pid int, regs *syscall.PtraceRegs, arch uint32) {
+	if arch != AUDIT_ARCH_I386 {
+		delete(int80Tracees, pid)
+		return
+	}
+	if _, ok := int80Tracees[pid]; !ok && regs.Cs != compatCS {
+		int80Tracees[pid] = regs.Cs
+		regs.Cs = compatCS
+	}
+}
+
+// Pointers of an i386 syscall are 32 bits wide, which the scratch space
+// below the stack pointer of 64-bit code is out of reach of. Before the
+// first such syscall of a process, the tracee is made to map scratch space
+// of its own with an injected mmap2, which the kernel places below 4GB for
+// an i386 syscall, and the syscall is then restarted.
+const lowScratchSize = 256 * 1024
+
+// lowScratchMap is the syscall interrupted to map the scratch space.
+type lowScratchMap struct {
+	regs syscall.PtraceRegs
+	nr   uint64
+	args [6]uint64
+}
+
+// startLowScratch turns the syscall at hand into the mmap2 of the scratch
+// space if the process needs it and has none yet.
+func (t *Tracer) startLowScratch(proc *ProcessState, regs *syscall.PtraceRegs, nr uint64, args [6]uint64) bool {
+	if _, ok := int80Tracees[proc.pid]; !ok || proc.lowScratchTried {
+		return false
+	}
+	proc.lowScratchTried = true
+	proc.lowScratchMap = &lowScratchMap{regs: *regs, nr: nr, args: args}
+	next := *regs
+	setSysno(&next, SYS_MMAP)
+	mmapArgs := [6]uint64{0, lowScratchSize, syscall.PROT_READ | syscall.PROT_WRITE, syscall.MAP_PRIVATE | MAP_ANONYMOUS, 0xffffffff, 0}
+	for i, arg := range mmapArgs {
+		setArgN(&next, i, arg)
+	}
+	ptraceSetRegs(proc.pid, &next)
+	return true
+}
+
+// finishLowScratch records the scratch space mapped and restarts the
+// interrupted syscall.
+func (t *Tracer) finishLowScratch(proc *ProcessState, regs *syscall.PtraceRegs) {
+	m := proc.lowScratchMap
+	proc.lowScratchMap = nil
+	if addr := int64(retval(regs)); addr > 0 && addr < 1<<32-lowScratchSize {
+		proc.lowScratch = uintptr(addr)
+	} else {
+		debugf("low scratch: mmap2 for pid=%d failed: %d", proc.pid, addr)
+	}
+	next := m.regs
+	rewindSyscall(&next, m.nr, m.args)
+	ptraceSetRegs(proc.pid, &next)
+}
+
+// lowScratchTop returns the top of the scratch space for the syscall proc
+// is in, if it is an i386 one made from 64-bit code.
+func lowScratchTop(proc *ProcessState) uintptr {
+	if _, ok := int80Tracees[proc.pid]; !ok || proc.lowScratch == 0 {
+		return 0
+	}
+	return proc.lowScratch + lowScratchSize
+}
+
+// unmarkSyscallArch forgets the mark of markSyscallArch once the syscall is
+// over.
+func unmarkSyscallArch(pid int) {
+	delete(int80Tracees, pid)
+}
+
+// i386 numbers of the old stat calls, whose struct stat differs from
+// stat64's.
+const (
+	compatStat  = 106
+	compatLstat = 107
+	compatFstat = 108
+)
+
+const compatSocketcall = 102
+
+// compatLlseek is _llseek, which takes the offset in two 32-bit halves.
+const compatLlseek = 140
+
+// The socketcall calls fuss handles, as the direct i386 syscall and its
+// argument count. accept becomes accept4 with no flags.
+var socketcalls = map[uint64]struct {
+	nr   uint64
+	args int
+}{
+	2:  {361, 3}, // bind
+	3:  {362, 3}, // connect
+	5:  {364, 3}, // accept
+	6:  {367, 3}, // getsockname
+	7:  {368, 3}, // getpeername
+	11: {369, 6}, // sendto
+	12: {371, 6}, // recvfrom
+	16: {370, 3}, // sendmsg
+	17: {372, 3}, // recvmsg
+	18: {364, 4}, // accept4
+}
+
+// compatUnknown marks a compat syscall fuss has no native counterpart for,
+// so that it matches none.
+const compatUnknown = 1 << 32
+
+// compatSyscalls lists the i386 syscalls fuss handles with the native
+// syscall each is handled as. Where several share one, the first is the one
+// fuss issues itself.
+var compatSyscalls = []struct {
+	nr     uint64
+	native uint64
+}{
+	{3, SYS_READ},                // read
+	{4, SYS_WRITE},               // write
+	{5, SYS_OPEN},                // open
+	{6, SYS_CLOSE},               // close
+	{195, SYS_STAT},              // stat64
+	{106, SYS_STAT},              // stat
+	{196, SYS_LSTAT},             // lstat64
+	{107, SYS_LSTAT},             // lstat
+	{197, SYS_FSTAT},             // fstat64
+	{108, SYS_FSTAT},             // fstat
+	{19, SYS_LSEEK},              // lseek
+	{140, SYS_LSEEK},             // _llseek
+	{192, SYS_MMAP},              // mmap2
+	{125, SYS_MPROTECT},          // mprotect
+	{181, SYS_PWRITE64},          // pwrite64
+	{146, SYS_WRITEV},            // writev
+	{239, SYS_SENDFILE},          // sendfile64
+	{187, SYS_SENDFILE},          // sendfile
+	{313, SYS_SPLICE},            // splice
+	{316, SYS_VMSPLICE},          // vmsplice
+	{33, SYS_ACCESS},             // access
+	{41, SYS_DUP},                // dup
+	{63, SYS_DUP2},               // dup2
+	{20, SYS_GETPID},             // getpid
+	{362, SYS_CONNECT},           // connect
+	{369, SYS_SENDTO},            // sendto
+	{371, SYS_RECVFROM},          // recvfrom
+	{370, SYS_SENDMSG},           // sendmsg
+	{372, SYS_RECVMSG},           // recvmsg
+	{361, SYS_BIND},              // bind
+	{367, SYS_GETSOCKNAME},       // getsockname
+	{368, SYS_GETPEERNAME},       // getpeername
+	{11, SYS_EXECVE},             // execve
+	{221, SYS_FCNTL},             // fcntl64
+	{55, SYS_FCNTL},              // fcntl
+	{193, SYS_TRUNCATE},          // truncate64
+	{92, SYS_TRUNCATE},           // truncate
+	{194, SYS_FTRUNCATE},         // ftruncate64
+	{93, SYS_FTRUNCATE},          // ftruncate
+	{141, SYS_GETDENTS},          // getdents
+	{183, SYS_GETCWD},            // getcwd
+	{12, SYS_CHDIR},              // chdir
+	{133, SYS_FCHDIR},            // fchdir
+	{38, SYS_RENAME},             // rename
+	{39, SYS_MKDIR},              // mkdir
+	{40, SYS_RMDIR},              // rmdir
+	{8, SYS_CREAT},               // creat
+	{9, SYS_LINK},                // link
+	{10, SYS_UNLINK},             // unlink
+	{83, SYS_SYMLINK},            // symlink
+	{85, SYS_READLINK},           // readlink
+	{15, SYS_CHMOD},              // chmod
+	{94, SYS_FCHMOD},             // fchmod
+	{212, SYS_CHOWN},             // chown32
+	{182, SYS_CHOWN},             // chown
+	{207, SYS_FCHOWN},            // fchown32
+	{95, SYS_FCHOWN},             // fchown
+	{198, SYS_LCHOWN},            // lchown32
+	{16, SYS_LCHOWN},             // lchown
+	{30, SYS_UTIME},              // utime
+	{14, SYS_MKNOD},              // mknod
+	{268, SYS_STATFS},            // statfs64
+	{99, SYS_STATFS},             // statfs
+	{217, SYS_PIVOT_ROOT},        // pivot_root
+	{61, SYS_CHROOT},             // chroot
+	{21, SYS_MOUNT},              // mount
+	{52, SYS_UMOUNT2},            // umount2
+	{226, SYS_SETXATTR},          // setxattr
+	{227, SYS_LSETXATTR},         // lsetxattr
+	{228, SYS_FSETXATTR},         // fsetxattr
+	{229, SYS_GETXATTR},          // getxattr
+	{230, SYS_LGETXATTR},         // lgetxattr
+	{231, SYS_FGETXATTR},         // fgetxattr
+	{232, SYS_LISTXATTR},         // listxattr
+	{233, SYS_LLISTXATTR},        // llistxattr
+	{234, SYS_FLISTXATTR},        // flistxattr
+	{235, SYS_REMOVEXATTR},       // removexattr
+	{236, SYS_LREMOVEXATTR},      // lremovexattr
+	{237, SYS_FREMOVEXATTR},      // fremovexattr
+	{220, SYS_GETDENTS64},        // getdents64
+	{271, SYS_UTIMES},            // utimes
+	{292, SYS_INOTIFY_ADD_WATCH}, // inotify_add_watch
+	{293, SYS_INOTIFY_RM_WATCH},  // inotify_rm_watch
+	{295, SYS_OPENAT},            // openat
+	{296, SYS_MKDIRAT},           // mkdirat
+	{297, SYS_MKNODAT},           // mknodat
+	{298, SYS_FCHOWNAT},          // fchownat
+	{299, SYS_FUTIMESAT},         // futimesat
+	{300, SYS_NEWFSTATAT},        // fstatat64
+	{301, SYS_UNLINKAT},          // unlinkat
+	{302, SYS_RENAMEAT},          // renameat
+	{303, SYS_LINKAT},            // linkat
+	{304, SYS_SYMLINKAT},         // symlinkat
+	{305, SYS_READLINKAT},        // readlinkat
+	{306, SYS_FCHMODAT},          // fchmodat
+	{307, SYS_FACCESSAT},         // faccessat
+	{412, SYS_UTIMENSAT},         // utimensat_time64
+	{320, SYS_UTIMENSAT},         // utimensat
+	{324, SYS_FALLOCATE},         // fallocate
+	{364, SYS_ACCEPT4},           // accept4
+	{341, SYS_NAME_TO_HANDLE_AT}, // name_to_handle_at
+	{330, SYS_DUP3},              // dup3
+	{334, SYS_PWRITEV},           // pwritev
+	{353, SYS_RENAMEAT2},         // renameat2
+	{356, SYS_MEMFD_CREATE},      // memfd_create
+	{358, SYS_EXECVEAT},          // execveat
+	{377, SYS_COPY_FILE_RANGE},   // copy_file_range
+	{379, SYS_PWRITEV2},          // pwritev2
+	{380, SYS_PKEY_MPROTECT},     // pkey_mprotect
+	{383, SYS_STATX},             // statx
+	{428, SYS_OPEN_TREE},         // open_tree
+	{429, SYS_MOVE_MOUNT},        // move_mount
+	{430, SYS_FSOPEN},            // fsopen
+	{431, SYS_FSCONFIG},          // fsconfig
+	{432, SYS_FSMOUNT},           // fsmount
+	{437, SYS_OPENAT2},           // openat2
+	{439, SYS_FACCESSAT2},        // faccessat2
+	{452, SYS_FCHMODAT2},         // fchmodat2
+}
+
+var (
+	compatToNative = make(map[uint64]uint64)
+	nativeToCompat = make(map[uint64]uint64)
+)
+
+func init() {
+	for _, s := range compatSyscalls {
+		compatToNative[s.nr] = s.native
+		if _, ok := nativeToCompat[s.native]; !ok {
+			nativeToCompat[s.native] = s.nr
+		}
+	}
+}
+
+func isCompat(regs *syscall.PtraceRegs) bool { return regs.Cs == compatCS }
+
+// nativeSysno returns the native syscall a syscall nr made by the tracee
+// with regs is handled as.
+func nativeSysno(regs *syscall.PtraceRegs, nr uint64) uint64 {
+	if !isCompat(regs) {
+		return nr
+	}
+	if native, ok := compatToNative[nr]; ok {
+		return native
+	}
+	return compatUnknown | nr
+}
+
+// compatSysno returns the i386 number of native syscall nr. The syscall in
+// regs keeps its own number if it is handled as nr already, so that a
+// restarted fcntl stays fcntl rather than becoming fcntl64.
+func compatSysno(regs *syscall.PtraceRegs, nr uint64) uint64 {
+	if nativeSysno(regs, regs.Orig_rax) == nr {
+		return regs.Orig_rax
+	}
+	if compat, ok := nativeToCompat[nr]; ok {
+		return compat
+	}
+	return nr &^ compatUnknown
+}
+
+// statNlink returns where st_nlink is in the struct stat the stat syscall
+// in regs fills.
+func statNlink(regs *syscall.PtraceRegs) (offset uintptr, size int) {
+	if !isCompat(regs) {
+		return 16, 8
+	}
+	switch regs.Orig_rax {
+	case compatStat, compatLstat, compatFstat:
+		return 10, 2
+	}
+	return 20, 4
+}
+
+// expandSocketcall turns a socketcall of the tracee into the direct socket
+// syscall, which kernels since 4.3 provide, so that it is handled as one.
+// It returns false if the syscall is left as it is.
+func expandSocketcall(pid int, regs *syscall.PtraceRegs) bool {
+	if !isCompat(regs) || regs.Orig_rax != compatSocketcall {
+		return false
+	}
+	call, ok := socketcalls[arg0(regs)]
+	if !ok {
+		return false
+	}
+	buf := make([]byte, 4*call.args)
+	if _, err := ReadBytes(pid, uintptr(arg1(regs)), buf); err != nil {
+		return false
+	}
+	regs.Orig_rax = call.nr
+	for i := range 6 {
+		var arg uint64
+		if i < call.args {
+			arg = uint64(binary.LittleEndian.Uint32(buf[4*i:]))
+		}
+		setArgN(regs, i, arg)
+	}
+	return ptraceSetRegs(pid, regs) == nil
+}
+
+// restoreSocketcall puts back the socketcall expandSocketcall expanded, at
+// its exit: the argument registers are the tracee's own, which it expects
+// back, and a restart must find the socketcall again.
+func restoreSocketcall(pid int, regs *syscall.PtraceRegs, args [6]uint64) {
+	restoreEntryArgs(regs, compatUnknown|compatSocketcall, args)
+	ptraceSetRegs(pid, regs)
+}
+
+// seekSyscall returns the syscall that sets the offset of fd to pos. The
+// offset of a compat lseek is 32 bits wide, so _llseek is used there,
+// storing the new offset at result.
+func seekSyscall(regs *syscall.PtraceRegs, fd int, pos int64, result uintptr) (uint64, [6]uint64) {
+	if !isCompat(regs) {
+		return SYS_LSEEK, [6]uint64{uint64(fd), uint64(pos), SEEK_SET}
+	}
+	return compatUnknown | compatLlseek, [6]uint64{uint64(fd), uint64(pos) >> 32, uint64(uint32(pos)), uint64(result), SEEK_SET}
+}
@@ -0,0 +1,311 @@
+package tracer
+
+import (
+	"bytes"
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// The kernel loads the interpreter of a script and the ELF interpreter
+// (PT_INTERP) of a dynamic executable itself, from the host. When one of
+// them is under the mountpoint, or the script is, fuss follows the chain the
+// kernel would follow through the VFS and has the tracee exec the last
+// interpreter explicitly, with the argv the kernel would have built. An
+// executable started through its ELF interpreter gets the path it was run
+// by as argv[0], and /proc/self/exe names the interpreter.
+
+const (
+	// As the kernel's BINPRM_MAX_RECURSION.
+	maxInterpDepth = 4
+	// As the kernel's BINPRM_BUF_SIZE, which bounds the #! line.
+	execHeaderSize = 256
+	maxExecArgs    = 1 << 16
+
+	X_OK = 1
+)
+
+// execArg is an argv entry: a pointer the tracee passed, or a string fuss
+// adds.
+type execArg struct {
+	ptr   uint64
+	str   string
+	added bool
+}
+
+func addedArg(s string) execArg {
+	return execArg{str: s, added: true}
+}
+
+func (h *SyscallHandler) handleExecEntry(dirfd, pathArg, argvArg int) {
+	pathAddr := uintptr(argN(h.regs, pathArg))
+	vfsPath, intercept, readable := h.readPathAtDetailed(dirfd, pathAddr)
+	if !readable {
+		return
+	}
+	rawPath, err := ReadString(h.proc.pid, pathAddr, 4096)
+	if err != nil {
+		return
+	}
+
+	var realPath string
+	if intercept {
+		realPath, err = h.tracer.vfs.ResolvePath(vfsPath)
+		if err != nil {
+			h.skipSyscall(errnoFromError(err))
+			return
+		}
+		debugf("exec: %q resolved to real path %q", vfsPath, realPath)
+	} else if _, known := h.proc.fdPaths[dirfd]; filepath.IsAbs(rawPath) || dirfd == AT_FDCWD || known {
+		realPath = h.resolveAt(dirfd, rawPath)
+	}
+
+	if realPath != "" {
+		// The path an interpreter is given to open, which must mean the same
+		// to it as it did to the tracee.
+		shown := rawPath
+		if !filepath.IsAbs(rawPath) && dirfd != AT_FDCWD {
+			shown = rootedPath(h.proc.root, h.resolveAt(dirfd, rawPath))
+		}
+		if h.execInterpreted(shown, realPath, intercept, pathArg, argvArg) {
+			return
+		}
+	}
+	if !intercept {
+		return
+	}
+
+	newAddr, err := h.rewritePath(pathAddr, realPath)
+	if err != nil {
+		return
+	}
+	setArgN(h.regs, pathArg, uint64(newAddr))
+	if pathArg != 0 {
+		setArg0(h.regs, AT_FDCWD_U64)
+	}
+	ptraceSetRegs(h.proc.pid, h.regs)
+}
+
+// execInterpreted rewrites an exec of path, a script or a dynamic
+// executable whose interpreters involve the overlay, into an exec of its
+// interpreter. It returns false if the kernel can be left to it.
+func (h *SyscallHandler) execInterpreted(path, realPath string, virtual bool, pathArg, argvArg int) bool {
+	argv, err := h.readArgv(uintptr(argN(h.regs, argvArg)))
+	if err != nil {
+		return false
+	}
+	lead := argv[:min(len(argv), 1)]
+	rewrite := false
+
+	for depth := 0; ; depth++ {
+		header := make([]byte, execHeaderSize)
+		f, err := os.Open(realPath)
+		if err != nil {
+			break
+		}
+		n, _ := f.Read(header)
+		f.Close()
+		header = header[:n]
+
+		var interp string
+		var more []execArg
+		switch {
+		case bytes.HasPrefix(header, []byte("#!")):
+			var arg string
+			var ok bool
+			interp, arg, ok = parseShebang(header)
+			if !ok {
+				break
+			}
+			if depth == maxInterpDepth {
+				h.skipSyscall(negErrno(syscall.ELOOP))
+				return true
+			}
+			more = []execArg{addedArg(interp)}
+			if arg != "" {
+				more = append(more, addedArg(arg))
+			}
+		case bytes.HasPrefix(header, []byte(elf.ELFMAG)):
+			interp = elfInterp(realPath)
+			more = []execArg{addedArg(interp)}
+		}
+		if interp == "" {
+			break
+		}
+
+		interpReal, interpVirtual, err := h.execRealPath(interp)
+		if err != nil {
+			if !virtual && !interpVirtual {
+				break
+			}
+			h.skipSyscall(errnoFromError(err))
+			return true
+		}
+		// Where the overlay gives the path the kernel would use, as it mostly
+		// does with the host as the lower layer, the kernel may go on.
+		moved := virtual && realPath != path
+		interpMoved := interpVirtual && interpReal != interp
+		elfLoader := !bytes.HasPrefix(header, []byte("#!"))
+		if elfLoader && !interpMoved {
+			break
+		}
+		if syscall.Access(realPath, X_OK) != nil {
+			h.skipSyscall(negErrno(syscall.EACCES))
+			return true
+		}
+
+		debugf("exec: %q runs through interpreter %q (%q)", path, interp, interpReal)
+		// The kernel replaces argv[0] with the interpreter, its argument and
+		// the path; the ELF interpreter takes the path to run instead.
+		more = append(more, addedArg(path))
+		if len(lead) > 0 {
+			lead = lead[1:]
+		}
+		lead = append(more, lead...)
+		rewrite = rewrite || moved || interpMoved
+		path, realPath, virtual = interp, interpReal, interpVirtual
+		if elfLoader {
+			break
+		}
+	}
+	if !rewrite {
+		return false
+	}
+
+	if len(argv) > 0 {
+		argv = argv[1:]
+	}
+	argvAddr, err := h.writeArgv(append(lead, argv...))
+	if err != nil {
+		return false
+	}
+	newAddr, err := h.rewritePath(0, realPath)
+	if err != nil {
+		return false
+	}
+	setArgN(h.regs, pathArg, uint64(newAddr))
+	setArgN(h.regs, argvArg, uint64(argvAddr))
+	if pathArg != 0 {
+		setArg0(h.regs, AT_FDCWD_U64)
+	}
+	ptraceSetRegs(h.proc.pid, h.regs)
+	return true
+}
+
+// execRealPath resolves an interpreter path as the kernel would, relative
+// to the working directory.
+func (h *SyscallHandler) execRealPath(path string) (realPath string, virtual bool, err error) {
+	resolved := h.resolvePath(path)
+	if !h.tracer.resolver.ShouldIntercept(resolved) {
+		if _, err := os.Stat(resolved); err != nil {
+			return "", false, err
+		}
+		return resolved, false, nil
+	}
+	realPath, err = h.tracer.vfs.ResolvePath(h.tracer.resolver.TranslatePath(resolved))
+	return realPath, true, err
+}
+
+// parseShebang splits a #! line into the interpreter and its optional
+// argument, which is everything after it, as the kernel does.
+func parseShebang(header []byte) (interp, arg string, ok bool) {
+	line := header[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	} else if len(header) == execHeaderSize {
+		// Truncated: the kernel only accepts it if the interpreter fits.
+		if bytes.IndexAny(bytes.TrimLeft(line, " \t"), " \t") < 0 {
+			return "", "", false
+		}
+	}
+	line = bytes.Trim(line, " \t")
+	if len(line) == 0 {
+		return "", "", false
+	}
+	interpEnd := bytes.IndexAny(line, " \t")
+	if interpEnd < 0 {
+		return string(line), "", true
+	}
+	return string(line[:interpEnd]), string(bytes.TrimLeft(line[interpEnd:], " \t")), true
+}
+
+// elfInterp returns the PT_INTERP of the ELF file at path, if it has one.
+func elfInterp(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return ""
+		}
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			data = data[:i]
+		}
+		return string(data)
+	}
+	return ""
+}
+
+func (h *SyscallHandler) readArgv(addr uintptr) ([]execArg, error) {
+	var argv []execArg
+	if addr == 0 {
+		return argv, nil
+	}
+	word := wordSize(h.regs)
+	buf := make([]byte, 512)
+	for len(argv) < maxExecArgs {
+		if _, err := ReadBytes(h.proc.pid, addr, buf); err != nil {
+			return nil, err
+		}
+		for off := 0; off < len(buf); off += word {
+			ptr := getUint(buf[off : off+word])
+			if ptr == 0 {
+				return argv, nil
+			}
+			argv = append(argv, execArg{ptr: ptr})
+		}
+		addr += uintptr(len(buf))
+	}
+	return nil, syscall.E2BIG
+}
+
+// writeArgv writes the strings fuss adds to argv and the pointer array
+// itself to scratch space.
+func (h *SyscallHandler) writeArgv(argv []execArg) (uintptr, error) {
+	var strs []byte
+	for _, a := range argv {
+		if a.added {
+			strs = append(strs, a.str...)
+			strs = append(strs, 0)
+		}
+	}
+	strsAddr := h.scratchAddrFor(len(strs), 1)
+	if err := WriteBytes(h.proc.pid, strsAddr, strs); err != nil {
+		return 0, err
+	}
+
+	word := wordSize(h.regs)
+	ptrs := make([]byte, word*(len(argv)+1))
+	off := uint64(0)
+	for i, a := range argv {
+		ptr := a.ptr
+		if a.added {
+			ptr = uint64(strsAddr) + off
+			off += uint64(len(a.str)) + 1
+		}
+		putUint(ptrs[word*i:word*(i+1)], ptr)
+	}
+	// Below the strings, where it may grow as long as argv needs.
+	ptrsAddr := h.scratchAddrFor(len(ptrs), 2)
+	if err := WriteBytes(h.proc.pid, ptrsAddr, ptrs); err != nil {
+		return 0, err
+	}
+	return ptrsAddr, nil
+}
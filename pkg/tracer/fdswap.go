@@ -0,0 +1,270 @@
+package tracer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// A tracee may hold an fd on a lower-layer file, e.g. one opened O_RDONLY.
+// Mutating it through that fd (fchmod, ftruncate, ...) would change the
+// lower layer, so fuss first copies the file up and has the tracee swap the
+// fd for one opened on the upper copy. The mutating syscall is turned into
+// an openat, followed by injected dup3, close and lseek calls, after which
+// the original syscall is restarted on the swapped fd.
+//
+// With deferred copy-up, write-opens of lower-layer files are served
+// read-only and the same swap happens on the first write through the fd,
+// this time reopening the upper copy with the access mode asked for.
+
+const (
+	AT_EMPTY_PATH = 0x1000
+	O_PATH        = 010000000
+	SEEK_SET      = 0
+)
+
+type fdSwapStep int
+
+const (
+	swapOpen fdSwapStep = iota
+	swapDup
+	swapClose
+	swapSeek
+	swapReplay
+)
+
+type fdSwap struct {
+	step     fdSwapStep
+	fd       int
+	newfd    int
+	flags    int
+	pos      int64
+	realPath string
+	// Where a compat tracee's _llseek stores the offset.
+	seekResult uintptr
+	err        int64
+
+	// The interrupted syscall, restarted once the fd is swapped.
+	regs syscall.PtraceRegs
+	nr   uint64
+	args [6]uint64
+}
+
+// fdOnly reports whether a *at syscall operates on dirfd itself: a NULL
+// path, or an empty one with AT_EMPTY_PATH.
+func (h *SyscallHandler) fdOnly(pathAddr uintptr, flags int) bool {
+	if pathAddr == 0 {
+		return true
+	}
+	if flags&AT_EMPTY_PATH == 0 {
+		return false
+	}
+	path, err := ReadString(h.proc.pid, pathAddr, 1)
+	return err == nil && path == ""
+}
+
+// handleFdMutationEntry copies up the file behind fd before a syscall that
+// modifies it through the fd, and swaps the fd if it still refers to a
+// lower-layer file.
+func (h *SyscallHandler) handleFdMutationEntry(fd int) {
+	path, ok := h.proc.fdPaths[fd]
+	if !ok || !h.tracer.resolver.ShouldIntercept(path) {
+		return
+	}
+	vfsPath := h.tracer.resolver.TranslatePath(path)
+
+	realPath, ok := h.fdRealPath(fd)
+	if !ok {
+		return
+	}
+
+	if _, err := h.tracer.vfs.ResolvePath(vfsPath); err != nil {
+		// Removed from the overlay while open; there is nothing to copy up
+		// and the fd may well point into a lower layer.
+		debugf("fd mutation: fd=%d %q no longer resolves: %v", fd, vfsPath, err)
+		h.skipSyscall(negErrno(syscall.EROFS))
+		return
+	}
+	upperPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
+	if err != nil {
+		h.skipSyscall(errnoFromError(err))
+		return
+	}
+	writeMode, deferred := h.proc.fdWriteMode[fd]
+	if upperPath == realPath && !deferred {
+		return
+	}
+
+	flags, pos, err := fdInfo(h.proc.pid, fd)
+	if err != nil {
+		debugf("fd mutation: fdinfo for fd=%d failed: %v", fd, err)
+		return
+	}
+	if flags&O_PATH != 0 {
+		return
+	}
+	if deferred {
+		flags = flags&^syscall.O_ACCMODE | writeMode
+	}
+
+	debugf("fd mutation: swapping fd=%d %q -> %q", fd, realPath, upperPath)
+	h.startFdSwap(fd, upperPath, flags, pos)
+}
+
+// deferWriteOpen decides whether a write-open of vfsPath is served read-only
+// until the first write. It returns the access mode to restore then, or 0.
+func (h *SyscallHandler) deferWriteOpen(vfsPath string, flags int) int {
+	mode := flags & syscall.O_ACCMODE
+	if !h.tracer.deferCopyUp || mode == syscall.O_RDONLY {
+		return 0
+	}
+	if flags&(syscall.O_TRUNC|O_DIRECTORY|O_PATH) != 0 {
+		return 0
+	}
+	checker, ok := h.tracer.vfs.(copyUpChecker)
+	if !ok || !checker.NeedsCopyUp(vfsPath) {
+		return 0
+	}
+	return mode
+}
+
+// handleDeferredWriteEntry copies up and swaps fd if it was opened for
+// writing with the copy-up deferred. Other fds are left alone: a write to a
+// read-only fd fails anyway and must not copy anything up.
+func (h *SyscallHandler) handleDeferredWriteEntry(fd int) {
+	if _, ok := h.proc.fdWriteMode[fd]; !ok {
+		return
+	}
+	h.handleFdMutationEntry(fd)
+}
+
+func (h *SyscallHandler) fdRealPath(fd int) (string, bool) {
+	if realPath, ok := h.proc.fdReal[fd]; ok {
+		return realPath, true
+	}
+	target, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", h.proc.pid, fd))
+	if err != nil || !filepath.IsAbs(target) {
+		return "", false
+	}
+	return target, true
+}
+
+// fdInfo returns the open flags and file offset of a tracee's fd.
+func fdInfo(pid, fd int) (flags int, pos int64, err error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%d", pid, fd))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "pos":
+			pos, err = strconv.ParseInt(value, 10, 64)
+		case "flags":
+			var f int64
+			f, err = strconv.ParseInt(value, 8, 64)
+			flags = int(f)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return flags, pos, nil
+}
+
+// startFdSwap turns the syscall at hand into an openat of the upper copy.
+func (h *SyscallHandler) startFdSwap(fd int, upperPath string, flags int, pos int64) {
+	swap := &fdSwap{
+		step:       swapOpen,
+		fd:         fd,
+		flags:      flags,
+		pos:        pos,
+		realPath:   upperPath,
+		seekResult: h.scratchAddrFor(8, 1),
+		regs:       *h.regs,
+		nr:         h.proc.entryNr,
+		args:       h.proc.entryArgs,
+	}
+
+	addr, err := h.rewritePath(0, upperPath)
+	if err != nil {
+		return
+	}
+	setSysno(h.regs, SYS_OPENAT)
+	setArg0(h.regs, AT_FDCWD_U64)
+	setArg1(h.regs, uint64(addr))
+	setArg2(h.regs, uint64(flags&^(syscall.O_CREAT|syscall.O_EXCL|syscall.O_TRUNC|syscall.O_NOCTTY)))
+	setArg3(h.regs, 0)
+	ptraceSetRegs(h.proc.pid, h.regs)
+	h.proc.fdSwap = swap
+}
+
+// advanceFdSwap runs at the exit of each injected syscall and sets up the
+// next one, finally restarting the interrupted syscall.
+func (t *Tracer) advanceFdSwap(proc *ProcessState, regs *syscall.PtraceRegs) {
+	swap := proc.fdSwap
+	ret := int64(retval(regs))
+	next := *regs
+
+	if ret < 0 && swap.err == 0 && (swap.step == swapOpen || swap.step == swapDup) {
+		debugf("fd swap: step %d for fd=%d failed: %d", swap.step, swap.fd, ret)
+		swap.err = ret
+		if swap.step == swapOpen {
+			t.failFdSwap(proc)
+			return
+		}
+		// Don't leak the fd we opened.
+		swap.step = swapClose
+		rewindSyscall(&next, SYS_CLOSE, [6]uint64{uint64(swap.newfd)})
+		ptraceSetRegs(proc.pid, &next)
+		return
+	}
+
+	switch swap.step {
+	case swapOpen:
+		swap.newfd = int(ret)
+		swap.step = swapDup
+		cloexec := uint64(swap.flags & syscall.O_CLOEXEC)
+		rewindSyscall(&next, SYS_DUP3, [6]uint64{uint64(swap.newfd), uint64(swap.fd), cloexec})
+	case swapDup:
+		swap.step = swapClose
+		proc.fdReal[swap.fd] = swap.realPath
+		delete(proc.fdWriteMode, swap.fd)
+		rewindSyscall(&next, SYS_CLOSE, [6]uint64{uint64(swap.newfd)})
+	case swapClose:
+		if swap.err != 0 {
+			t.failFdSwap(proc)
+			return
+		}
+		if swap.pos != 0 {
+			swap.step = swapSeek
+			nr, args := seekSyscall(&next, swap.fd, swap.pos, swap.seekResult)
+			rewindSyscall(&next, nr, args)
+			break
+		}
+		fallthrough
+	case swapSeek:
+		swap.step = swapReplay
+		next = swap.regs
+		rewindSyscall(&next, swap.nr, swap.args)
+	}
+	ptraceSetRegs(proc.pid, &next)
+}
+
+// failFdSwap completes the interrupted syscall with the error that stopped
+// the swap.
+func (t *Tracer) failFdSwap(proc *ProcessState) {
+	swap := proc.fdSwap
+	proc.fdSwap = nil
+	next := swap.regs
+	restoreEntryArgs(&next, swap.nr, swap.args)
+	setRetval(&next, uint64(swap.err))
+	ptraceSetRegs(proc.pid, &next)
+}
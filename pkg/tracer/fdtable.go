@@ -5,8 +5,8 @@ import (
 )
 
 type DirInfo struct {
-	path   string
-	pos    int
+	path string
+	pos  int
 }
 
 type FDTable struct {
@@ -1,8 +1,10 @@
 package tracer
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,6 +19,9 @@ const (
 	AT_REMOVEDIR        = 0x200
 	F_DUPFD             = 0
 	F_DUPFD_CLOEXEC     = 1030
+	F_GETFL             = 3
+	RENAME_EXCHANGE     = 0x2
+	RENAME_WHITEOUT     = 0x4
 
 	O_DIRECTORY = syscall.O_DIRECTORY
 )
@@ -38,9 +43,41 @@ type removePlanner interface {
 	FinalizeRemove(path string, isDir bool) error
 }
 
+// renamePlanner is implemented by filesystems that emulate renameat2 flags
+// instead of passing them to the kernel.
+type renamePlanner interface {
+	PlanRename(oldpath, newpath string, flags uint) (oldReal, newReal string, err error)
+	FinalizeRename(oldpath, newpath string, flags uint) error
+}
+
+// copyUpChecker is implemented by filesystems that copy files up on write.
+type copyUpChecker interface {
+	NeedsCopyUp(path string) bool
+}
+
+// xattrHider is implemented by filesystems that keep private extended
+// attributes on their backing files.
+type xattrHider interface {
+	HiddenXattr(name string) bool
+}
+
+type xattrOp int
+
+const (
+	xattrGet xattrOp = iota
+	xattrList
+	xattrSet
+	xattrRemove
+)
+
 func (h *SyscallHandler) HandleEntry() {
-	nr := sysno(h.regs)
-	debugf("syscall entry: %d arg0=%x arg1=%x arg2=%x arg3=%x", nr, arg0(h.regs), arg1(h.regs), arg2(h.regs), arg3(h.regs))
+	nr, args := h.proc.entryNr, h.proc.entryArgs
+	debugf("syscall entry: %d arg0=%x arg1=%x arg2=%x arg3=%x", nr, args[0], args[1], args[2], args[3])
+
+	if spec, ok := syscallTable[nr]; ok {
+		h.handlePathEntry(spec)
+		return
+	}
 
 	switch nr {
 	case SYS_OPEN:
@@ -49,24 +86,22 @@ func (h *SyscallHandler) HandleEntry() {
 		h.handleCreatEntry()
 	case SYS_OPENAT:
 		h.handleOpenatEntry()
+	case SYS_OPENAT2:
+		h.handleOpenat2Entry()
 	case SYS_EXECVE:
-		h.handleExecveEntry()
+		h.handleExecEntry(AT_FDCWD, 0, 1)
 	case SYS_EXECVEAT:
-		h.handleExecveatEntry()
+		h.handleExecEntry(int(int32(args[0])), 1, 2)
 	case SYS_CLOSE:
 		h.handleCloseEntry()
-	case SYS_STAT:
-		h.handleStatEntry()
-	case SYS_LSTAT:
-		h.handleLstatEntry()
-	case SYS_NEWFSTATAT:
-		h.handleNewfstatatEntry()
+	case SYS_GETDENTS:
+		format := direntLegacy
+		if isCompat(h.regs) {
+			format = direntCompat
+		}
+		h.handleGetdentsEntry(format)
 	case SYS_GETDENTS64:
-		h.handleGetdents64Entry()
-	case SYS_MKDIR:
-		h.handleMkdirEntry()
-	case SYS_MKDIRAT:
-		h.handleMkdiratEntry()
+		h.handleGetdentsEntry(dirent64)
 	case SYS_UNLINK:
 		h.handleUnlinkEntry()
 	case SYS_RMDIR:
@@ -75,46 +110,68 @@ func (h *SyscallHandler) HandleEntry() {
 		h.handleUnlinkatEntry()
 	case SYS_RENAME:
 		h.handleRenameEntry()
-	case SYS_RENAMEAT, SYS_RENAMEAT2:
-		h.handleRenameatEntry()
+	case SYS_RENAMEAT:
+		h.handleRenameatEntry(0)
+	case SYS_RENAMEAT2:
+		h.handleRenameatEntry(uint(args[4]))
 	case SYS_LINK:
 		h.handleLinkEntry()
 	case SYS_LINKAT:
 		h.handleLinkatEntry()
-	case SYS_SYMLINK:
-		h.handleSymlinkEntry()
-	case SYS_SYMLINKAT:
-		h.handleSymlinkatEntry()
-	case SYS_READLINK:
-		h.handleReadlinkEntry()
-	case SYS_READLINKAT:
-		h.handleReadlinkatEntry()
-	case SYS_CHMOD:
-		h.handleChmodEntry()
-	case SYS_CHOWN:
-		h.handleChownEntry()
-	case SYS_LCHOWN:
-		h.handleLchownEntry()
-	case SYS_FCHMODAT:
-		h.handleFchmodatEntry()
-	case SYS_FCHOWNAT:
-		h.handleFchownatEntry()
-	case SYS_FACCESSAT:
-		h.handleFaccessatEntry()
-	case SYS_FACCESSAT2:
-		h.handleFaccessat2Entry()
 	case SYS_GETXATTR:
-		h.handleXattrPathEntry(true)
+		h.handleXattrPathEntry(xattrGet, true)
 	case SYS_LGETXATTR:
-		h.handleXattrPathEntry(false)
+		h.handleXattrPathEntry(xattrGet, false)
 	case SYS_LISTXATTR:
-		h.handleXattrPathEntry(true)
+		h.handleXattrPathEntry(xattrList, true)
 	case SYS_LLISTXATTR:
-		h.handleXattrPathEntry(false)
-	case SYS_STATFS:
-		h.handleStatfsEntry()
-	case SYS_STATX:
-		h.handleStatxEntry()
+		h.handleXattrPathEntry(xattrList, false)
+	case SYS_SETXATTR:
+		h.handleXattrPathEntry(xattrSet, true)
+	case SYS_LSETXATTR:
+		h.handleXattrPathEntry(xattrSet, false)
+	case SYS_REMOVEXATTR:
+		h.handleXattrPathEntry(xattrRemove, true)
+	case SYS_LREMOVEXATTR:
+		h.handleXattrPathEntry(xattrRemove, false)
+	case SYS_FGETXATTR:
+		h.handleXattrFdEntry(xattrGet)
+	case SYS_FLISTXATTR:
+		h.handleXattrFdEntry(xattrList)
+	case SYS_FSETXATTR:
+		h.handleXattrFdEntry(xattrSet)
+	case SYS_FREMOVEXATTR:
+		h.handleXattrFdEntry(xattrRemove)
+	case SYS_FCHMOD, SYS_FCHOWN, SYS_FTRUNCATE, SYS_FALLOCATE:
+		h.handleFdMutationEntry(int(int32(args[0])))
+	case SYS_READ:
+		h.handleInotifyReadEntry()
+	case SYS_FSTAT:
+		h.handleMountParentStatEntry(int(int32(args[0])), 0)
+	case SYS_LSEEK:
+		delete(h.proc.splicedDirs, int(int32(args[0])))
+	case SYS_INOTIFY_RM_WATCH:
+		h.handleInotifyRmWatchEntry()
+	case SYS_BIND, SYS_CONNECT:
+		h.handleSockaddrEntry(1, 2)
+	case SYS_SENDTO:
+		h.handleSockaddrEntry(4, 5)
+	case SYS_SENDMSG:
+		h.handleSendmsgEntry()
+	case SYS_GETSOCKNAME, SYS_GETPEERNAME, SYS_ACCEPT, SYS_ACCEPT4:
+		h.handleSockaddrResultEntry(1, 2)
+	case SYS_RECVFROM:
+		h.handleSockaddrResultEntry(4, 5)
+	case SYS_RECVMSG:
+		h.handleRecvmsgEntry()
+	case SYS_WRITE, SYS_PWRITE64, SYS_WRITEV, SYS_PWRITEV, SYS_PWRITEV2, SYS_SENDFILE, SYS_VMSPLICE:
+		h.handleDeferredWriteEntry(int(int32(args[0])))
+	case SYS_SPLICE, SYS_COPY_FILE_RANGE:
+		h.handleDeferredWriteEntry(int(int32(args[2])))
+	case SYS_MMAP:
+		h.handleMmapEntry()
+	case SYS_MPROTECT, SYS_PKEY_MPROTECT:
+		h.handleMprotectEntry()
 	case SYS_DUP:
 		h.handleDupEntry()
 	case SYS_DUP2, SYS_DUP3:
@@ -127,22 +184,30 @@ func (h *SyscallHandler) HandleEntry() {
 		h.handleFchdirEntry()
 	case SYS_GETCWD:
 		h.handleGetcwdEntry()
-	case SYS_ACCESS:
-		h.handleAccessEntry()
-	case SYS_MKNOD:
-		h.handleMknodEntry()
-	case SYS_MKNODAT:
-		h.handleMknodatEntry()
-	case SYS_TRUNCATE:
-		h.handleTruncateEntry()
-	case SYS_UTIME:
-		h.handleUtimeEntry()
-	case SYS_UTIMES:
-		h.handleUtimesEntry()
-	case SYS_FUTIMESAT:
-		h.handleFutimesatEntry()
-	case SYS_UTIMENSAT:
-		h.handleUtimensatEntry()
+	case SYS_CHROOT:
+		h.handleChrootEntry()
+	case SYS_PIVOT_ROOT:
+		h.handlePivotRootEntry()
+	case SYS_MOUNT:
+		h.handleMountEntry()
+	case SYS_UMOUNT2:
+		h.handleUmountEntry()
+	case SYS_OPEN_TREE:
+		h.handleOpenTreeEntry()
+	case SYS_FSOPEN:
+		h.handleFsopenEntry()
+	case SYS_FSCONFIG:
+		h.handleFsconfigEntry()
+	case SYS_FSMOUNT:
+		h.handleFsmountEntry()
+	case SYS_MOVE_MOUNT:
+		h.handleMoveMountEntry()
+	case SYS_PTRACE:
+		h.handlePtraceEntry()
+	case SYS_WAIT4:
+		h.handleWaitEntry(false)
+	case SYS_WAITID:
+		h.handleWaitEntry(true)
 	}
 }
 
@@ -151,40 +216,61 @@ func (h *SyscallHandler) HandleExit() {
 		result := *h.proc.skipResult
 		h.proc.skipResult = nil
 		setRetval(h.regs, uint64(result))
-		syscall.PtraceSetRegs(h.proc.pid, h.regs)
+		ptraceSetRegs(h.proc.pid, h.regs)
 		return
 	}
 
-	nr := sysno(h.regs)
+	// The syscall number recorded at entry is authoritative; the register may
+	// have been rewritten by us or clobbered by a restart.
+	nr := h.proc.entryNr
 
 	switch nr {
-	case SYS_OPEN:
+	case SYS_OPEN, SYS_OPENAT:
+		h.handleProcFileExit()
 		h.handleOpenatExit()
 	case SYS_CREAT:
 		h.handleOpenatExit()
-	case SYS_OPENAT:
+	case SYS_OPENAT2:
 		h.handleOpenatExit()
-	case SYS_GETDENTS64:
-		h.handleGetdents64Exit()
+	case SYS_GETDENTS, SYS_GETDENTS64:
+		h.handleGetdentsExit()
+		h.handleMountParentGetdentsExit()
 	case SYS_DUP:
 		h.handleDupExit()
 	case SYS_DUP2, SYS_DUP3:
 		h.handleDup2Exit()
 	case SYS_FCNTL:
 		h.handleDupExit()
+		h.handleGetflExit()
 	case SYS_CHDIR:
 		h.handleChdirExit()
 	case SYS_FCHDIR:
 		h.handleFchdirExit()
 	case SYS_UNLINK, SYS_RMDIR, SYS_UNLINKAT:
 		h.handleRemoveExit()
+	case SYS_RENAMEAT2:
+		h.handleRenameExit()
+	case SYS_INOTIFY_ADD_WATCH, SYS_INOTIFY_RM_WATCH, SYS_FANOTIFY_MARK:
+		h.handleWatchExit()
+	case SYS_READ:
+		h.handleInotifyReadExit()
+	case SYS_GETSOCKNAME, SYS_GETPEERNAME, SYS_ACCEPT, SYS_ACCEPT4, SYS_RECVFROM, SYS_RECVMSG:
+		h.handleSockaddrResultExit()
+	case SYS_OPEN_TREE, SYS_FSOPEN, SYS_FSMOUNT:
+		h.handleMountFdExit()
+	case SYS_STAT, SYS_LSTAT, SYS_FSTAT, SYS_NEWFSTATAT, SYS_STATX:
+		h.handleMountParentStatExit()
+	case SYS_LISTXATTR, SYS_LLISTXATTR, SYS_FLISTXATTR:
+		h.handleXattrListExit()
+	case SYS_WAIT4, SYS_WAITID:
+		h.handleWaitExit()
 	}
 }
 
 func (h *SyscallHandler) skipSyscall(result int64) {
 	setSysno(h.regs, SYS_GETPID)
 	h.proc.skipResult = &result
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 }
 
 func (h *SyscallHandler) readPathAtDetailed(dirfd int, pathAddr uintptr) (vfsPath string, intercept bool, readable bool) {
@@ -211,7 +297,14 @@ func (h *SyscallHandler) readPathAtDetailed(dirfd int, pathAddr uintptr) (vfsPat
 		}
 	}
 
-	resolved := h.tracer.resolver.ResolveAt(dirfd, path, h.proc.cwd, h.proc.fdPaths)
+	resolved := h.resolveAt(dirfd, path)
+	// A magic link followed as a directory leads into the overlay; the
+	// link itself is left to the kernel.
+	if link, rest, ok := h.procLink(resolved); ok && (rest != "" || strings.HasSuffix(path, "/")) {
+		if target, deleted, ok := h.procLinkTarget(link); ok && !deleted {
+			resolved = target + rest
+		}
+	}
 	shouldIntercept := h.tracer.resolver.ShouldIntercept(resolved)
 	debugf("readPathAt: path=%q resolved=%q shouldIntercept=%v", path, resolved, shouldIntercept)
 	if !shouldIntercept {
@@ -219,7 +312,7 @@ func (h *SyscallHandler) readPathAtDetailed(dirfd int, pathAddr uintptr) (vfsPat
 	}
 
 	vfsPath = h.tracer.resolver.TranslatePath(resolved)
-	logIntercept(sysno(h.regs), path, resolved, vfsPath)
+	logIntercept(h.proc.entryNr, path, resolved, vfsPath)
 	return vfsPath, true, true
 }
 
@@ -273,7 +366,11 @@ func (h *SyscallHandler) scratchAddrFor(size int, slot int) uintptr {
 	// argument/environment data on large rewritten paths.
 	baseGap := 16 * 1024
 	perSlot := 24 * 1024
-	return uintptr(sp(h.regs)) - uintptr(baseGap) - uintptr(slot*perSlot) - uintptr(alloc)
+	top := uintptr(sp(h.regs)) - uintptr(baseGap)
+	if low := lowScratchTop(h.proc); low != 0 {
+		top = low
+	}
+	return top - uintptr(slot*perSlot) - uintptr(alloc)
 }
 
 func alignUp(n, align int) int {
@@ -289,6 +386,10 @@ func (h *SyscallHandler) handleOpenatEntry() {
 	rawPath, _ := ReadString(h.proc.pid, pathAddr, 4096)
 	debugf("openat: dirfd=%d path=%q flags=0x%x mode=0%o", dirfd, rawPath, flags, mode)
 
+	if h.serveProcFile(dirfd, pathAddr, flags) {
+		return
+	}
+
 	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
 	if !intercept {
 		debugf("openat: not intercepting %q", rawPath)
@@ -297,7 +398,14 @@ func (h *SyscallHandler) handleOpenatEntry() {
 
 	debugf("openat: intercepting %q -> vfs %q", rawPath, vfsPath)
 
-	realPath, err := h.tracer.vfs.ResolveForOpen(vfsPath, vfs.OpenFlags(flags), mode)
+	writeMode := h.deferWriteOpen(vfsPath, flags)
+	if writeMode != 0 {
+		debugf("openat: deferring copy-up of %q", vfsPath)
+		flags = flags&^syscall.O_ACCMODE | syscall.O_RDONLY
+		setArg2(h.regs, uint64(flags))
+	}
+
+	realPath, err := h.resolveForOpen(vfsPath, flags, mode)
 	if err != nil {
 		debugf("openat: ResolveForOpen failed: %v", err)
 		h.skipSyscall(errnoFromError(err))
@@ -313,16 +421,18 @@ func (h *SyscallHandler) handleOpenatEntry() {
 	}
 	h.newPath = newPath
 	setArg1(h.regs, uint64(h.newPath))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 
-	h.isDir = flags&O_DIRECTORY != 0
+	h.isDir = flags&O_DIRECTORY != 0 && flags&O_TMPFILE != O_TMPFILE
 	h.vfsPath = vfsPath
 
-	resolved := h.tracer.resolver.ResolveAt(dirfd, rawPath, h.proc.cwd, h.proc.fdPaths)
+	resolved := h.resolveAt(dirfd, rawPath)
 	h.proc.pendingOpen = &pendingOpen{
-		path:    resolved,
-		isDir:   h.isDir,
-		vfsPath: vfsPath,
+		path:      resolved,
+		isDir:     h.isDir,
+		vfsPath:   vfsPath,
+		realPath:  realPath,
+		writeMode: writeMode,
 	}
 }
 
@@ -334,6 +444,10 @@ func (h *SyscallHandler) handleOpenEntry() {
 	rawPath, _ := ReadString(h.proc.pid, pathAddr, 4096)
 	debugf("open: path=%q flags=0x%x mode=0%o", rawPath, flags, mode)
 
+	if h.serveProcFile(AT_FDCWD, pathAddr, flags) {
+		return
+	}
+
 	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
 	if !intercept {
 		debugf("open: not intercepting %q", rawPath)
@@ -342,7 +456,14 @@ func (h *SyscallHandler) handleOpenEntry() {
 
 	debugf("open: intercepting %q -> vfs %q", rawPath, vfsPath)
 
-	realPath, err := h.tracer.vfs.ResolveForOpen(vfsPath, vfs.OpenFlags(flags), mode)
+	writeMode := h.deferWriteOpen(vfsPath, flags)
+	if writeMode != 0 {
+		debugf("open: deferring copy-up of %q", vfsPath)
+		flags = flags&^syscall.O_ACCMODE | syscall.O_RDONLY
+		setArg1(h.regs, uint64(flags))
+	}
+
+	realPath, err := h.resolveForOpen(vfsPath, flags, mode)
 	if err != nil {
 		debugf("open: ResolveForOpen failed: %v", err)
 		h.skipSyscall(errnoFromError(err))
@@ -358,16 +479,18 @@ func (h *SyscallHandler) handleOpenEntry() {
 	}
 	h.newPath = newPath
 	setArg0(h.regs, uint64(h.newPath))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 
-	h.isDir = flags&O_DIRECTORY != 0
+	h.isDir = flags&O_DIRECTORY != 0 && flags&O_TMPFILE != O_TMPFILE
 	h.vfsPath = vfsPath
 
-	resolved := h.tracer.resolver.ResolveAt(AT_FDCWD, rawPath, h.proc.cwd, h.proc.fdPaths)
+	resolved := h.resolvePath(rawPath)
 	h.proc.pendingOpen = &pendingOpen{
-		path:    resolved,
-		isDir:   h.isDir,
-		vfsPath: vfsPath,
+		path:      resolved,
+		isDir:     h.isDir,
+		vfsPath:   vfsPath,
+		realPath:  realPath,
+		writeMode: writeMode,
 	}
 }
 
@@ -403,16 +526,17 @@ func (h *SyscallHandler) handleCreatEntry() {
 	}
 	h.newPath = newPath
 	setArg0(h.regs, uint64(h.newPath))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 
 	h.isDir = false
 	h.vfsPath = vfsPath
 
-	resolved := h.tracer.resolver.ResolveAt(AT_FDCWD, rawPath, h.proc.cwd, h.proc.fdPaths)
+	resolved := h.resolvePath(rawPath)
 	h.proc.pendingOpen = &pendingOpen{
-		path:    resolved,
-		isDir:   h.isDir,
-		vfsPath: vfsPath,
+		path:     resolved,
+		isDir:    h.isDir,
+		vfsPath:  vfsPath,
+		realPath: realPath,
 	}
 }
 
@@ -433,6 +557,13 @@ func (h *SyscallHandler) handleOpenatExit() {
 	debugf("openat exit: fd=%d path=%q isDir=%v", fd, pending.path, pending.isDir)
 
 	h.proc.fdPaths[fd] = pending.path
+	h.proc.fdReal[fd] = pending.realPath
+	if pending.writeMode != 0 {
+		if h.proc.fdWriteMode == nil {
+			h.proc.fdWriteMode = make(map[int]int)
+		}
+		h.proc.fdWriteMode[fd] = pending.writeMode
+	}
 
 	if pending.isDir {
 		h.tracer.fdTable.TrackDir(fd, pending.vfsPath)
@@ -445,85 +576,31 @@ func (h *SyscallHandler) handleCloseEntry() {
 
 	h.tracer.fdTable.Close(fd)
 	delete(h.proc.fdPaths, fd)
+	delete(h.proc.fdReal, fd)
+	delete(h.proc.fdWriteMode, fd)
+	delete(h.proc.inotify, fd)
+	delete(h.proc.fanotify, fd)
+	delete(h.proc.splicedDirs, fd)
+	delete(h.proc.mountFds, fd)
 }
 
-func (h *SyscallHandler) handleStatEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.ResolveForStat(vfsPath, true)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleLstatEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.ResolveForStat(vfsPath, false)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleNewfstatatEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-	flags := int(arg3(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
-		return
-	}
-
-	followSymlinks := flags&AT_SYMLINK_NOFOLLOW == 0
-	realPath, err := h.tracer.vfs.ResolveForStat(vfsPath, followSymlinks)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
+// direntFormat is the record layout a getdents call fills.
+type direntFormat int
 
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
+const (
+	dirent64     direntFormat = iota
+	direntLegacy              // linux_dirent
+	direntCompat              // linux_dirent of a 32-bit tracee
+)
 
-func (h *SyscallHandler) handleGetdents64Entry() {
+func (h *SyscallHandler) handleGetdentsEntry(format direntFormat) {
 	fd := int(arg0(h.regs))
 	bufAddr := uintptr(arg1(h.regs))
 	count := int(arg2(h.regs))
 
 	vfsPath, ok := h.tracer.fdTable.GetDir(fd)
 	if !ok {
+		h.handleMountParentGetdentsEntry(fd, bufAddr, count, format)
 		return
 	}
 
@@ -534,10 +611,11 @@ func (h *SyscallHandler) handleGetdents64Entry() {
 		bufAddr: bufAddr,
 		count:   count,
 		vfsPath: vfsPath,
+		format:  format,
 	}
 }
 
-func (h *SyscallHandler) handleGetdents64Exit() {
+func (h *SyscallHandler) handleGetdentsExit() {
 	if h.proc.pendingGetdents == nil {
 		return
 	}
@@ -549,7 +627,7 @@ func (h *SyscallHandler) handleGetdents64Exit() {
 	if err != nil {
 		debugf("getdents64 exit: ReadDir(%q) error: %v", pending.vfsPath, err)
 		setRetval(h.regs, uint64(errnoFromError(err)))
-		syscall.PtraceSetRegs(h.proc.pid, h.regs)
+		ptraceSetRegs(h.proc.pid, h.regs)
 		return
 	}
 
@@ -559,7 +637,7 @@ func (h *SyscallHandler) handleGetdents64Exit() {
 	if pos >= len(entries) {
 		debugf("getdents64 exit: pos=%d >= len=%d, returning 0", pos, len(entries))
 		setRetval(h.regs, 0)
-		syscall.PtraceSetRegs(h.proc.pid, h.regs)
+		ptraceSetRegs(h.proc.pid, h.regs)
 		return
 	}
 
@@ -570,19 +648,13 @@ func (h *SyscallHandler) handleGetdents64Exit() {
 	streamOff := int64(0)
 	for i := pos; i < len(entries) && offset < pending.count; i++ {
 		entry := &entries[i]
-		reclen := (19 + len(entry.Name) + 1 + 7) & ^7
-
+		reclen := direntLen(entry.Name, pending.format)
 		if offset+reclen > pending.count {
 			break
 		}
 
-		binary.LittleEndian.PutUint64(buf[offset:], entry.Ino)
 		streamOff += int64(reclen)
-		binary.LittleEndian.PutUint64(buf[offset+8:], uint64(streamOff))
-		binary.LittleEndian.PutUint16(buf[offset+16:], uint16(reclen))
-		buf[offset+18] = entry.Type
-		copy(buf[offset+19:], entry.Name)
-		buf[offset+19+len(entry.Name)] = 0
+		putDirent(buf[offset:], entry.Ino, streamOff, entry.Type, entry.Name, pending.format)
 
 		offset += reclen
 		entriesRead++
@@ -592,7 +664,7 @@ func (h *SyscallHandler) handleGetdents64Exit() {
 		if err := WriteBytes(h.proc.pid, pending.bufAddr, buf[:offset]); err != nil {
 			debugf("getdents64 exit: WriteBytes failed: %v", err)
 			setRetval(h.regs, uint64(errnoFromError(syscall.EIO)))
-			syscall.PtraceSetRegs(h.proc.pid, h.regs)
+			ptraceSetRegs(h.proc.pid, h.regs)
 			return
 		}
 	}
@@ -600,53 +672,46 @@ func (h *SyscallHandler) handleGetdents64Exit() {
 	h.tracer.fdTable.SetDirPos(pending.fd, pos+entriesRead)
 	debugf("getdents64 exit: wrote %d entries, %d bytes", entriesRead, offset)
 	setRetval(h.regs, uint64(int64(offset)))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 }
 
-func (h *SyscallHandler) handleMkdiratEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareCreate(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
+// direntLen returns the record length of name in a getdents buffer.
+func direntLen(name string, format direntFormat) int {
+	switch format {
+	case direntLegacy:
+		return (18 + len(name) + 2 + 7) & ^7
+	case direntCompat:
+		return (10 + len(name) + 2 + 3) & ^3
 	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	return (19 + len(name) + 1 + 7) & ^7
 }
 
-func (h *SyscallHandler) handleMkdirEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareCreate(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
+// putDirent encodes a directory entry at the start of buf. The legacy
+// linux_dirent keeps d_type in the record's last byte; a 32-bit one has
+// 32-bit d_ino and d_off.
+func putDirent(buf []byte, ino uint64, off int64, typ uint8, name string, format direntFormat) {
+	reclen := direntLen(name, format)
+	if format == direntCompat {
+		binary.LittleEndian.PutUint32(buf, uint32(ino))
+		binary.LittleEndian.PutUint32(buf[4:], uint32(min(off, math.MaxInt32)))
+		binary.LittleEndian.PutUint16(buf[8:], uint16(reclen))
+		copy(buf[10:], name)
+		buf[10+len(name)] = 0
+		buf[reclen-1] = typ
 		return
 	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
+	binary.LittleEndian.PutUint64(buf, ino)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(off))
+	binary.LittleEndian.PutUint16(buf[16:], uint16(reclen))
+	if format == direntLegacy {
+		copy(buf[18:], name)
+		buf[18+len(name)] = 0
+		buf[reclen-1] = typ
+	} else {
+		buf[18] = typ
+		copy(buf[19:], name)
+		buf[19+len(name)] = 0
 	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
 }
 
 func (h *SyscallHandler) handleUnlinkEntry() {
@@ -690,7 +755,7 @@ func (h *SyscallHandler) handleUnlinkEntry() {
 		return
 	}
 	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 	h.proc.pendingRemove = &pendingRemove{
 		vfsPath:       vfsPath,
 		isDir:         false,
@@ -743,7 +808,7 @@ func (h *SyscallHandler) handleRmdirEntry() {
 		return
 	}
 	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 	h.proc.pendingRemove = &pendingRemove{
 		vfsPath:       vfsPath,
 		isDir:         true,
@@ -805,7 +870,7 @@ func (h *SyscallHandler) handleUnlinkatEntry() {
 	}
 	setArg0(h.regs, AT_FDCWD_U64)
 	setArg1(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 	h.proc.pendingRemove = &pendingRemove{
 		vfsPath:       vfsPath,
 		isDir:         isDir,
@@ -813,7 +878,7 @@ func (h *SyscallHandler) handleUnlinkatEntry() {
 	}
 }
 
-func (h *SyscallHandler) handleRenameatEntry() {
+func (h *SyscallHandler) handleRenameatEntry(flags uint) {
 	oldDirfd := int(int32(arg0(h.regs)))
 	oldPathAddr := uintptr(arg1(h.regs))
 	newDirfd := int(int32(arg2(h.regs)))
@@ -840,7 +905,16 @@ func (h *SyscallHandler) handleRenameatEntry() {
 		return
 	}
 
-	oldReal, newReal, err := h.tracer.vfs.PrepareRename(oldVfsPath, newVfsPath)
+	planner, planned := h.tracer.vfs.(renamePlanner)
+	planned = planned && flags != 0
+
+	var oldReal, newReal string
+	var err error
+	if planned {
+		oldReal, newReal, err = planner.PlanRename(oldVfsPath, newVfsPath, flags)
+	} else {
+		oldReal, newReal, err = h.tracer.vfs.PrepareRename(oldVfsPath, newVfsPath)
+	}
 	if err != nil {
 		h.skipSyscall(errnoFromError(err))
 		return
@@ -859,7 +933,35 @@ func (h *SyscallHandler) handleRenameatEntry() {
 	setArg1(h.regs, uint64(oldAddr))
 	setArg2(h.regs, AT_FDCWD_U64)
 	setArg3(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	if planned {
+		// The whiteout is created in the overlay's own style at exit.
+		setArg4(h.regs, uint64(flags&^RENAME_WHITEOUT))
+		h.proc.pendingRename = &pendingRename{
+			oldVfsPath: oldVfsPath,
+			newVfsPath: newVfsPath,
+			flags:      flags,
+		}
+	}
+	ptraceSetRegs(h.proc.pid, h.regs)
+}
+
+func (h *SyscallHandler) handleRenameExit() {
+	if h.proc.pendingRename == nil {
+		return
+	}
+
+	pending := h.proc.pendingRename
+	h.proc.pendingRename = nil
+
+	if int64(retval(h.regs)) < 0 {
+		return
+	}
+
+	planner := h.tracer.vfs.(renamePlanner)
+	if err := planner.FinalizeRename(pending.oldVfsPath, pending.newVfsPath, pending.flags); err != nil {
+		setRetval(h.regs, uint64(errnoFromError(err)))
+		ptraceSetRegs(h.proc.pid, h.regs)
+	}
 }
 
 func (h *SyscallHandler) handleRenameEntry() {
@@ -904,7 +1006,7 @@ func (h *SyscallHandler) handleRenameEntry() {
 
 	setArg0(h.regs, uint64(oldAddr))
 	setArg1(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 }
 
 func (h *SyscallHandler) handleLinkEntry() {
@@ -944,7 +1046,7 @@ func (h *SyscallHandler) handleLinkEntry() {
 
 	setArg0(h.regs, uint64(oldAddr))
 	setArg1(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 }
 
 func (h *SyscallHandler) handleLinkatEntry() {
@@ -952,6 +1054,11 @@ func (h *SyscallHandler) handleLinkatEntry() {
 	oldPathAddr := uintptr(arg1(h.regs))
 	newDirfd := int(int32(arg2(h.regs)))
 	newPathAddr := uintptr(arg3(h.regs))
+	flags := int(arg4(h.regs))
+
+	if h.handleLinkFdEntry(oldDirfd, oldPathAddr, newDirfd, newPathAddr, flags) {
+		return
+	}
 
 	oldVfsPath, oldIntercept, oldReadable := h.readPathAtDetailed(oldDirfd, oldPathAddr)
 	newVfsPath, newIntercept, newReadable := h.readPathAtDetailed(newDirfd, newPathAddr)
@@ -988,432 +1095,177 @@ func (h *SyscallHandler) handleLinkatEntry() {
 	setArg1(h.regs, uint64(oldAddr))
 	setArg2(h.regs, AT_FDCWD_U64)
 	setArg3(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 }
 
-func (h *SyscallHandler) handleSymlinkatEntry() {
-	targetAddr := uintptr(arg0(h.regs))
-	newDirfd := int(int32(arg1(h.regs)))
-	linkpathAddr := uintptr(arg2(h.regs))
+func (h *SyscallHandler) handleXattrPathEntry(op xattrOp, followSymlinks bool) {
+	pathAddr := uintptr(arg0(h.regs))
 
-	vfsPath, intercept := h.readPathAt(newDirfd, linkpathAddr)
+	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
 	if !intercept {
 		return
 	}
 
-	realPath, err := h.tracer.vfs.PrepareSymlink(vfsPath)
+	if op != xattrList && h.hiddenXattr(uintptr(arg1(h.regs))) {
+		h.skipSyscall(negErrno(syscall.EOPNOTSUPP))
+		return
+	}
+
+	var realPath string
+	var err error
+	if op == xattrSet || op == xattrRemove {
+		realPath, err = h.tracer.vfs.PrepareXattr(vfsPath)
+	} else {
+		realPath, err = h.tracer.vfs.ResolveForStat(vfsPath, followSymlinks)
+	}
 	if err != nil {
 		h.skipSyscall(errnoFromError(err))
 		return
 	}
 
-	newAddr, err := h.rewritePath(linkpathAddr, realPath)
+	if op == xattrList {
+		h.proc.pendingXattrList = &pendingXattrList{bufAddr: uintptr(arg1(h.regs)), size: arg2(h.regs)}
+	}
+
+	newAddr, err := h.rewritePath(pathAddr, realPath)
 	if err != nil {
 		return
 	}
-	setArg1(h.regs, AT_FDCWD_U64)
-	setArg2(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-	_ = targetAddr
+	setArg0(h.regs, uint64(newAddr))
+	ptraceSetRegs(h.proc.pid, h.regs)
 }
 
-func (h *SyscallHandler) handleSymlinkEntry() {
-	targetAddr := uintptr(arg0(h.regs))
-	linkpathAddr := uintptr(arg1(h.regs))
+func (h *SyscallHandler) handleXattrFdEntry(op xattrOp) {
+	fd := int(int32(arg0(h.regs)))
 
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, linkpathAddr)
-	if !intercept {
+	path, ok := h.proc.fdPaths[fd]
+	if !ok || !h.tracer.resolver.ShouldIntercept(path) {
 		return
 	}
 
-	realPath, err := h.tracer.vfs.PrepareSymlink(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
+	if op != xattrList && h.hiddenXattr(uintptr(arg1(h.regs))) {
+		h.skipSyscall(negErrno(syscall.EOPNOTSUPP))
 		return
 	}
 
-	newAddr, err := h.rewritePath(linkpathAddr, realPath)
-	if err != nil {
+	switch op {
+	case xattrGet:
+		return
+	case xattrList:
+		h.proc.pendingXattrList = &pendingXattrList{bufAddr: uintptr(arg1(h.regs)), size: arg2(h.regs)}
 		return
 	}
-	setArg1(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-	_ = targetAddr
+
+	h.handleFdMutationEntry(fd)
 }
 
-func (h *SyscallHandler) handleExecveEntry() {
-	pathAddr := uintptr(arg0(h.regs))
+func (h *SyscallHandler) hiddenXattr(nameAddr uintptr) bool {
+	hider, ok := h.tracer.vfs.(xattrHider)
+	if !ok {
+		return false
+	}
+	name, err := ReadString(h.proc.pid, nameAddr, 256)
+	return err == nil && hider.HiddenXattr(name)
+}
 
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		rawPath, err := ReadString(h.proc.pid, pathAddr, 4096)
-		if err != nil {
-			debugf("execve: ReadString failed: pid=%d addr=%x err=%v", h.proc.pid, pathAddr, err)
-		} else {
-			debugf("execve: not intercepting path %q", rawPath)
-		}
+// handleXattrListExit drops the filesystem's private names from a list
+// returned by listxattr and friends.
+func (h *SyscallHandler) handleXattrListExit() {
+	pending := h.proc.pendingXattrList
+	h.proc.pendingXattrList = nil
+	// A size of 0 only asks how large the list is: nothing was written.
+	if pending == nil || pending.bufAddr == 0 || pending.size == 0 {
 		return
 	}
-
-	debugf("execve: intercepting vfs path %q", vfsPath)
-
-	realPath, err := h.tracer.vfs.ResolvePath(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
+	hider, ok := h.tracer.vfs.(xattrHider)
+	if !ok {
 		return
 	}
 
-	debugf("execve: resolved to real path %q", realPath)
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
+	n := int64(retval(h.regs))
+	if n <= 0 || uint64(n) > pending.size {
 		return
 	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleExecveatEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
+	buf := make([]byte, n)
+	if read, err := ReadBytes(h.proc.pid, pending.bufAddr, buf); err != nil || read < len(buf) {
 		return
 	}
 
-	debugf("execveat: intercepting vfs path %q", vfsPath)
-
-	realPath, err := h.tracer.vfs.ResolvePath(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
+	filtered := make([]byte, 0, len(buf))
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) == 0 || hider.HiddenXattr(string(name)) {
+			continue
+		}
+		filtered = append(append(filtered, name...), 0)
+	}
+	if len(filtered) == len(buf) {
 		return
 	}
 
-	debugf("execveat: resolved to real path %q", realPath)
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
+	debugf("listxattr: hid %d bytes of private names", len(buf)-len(filtered))
+	if err := WriteBytes(h.proc.pid, pending.bufAddr, filtered); err != nil {
 		return
 	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	setRetval(h.regs, uint64(len(filtered)))
+	ptraceSetRegs(h.proc.pid, h.regs)
 }
 
-func (h *SyscallHandler) handleReadlinkatEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
+func (h *SyscallHandler) handleDupEntry() {
+	h.proc.pendingDup = &pendingDup{
+		oldfd: int(arg0(h.regs)),
+		newfd: -1,
+	}
+}
 
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
+func (h *SyscallHandler) handleDupExit() {
+	if h.proc.pendingDup == nil {
 		return
 	}
 
-	realPath, err := h.tracer.vfs.ResolvePath(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
+	pending := h.proc.pendingDup
+	h.proc.pendingDup = nil
+
+	newfd := int(int64(retval(h.regs)))
+	if newfd < 0 {
 		return
 	}
 
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
+	h.tracer.fdTable.Dup(pending.oldfd, newfd)
+	if path, ok := h.proc.fdPaths[pending.oldfd]; ok {
+		h.proc.fdPaths[newfd] = path
+	}
+	if real, ok := h.proc.fdReal[pending.oldfd]; ok {
+		h.proc.fdReal[newfd] = real
+	}
+	if mode, ok := h.proc.fdWriteMode[pending.oldfd]; ok {
+		h.proc.fdWriteMode[newfd] = mode
 	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
 }
 
-func (h *SyscallHandler) handleReadlinkEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
+// handleGetflExit reports the access mode a write-open asked for on an fd
+// still read-only pending a deferred copy-up.
+func (h *SyscallHandler) handleGetflExit() {
+	if h.proc.entryArgs[1] != F_GETFL {
 		return
 	}
-
-	realPath, err := h.tracer.vfs.ResolvePath(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
+	mode, ok := h.proc.fdWriteMode[int(int32(h.proc.entryArgs[0]))]
+	ret := int64(retval(h.regs))
+	if !ok || ret < 0 {
 		return
 	}
+	setRetval(h.regs, uint64(ret&^syscall.O_ACCMODE|int64(mode)))
+	ptraceSetRegs(h.proc.pid, h.regs)
+}
 
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
+func (h *SyscallHandler) handleDup2Entry() {
+	h.proc.pendingDup = &pendingDup{
+		oldfd: int(arg0(h.regs)),
+		newfd: int(arg1(h.regs)),
 	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
 }
 
-func (h *SyscallHandler) handleFchmodatEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleChmodEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleFchownatEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleChownEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleLchownEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleFaccessat2Entry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.ResolvePath(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleFaccessatEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.ResolvePath(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleStatfsEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.ResolveForStat(vfsPath, true)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleStatxEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-	flags := int(arg2(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
-		return
-	}
-
-	followSymlinks := flags&AT_SYMLINK_NOFOLLOW == 0
-	realPath, err := h.tracer.vfs.ResolveForStat(vfsPath, followSymlinks)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleXattrPathEntry(followSymlinks bool) {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.ResolveForStat(vfsPath, followSymlinks)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleDupEntry() {
-	h.proc.pendingDup = &pendingDup{
-		oldfd: int(arg0(h.regs)),
-		newfd: -1,
-	}
-}
-
-func (h *SyscallHandler) handleDupExit() {
-	if h.proc.pendingDup == nil {
-		return
-	}
-
-	pending := h.proc.pendingDup
-	h.proc.pendingDup = nil
-
-	newfd := int(int64(retval(h.regs)))
-	if newfd < 0 {
-		return
-	}
-
-	h.tracer.fdTable.Dup(pending.oldfd, newfd)
-	if path, ok := h.proc.fdPaths[pending.oldfd]; ok {
-		h.proc.fdPaths[newfd] = path
-	}
-}
-
-func (h *SyscallHandler) handleDup2Entry() {
-	h.proc.pendingDup = &pendingDup{
-		oldfd: int(arg0(h.regs)),
-		newfd: int(arg1(h.regs)),
-	}
-}
-
-func (h *SyscallHandler) handleDup2Exit() {
-	if h.proc.pendingDup == nil {
+func (h *SyscallHandler) handleDup2Exit() {
+	if h.proc.pendingDup == nil {
 		return
 	}
 
@@ -1427,9 +1279,17 @@ func (h *SyscallHandler) handleDup2Exit() {
 
 	h.tracer.fdTable.Close(pending.newfd)
 	h.tracer.fdTable.Dup(pending.oldfd, pending.newfd)
+	delete(h.proc.fdReal, pending.newfd)
+	delete(h.proc.fdWriteMode, pending.newfd)
 	if path, ok := h.proc.fdPaths[pending.oldfd]; ok {
 		h.proc.fdPaths[pending.newfd] = path
 	}
+	if real, ok := h.proc.fdReal[pending.oldfd]; ok {
+		h.proc.fdReal[pending.newfd] = real
+	}
+	if mode, ok := h.proc.fdWriteMode[pending.oldfd]; ok {
+		h.proc.fdWriteMode[pending.newfd] = mode
+	}
 }
 
 func (h *SyscallHandler) handleFcntlEntry() {
@@ -1452,7 +1312,7 @@ func (h *SyscallHandler) handleChdirEntry() {
 		return
 	}
 
-	resolved := h.tracer.resolver.ResolvePath(h.proc.cwd, path)
+	resolved := h.resolvePath(path)
 	h.proc.pendingChdir = &pendingChdir{path: resolved}
 
 	if !h.tracer.resolver.ShouldIntercept(resolved) {
@@ -1471,7 +1331,7 @@ func (h *SyscallHandler) handleChdirEntry() {
 		return
 	}
 	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
+	ptraceSetRegs(h.proc.pid, h.regs)
 }
 
 func (h *SyscallHandler) handleChdirExit() {
@@ -1537,7 +1397,7 @@ func (h *SyscallHandler) handleGetcwdEntry() {
 		return
 	}
 
-	cwd := h.proc.cwd
+	cwd := rootedPath(h.proc.root, h.proc.cwd)
 	if cwd == "" {
 		cwd = "/"
 	}
@@ -1576,190 +1436,8 @@ func (h *SyscallHandler) handleRemoveExit() {
 
 	if err := planner.FinalizeRemove(pending.vfsPath, pending.isDir); err != nil {
 		setRetval(h.regs, uint64(errnoFromError(err)))
-		syscall.PtraceSetRegs(h.proc.pid, h.regs)
-	}
-}
-
-func (h *SyscallHandler) handleAccessEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.ResolvePath(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleMknodEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareCreate(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleMknodatEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareCreate(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, AT_FDCWD_U64)
-	setArg1(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleTruncateEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleUtimeEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleUtimesEntry() {
-	pathAddr := uintptr(arg0(h.regs))
-
-	vfsPath, intercept := h.readPathAt(AT_FDCWD, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
+		ptraceSetRegs(h.proc.pid, h.regs)
 	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg0(h.regs, uint64(newAddr))
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleFutimesatEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
-}
-
-func (h *SyscallHandler) handleUtimensatEntry() {
-	dirfd := int(int32(arg0(h.regs)))
-	pathAddr := uintptr(arg1(h.regs))
-
-	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
-	if !intercept {
-		return
-	}
-
-	realPath, err := h.tracer.vfs.PrepareWrite(vfsPath)
-	if err != nil {
-		h.skipSyscall(errnoFromError(err))
-		return
-	}
-
-	newAddr, err := h.rewritePath(pathAddr, realPath)
-	if err != nil {
-		return
-	}
-	setArg1(h.regs, uint64(newAddr))
-	setArg0(h.regs, AT_FDCWD_U64)
-	syscall.PtraceSetRegs(h.proc.pid, h.regs)
 }
 
 func errnoFromError(err error) int64 {
@@ -0,0 +1,105 @@
+package tracer
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// PTRACE_O_EXITKILL makes the kernel SIGKILL every tracee if fuss dies, so
+// they are never left stopped with nobody to continue them.
+const PTRACE_O_EXITKILL = 0x100000
+
+// WaitPolicy decides what happens to remaining descendants once the main
+// child has exited.
+type WaitPolicy int
+
+const (
+	// WaitAll keeps tracing until every descendant has exited.
+	WaitAll WaitPolicy = iota
+	// WaitMain returns as soon as the main child exits; descendants are
+	// detached and keep running outside the overlay.
+	WaitMain
+	// WaitKill kills all remaining descendants when the main child exits.
+	WaitKill
+)
+
+func ParseWaitPolicy(s string) (WaitPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "all":
+		return WaitAll, nil
+	case "main":
+		return WaitMain, nil
+	case "kill":
+		return WaitKill, nil
+	default:
+		return WaitAll, fmt.Errorf("unknown wait policy: %s", s)
+	}
+}
+
+func (t *Tracer) SetWaitPolicy(p WaitPolicy) {
+	t.waitPolicy = p
+}
+
+func (t *Tracer) ptraceOptions() int {
+	opts := PTRACE_O_TRACESYSGOOD | PTRACE_O_TRACECLONE | PTRACE_O_TRACEFORK | PTRACE_O_TRACEVFORK | PTRACE_O_TRACEEXEC
+	if t.followStops {
+		opts |= PTRACE_O_EXITKILL
+	}
+	return opts
+}
+
+// forwardSignals relays termination signals received by fuss to the child's
+// process group until the returned function is called.
+func forwardSignals(pgid int) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	go func() {
+		for sig := range sigs {
+			debugf("forwarding %v to process group %d", sig, pgid)
+			syscall.Kill(-pgid, sig.(syscall.Signal))
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}
+}
+
+// mainExited applies the wait policy after the main child is gone. It returns
+// true when the trace loop should stop.
+func (t *Tracer) mainExited(pid int, ws syscall.WaitStatus) (bool, error) {
+	switch t.waitPolicy {
+	case WaitMain:
+		if len(t.procs) > 0 {
+			debugf("main child exited, detaching %d remaining tracees", len(t.procs))
+			if err := t.detachAll(pid, ws, false); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	case WaitKill:
+		debugf("main child exited, killing %d remaining tracees", len(t.procs))
+		t.killing = true
+		for other := range t.procs {
+			syscall.Kill(other, syscall.SIGKILL)
+		}
+	}
+	return false, nil
+}
+
+// isForeground reports whether fuss owns the terminal on stdin.
+func isForeground() bool {
+	pgrp, err := unix.IoctlGetInt(0, unix.TIOCGPGRP)
+	return err == nil && pgrp == syscall.Getpgrp()
+}
+
+func setForeground(pgid int) {
+	if err := unix.IoctlSetPointerInt(0, unix.TIOCSPGRP, pgid); err != nil {
+		debugf("tcsetpgrp(%d) failed: %v", pgid, err)
+	}
+}
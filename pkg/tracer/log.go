@@ -63,112 +63,3 @@ func logIntercept(sysno uint64, path string, resolved string, vfsPath string) {
 		"vfs", vfsPath,
 	)
 }
-
-func syscallName(sysno uint64) string {
-	switch sysno {
-	case SYS_OPEN:
-		return "open"
-	case SYS_OPENAT:
-		return "openat"
-	case SYS_CLOSE:
-		return "close"
-	case SYS_STAT:
-		return "stat"
-	case SYS_LSTAT:
-		return "lstat"
-	case SYS_ACCESS:
-		return "access"
-	case SYS_NEWFSTATAT:
-		return "newfstatat"
-	case SYS_GETDENTS64:
-		return "getdents64"
-	case SYS_MKDIRAT:
-		return "mkdirat"
-	case SYS_MKDIR:
-		return "mkdir"
-	case SYS_CREAT:
-		return "creat"
-	case SYS_TRUNCATE:
-		return "truncate"
-	case SYS_LINK:
-		return "link"
-	case SYS_SYMLINK:
-		return "symlink"
-	case SYS_CHMOD:
-		return "chmod"
-	case SYS_CHOWN:
-		return "chown"
-	case SYS_LCHOWN:
-		return "lchown"
-	case SYS_UNLINK:
-		return "unlink"
-	case SYS_RMDIR:
-		return "rmdir"
-	case SYS_UNLINKAT:
-		return "unlinkat"
-	case SYS_RENAME:
-		return "rename"
-	case SYS_RENAMEAT:
-		return "renameat"
-	case SYS_RENAMEAT2:
-		return "renameat2"
-	case SYS_LINKAT:
-		return "linkat"
-	case SYS_SYMLINKAT:
-		return "symlinkat"
-	case SYS_READLINK:
-		return "readlink"
-	case SYS_READLINKAT:
-		return "readlinkat"
-	case SYS_FCHMODAT:
-		return "fchmodat"
-	case SYS_FCHOWNAT:
-		return "fchownat"
-	case SYS_FACCESSAT:
-		return "faccessat"
-	case SYS_FACCESSAT2:
-		return "faccessat2"
-	case SYS_UTIME:
-		return "utime"
-	case SYS_UTIMES:
-		return "utimes"
-	case SYS_FUTIMESAT:
-		return "futimesat"
-	case SYS_UTIMENSAT:
-		return "utimensat"
-	case SYS_MKNOD:
-		return "mknod"
-	case SYS_GETXATTR:
-		return "getxattr"
-	case SYS_LGETXATTR:
-		return "lgetxattr"
-	case SYS_LISTXATTR:
-		return "listxattr"
-	case SYS_LLISTXATTR:
-		return "llistxattr"
-	case SYS_STATFS:
-		return "statfs"
-	case SYS_STATX:
-		return "statx"
-	case SYS_DUP:
-		return "dup"
-	case SYS_DUP2:
-		return "dup2"
-	case SYS_DUP3:
-		return "dup3"
-	case SYS_FCNTL:
-		return "fcntl"
-	case SYS_EXECVE:
-		return "execve"
-	case SYS_EXECVEAT:
-		return "execveat"
-	case SYS_GETCWD:
-		return "getcwd"
-	case SYS_CHDIR:
-		return "chdir"
-	case SYS_FCHDIR:
-		return "fchdir"
-	default:
-		return fmt.Sprintf("sys_%d", sysno)
-	}
-}
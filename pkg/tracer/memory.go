@@ -1,6 +1,7 @@
 package tracer
 
 import (
+	"encoding/binary"
 	"syscall"
 	"unsafe"
 )
@@ -131,3 +132,34 @@ func WriteBytes(pid int, addr uintptr, data []byte) error {
 func WriteString(pid int, addr uintptr, s string) error {
 	return WriteBytes(pid, addr, append([]byte(s), 0))
 }
+
+// wordSize returns the size of a pointer or long in the tracee's ABI.
+func wordSize(regs *syscall.PtraceRegs) int {
+	if isCompat(regs) {
+		return 4
+	}
+	return 8
+}
+
+// getUint decodes the little-endian integer that fills buf.
+func getUint(buf []byte) uint64 {
+	switch len(buf) {
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(buf))
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(buf))
+	}
+	return binary.LittleEndian.Uint64(buf)
+}
+
+// putUint encodes v into all of buf.
+func putUint(buf []byte, v uint64) {
+	switch len(buf) {
+	case 2:
+		binary.LittleEndian.PutUint16(buf, uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(buf, uint32(v))
+	default:
+		binary.LittleEndian.PutUint64(buf, v)
+	}
+}
@@ -0,0 +1,126 @@
+package tracer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// A shared mapping writes straight through to the file it maps, so one of a
+// lower-layer file would modify the lower layer. fuss never lets one become
+// writable: a shared mapping of an fd open for writing copies the file up
+// and swaps the fd first, and mprotect adding PROT_WRITE to a shared mapping
+// that still refers to a lower layer fails with EACCES.
+
+const (
+	PROT_WRITE    = 0x2
+	MAP_SHARED    = 0x1
+	MAP_ANONYMOUS = 0x20
+)
+
+// lowerChecker is implemented by filesystems with read-only layers.
+type lowerChecker interface {
+	InLowerLayer(realPath string) bool
+}
+
+func (h *SyscallHandler) handleMmapEntry() {
+	prot := int(arg2(h.regs))
+	flags := int(arg3(h.regs))
+	if flags&MAP_SHARED == 0 || flags&MAP_ANONYMOUS != 0 {
+		return
+	}
+	fd := int(int32(arg4(h.regs)))
+
+	if _, ok := h.proc.fdWriteMode[fd]; ok {
+		// Opened read-only with the copy-up deferred: only a writable mapping
+		// needs the file up, a read-only one can never be upgraded.
+		if prot&PROT_WRITE != 0 {
+			h.handleFdMutationEntry(fd)
+		}
+		return
+	}
+	// Even a read-only shared mapping of a writable fd can be made writable
+	// later with mprotect.
+	if h.writableOnLower(fd) {
+		h.handleFdMutationEntry(fd)
+	}
+}
+
+// writableOnLower reports whether fd is open for writing on a lower-layer
+// file, something only fds fuss did not open itself can be.
+func (h *SyscallHandler) writableOnLower(fd int) bool {
+	checker, ok := h.tracer.vfs.(lowerChecker)
+	if !ok {
+		return false
+	}
+	path, ok := h.proc.fdPaths[fd]
+	if !ok || !h.tracer.resolver.ShouldIntercept(path) {
+		return false
+	}
+	realPath, ok := h.fdRealPath(fd)
+	if !ok || !checker.InLowerLayer(realPath) {
+		return false
+	}
+	flags, _, err := fdInfo(h.proc.pid, fd)
+	return err == nil && flags&syscall.O_ACCMODE != syscall.O_RDONLY
+}
+
+func (h *SyscallHandler) handleMprotectEntry() {
+	addr := arg0(h.regs)
+	length := arg1(h.regs)
+	prot := int(arg2(h.regs))
+	if prot&PROT_WRITE == 0 || length == 0 {
+		return
+	}
+	checker, ok := h.tracer.vfs.(lowerChecker)
+	if !ok {
+		return
+	}
+
+	path, err := sharedMappingIn(h.proc.pid, addr, addr+length, checker)
+	if err != nil {
+		debugf("mprotect: reading mappings failed: %v", err)
+		return
+	}
+	if path != "" {
+		debugf("mprotect: refusing PROT_WRITE on shared mapping of lower file %q", path)
+		h.skipSyscall(negErrno(syscall.EACCES))
+	}
+}
+
+// sharedMappingIn returns the lower-layer file behind a shared mapping that
+// overlaps [start, end) in pid's address space, or "" if there is none.
+func sharedMappingIn(pid int, start, end uint64, checker lowerChecker) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// start-end perms offset dev inode path
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasSuffix(fields[1], "s") {
+			continue
+		}
+		lo, hi, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			continue
+		}
+		mapStart, err1 := strconv.ParseUint(lo, 16, 64)
+		mapEnd, err2 := strconv.ParseUint(hi, 16, 64)
+		if err1 != nil || err2 != nil || mapEnd <= start || mapStart >= end {
+			continue
+		}
+		path := strings.TrimSuffix(strings.Join(fields[5:], " "), " (deleted)")
+		if filepath.IsAbs(path) && checker.InLowerLayer(path) {
+			return path, nil
+		}
+	}
+	return "", scanner.Err()
+}
@@ -0,0 +1,586 @@
+package tracer
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mounting needs CAP_SYS_ADMIN, so bind mounts and tmpfs mounts made by
+// tracees are emulated in a mount table of the session. A bind mount of a
+// path under the mountpoint is followed by path resolution wherever its
+// target is. A host directory, the temporary directory backing a tmpfs, or
+// the host's own proc, sysfs or devpts can only be mounted onto a path under
+// the mountpoint, where the VFS shows it. Anything else is left to the
+// kernel. Emulated mounts are always writable: asking for a read-only one
+// fails with EPERM.
+
+const (
+	MS_RDONLY     = 0x1
+	MS_REMOUNT    = 0x20
+	MS_BIND       = 0x1000
+	MS_MOVE       = 0x2000
+	MS_UNBINDABLE = 0x20000
+	MS_PRIVATE    = 0x40000
+	MS_SLAVE      = 0x80000
+	MS_SHARED     = 0x100000
+
+	OPEN_TREE_CLONE         = 0x1
+	FSOPEN_CLOEXEC          = 0x1
+	FSMOUNT_CLOEXEC         = 0x1
+	MOVE_MOUNT_F_EMPTY_PATH = 0x4
+	MOVE_MOUNT_T_EMPTY_PATH = 0x40
+
+	FSCONFIG_SET_FLAG   = 0
+	FSCONFIG_SET_STRING = 1
+	MFD_CLOEXEC         = 0x1
+
+	MOUNT_ATTR_RDONLY = 0x1
+)
+
+// mountTable is implemented by filesystems that can show host directories
+// over their own.
+type mountTable interface {
+	Mount(path, source string) error
+	Unmount(path string) error
+}
+
+// Filesystems mounted as the host's own instance.
+var hostFilesystems = map[string]string{
+	"proc":     "/proc",
+	"sysfs":    "/sys",
+	"devtmpfs": "/dev",
+	"devpts":   "/dev/pts",
+	"mqueue":   "/dev/mqueue",
+}
+
+type virtualMount struct {
+	fstype string // "" for a bind mount
+	source string // for a bind mount, the host path shown
+	data   string // comma-separated options
+	target string
+
+	// Bind mounts of paths under the mountpoint are followed by the
+	// resolver; everything else is shown by the VFS.
+	resolved bool
+	// Backing of a tmpfs, removed when it is unmounted.
+	tmpDir string
+	// Asked for with MS_RDONLY, which is only honoured by refusing the
+	// mount once it is found to be emulated.
+	readOnly bool
+}
+
+// mount attaches m at target.
+func (t *Tracer) mount(m *virtualMount, target string) error {
+	if m.fstype == "" && t.resolver.ShouldIntercept(m.source) {
+		t.resolver.Bind(target, m.source)
+		m.target, m.resolved = target, true
+		t.mounts = append(t.mounts, m)
+		return nil
+	}
+
+	mt, ok := t.vfs.(mountTable)
+	if !ok || !t.resolver.ShouldIntercept(target) {
+		return errNotEmulated
+	}
+	if m.readOnly {
+		return syscall.EPERM
+	}
+	if m.fstype == "tmpfs" && m.tmpDir == "" {
+		dir, err := os.MkdirTemp("", "fuss-tmpfs-")
+		if err != nil {
+			return err
+		}
+		os.Chmod(dir, tmpfsMode(m.data))
+		m.tmpDir = dir
+	}
+	hostDir := m.hostDir()
+	if hostDir == "" {
+		return errNotEmulated
+	}
+	if err := mt.Mount(t.resolver.TranslatePath(target), hostDir); err != nil {
+		return err
+	}
+	m.target, m.resolved = target, false
+	t.mounts = append(t.mounts, m)
+	return nil
+}
+
+// hostDir returns the host directory shown by a mount not followed by the
+// resolver.
+func (m *virtualMount) hostDir() string {
+	switch m.fstype {
+	case "":
+		return m.source
+	case "tmpfs":
+		return m.tmpDir
+	}
+	return hostFilesystems[m.fstype]
+}
+
+// describeMount returns the filesystem type, source and root of m as
+// mountinfo lists them. A bind mount shows the filesystem of what it binds.
+func (t *Tracer) describeMount(m *virtualMount) (fstype, source, root string) {
+	switch {
+	case m.resolved:
+		return "overlay", "fuss", t.resolver.TranslatePath(m.source)
+	case m.fstype == "":
+		return "none", m.source, m.source
+	case m.fstype == "tmpfs":
+		return "tmpfs", "tmpfs", "/"
+	}
+	return m.fstype, m.fstype, "/"
+}
+
+func (m *virtualMount) options() string {
+	if m.data == "" {
+		return "rw"
+	}
+	return "rw," + m.data
+}
+
+// unmount detaches m, keeping what backs it.
+func (t *Tracer) unmount(m *virtualMount) {
+	for i, other := range t.mounts {
+		if other == m {
+			t.mounts = append(t.mounts[:i], t.mounts[i+1:]...)
+			break
+		}
+	}
+	if m.resolved {
+		t.resolver.Unbind(m.target)
+	} else if mt, ok := t.vfs.(mountTable); ok {
+		mt.Unmount(t.resolver.TranslatePath(m.target))
+	}
+}
+
+// findMount returns the topmost mount at target.
+func (t *Tracer) findMount(target string) *virtualMount {
+	for i := len(t.mounts) - 1; i >= 0; i-- {
+		if t.mounts[i].target == target {
+			return t.mounts[i]
+		}
+	}
+	return nil
+}
+
+// mountAt returns the innermost mount at or above path, or nil.
+func (t *Tracer) mountAt(path string) *virtualMount {
+	var best *virtualMount
+	for _, m := range t.mounts {
+		if _, ok := pathWithinRoot(path, m.target); ok && (best == nil || len(m.target) >= len(best.target)) {
+			best = m
+		}
+	}
+	return best
+}
+
+// releaseMounts removes the directories backing tmpfs mounts at the end
+// of the session, once every tracee that could use them has exited.
+func (t *Tracer) releaseMounts() {
+	for _, m := range t.mounts {
+		if m.tmpDir != "" {
+			os.RemoveAll(m.tmpDir)
+		}
+	}
+	for _, dir := range t.unmountedTmpDirs {
+		os.RemoveAll(dir)
+	}
+	t.mounts, t.unmountedTmpDirs = nil, nil
+}
+
+// releaseTmpDir removes the directory backing an unmounted tmpfs, unless
+// another mount or the fd of an open_tree clone still shows it, in which
+// case it is left for releaseMounts.
+func (t *Tracer) releaseTmpDir(dir string) {
+	for _, m := range t.mounts {
+		if m.hostDir() == dir {
+			t.unmountedTmpDirs = append(t.unmountedTmpDirs, dir)
+			return
+		}
+	}
+	for _, proc := range t.procs {
+		for _, m := range proc.mountFds {
+			if m.hostDir() == dir {
+				t.unmountedTmpDirs = append(t.unmountedTmpDirs, dir)
+				return
+			}
+		}
+	}
+	os.RemoveAll(dir)
+}
+
+// tmpfsMode returns the root directory mode given by the mode= option.
+func tmpfsMode(data string) os.FileMode {
+	mode := os.FileMode(0o1777)
+	for _, opt := range strings.Split(data, ",") {
+		if v, ok := strings.CutPrefix(opt, "mode="); ok {
+			if n, err := strconv.ParseUint(v, 8, 32); err == nil {
+				mode = os.FileMode(n & 0o777)
+				if n&0o1000 != 0 {
+					mode |= os.ModeSticky
+				}
+			}
+		}
+	}
+	return mode
+}
+
+// pathExists reports whether a resolved path exists, looking it up in the
+// VFS if it is intercepted.
+func (t *Tracer) pathExists(path string) error {
+	if t.resolver.ShouldIntercept(path) {
+		_, err := t.vfs.ResolvePath(t.resolver.TranslatePath(path))
+		return err
+	}
+	_, err := os.Stat(path)
+	return err
+}
+
+func (h *SyscallHandler) mountTargetAt(dirfd int, pathAddr uintptr) (string, bool) {
+	path, err := ReadString(h.proc.pid, pathAddr, 4096)
+	if err != nil || path == "" {
+		return "", false
+	}
+	if dirfd != AT_FDCWD && !strings.HasPrefix(path, "/") {
+		base, ok := h.proc.fdPaths[dirfd]
+		if !ok {
+			if base, ok = h.resolveDirfdPath(dirfd); !ok {
+				return "", false
+			}
+		}
+		return h.rootedMountTarget(h.tracer.resolver.ResolveMountTarget(h.proc.root, base, path)), true
+	}
+	return h.rootedMountTarget(h.tracer.resolver.ResolveMountTarget(h.proc.root, h.proc.cwd, path)), true
+}
+
+// rootedMountTarget resolves the symlinks in the parent directories of a
+// mount target inside a virtual root, as resolveAt does for other paths.
+func (h *SyscallHandler) rootedMountTarget(target string) string {
+	if h.proc.root == "" || target == h.proc.root {
+		return target
+	}
+	rel, ok := pathWithinRoot(filepath.Dir(target), h.proc.root)
+	if !ok {
+		return target
+	}
+	dir, err := h.walkOpenat2(h.proc.root, rel, RESOLVE_IN_ROOT, true)
+	if err != nil {
+		return target
+	}
+	return filepath.Join(dir, filepath.Base(target))
+}
+
+// finishMount completes an emulated mount call with the outcome of err.
+func (h *SyscallHandler) finishMount(err error) {
+	switch err {
+	case errNotEmulated:
+	case nil:
+		h.skipSyscall(0)
+	default:
+		h.skipSyscall(errnoFromError(err))
+	}
+}
+
+func (h *SyscallHandler) handleMountEntry() {
+	target, ok := h.mountTargetAt(AT_FDCWD, uintptr(arg1(h.regs)))
+	if !ok {
+		return
+	}
+	flags := arg3(h.regs)
+	debugf("mount: target=%q flags=0x%x", target, flags)
+
+	switch {
+	case flags&MS_REMOUNT != 0:
+		// An emulated mount stays writable, which is all a remount
+		// without MS_RDONLY can ask for.
+		if h.tracer.findMount(target) != nil {
+			h.skipSyscall(readOnlyResult(flags))
+		}
+	case flags&(MS_UNBINDABLE|MS_PRIVATE|MS_SLAVE|MS_SHARED) != 0:
+		// Propagation of an emulated mount is not emulated.
+		if h.tracer.findMount(target) != nil {
+			h.skipSyscall(0)
+		}
+	case flags&MS_MOVE != 0:
+		from, ok := h.mountTargetAt(AT_FDCWD, uintptr(arg0(h.regs)))
+		if !ok {
+			return
+		}
+		h.finishMount(h.moveMount(from, target))
+	case flags&MS_BIND != 0:
+		source, err := ReadString(h.proc.pid, uintptr(arg0(h.regs)), 4096)
+		if err != nil || source == "" {
+			return
+		}
+		// Like the kernel, a bind mount ignores MS_RDONLY; only a remount
+		// makes it read-only.
+		source = h.resolvePath(source)
+		h.finishMount(h.attachMount(&virtualMount{source: source}, target))
+	default:
+		fstype, err := ReadString(h.proc.pid, uintptr(arg2(h.regs)), 256)
+		if err != nil || fstype == "" {
+			return
+		}
+		var data string
+		if addr := uintptr(arg4(h.regs)); addr != 0 {
+			data, _ = ReadString(h.proc.pid, addr, 4096)
+		}
+		m := &virtualMount{fstype: fstype, data: data, readOnly: flags&MS_RDONLY != 0}
+		h.finishMount(h.attachMount(m, target))
+	}
+}
+
+// readOnlyResult is the outcome of a request for mount flags: emulated
+// mounts cannot be made read-only.
+func readOnlyResult(flags uint64) int64 {
+	if flags&MS_RDONLY != 0 {
+		return negErrno(syscall.EPERM)
+	}
+	return 0
+}
+
+// attachMount mounts m at target, both of which must exist.
+func (h *SyscallHandler) attachMount(m *virtualMount, target string) error {
+	if m.fstype == "" {
+		if err := h.tracer.pathExists(m.source); err != nil {
+			return err
+		}
+	} else if _, ok := hostFilesystems[m.fstype]; !ok && m.fstype != "tmpfs" {
+		return errNotEmulated
+	}
+	if err := h.tracer.pathExists(target); err != nil {
+		if h.tracer.resolver.ShouldIntercept(target) {
+			return err
+		}
+		return errNotEmulated
+	}
+	if err := h.tracer.mount(m, target); err != nil {
+		return err
+	}
+	debugf("mount: %q (%q) on %q", m.source, m.fstype, target)
+	return nil
+}
+
+// moveMount moves the emulated mount at from to target.
+func (h *SyscallHandler) moveMount(from, target string) error {
+	m := h.tracer.findMount(from)
+	if m == nil {
+		return errNotEmulated
+	}
+	if err := h.tracer.pathExists(target); err != nil {
+		return err
+	}
+	h.tracer.unmount(m)
+	if err := h.tracer.mount(m, target); err != nil {
+		h.tracer.mount(m, from)
+		if err == errNotEmulated {
+			return syscall.EINVAL
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *SyscallHandler) handleUmountEntry() {
+	target, ok := h.mountTargetAt(AT_FDCWD, uintptr(arg0(h.regs)))
+	if !ok {
+		return
+	}
+	m := h.tracer.findMount(target)
+	if m == nil {
+		return
+	}
+	h.tracer.unmount(m)
+	if m.tmpDir != "" {
+		h.tracer.releaseTmpDir(m.tmpDir)
+	}
+	debugf("umount: %q", target)
+	h.skipSyscall(0)
+}
+
+// The new mount API hands out fds for mounts that are not attached yet.
+// open_tree, fsopen and fsmount are turned into calls that return an fd,
+// which fuss then knows to stand for the mount.
+
+func (h *SyscallHandler) handleOpenTreeEntry() {
+	dirfd := int(int32(arg0(h.regs)))
+	flags := arg2(h.regs)
+	if flags&OPEN_TREE_CLONE == 0 {
+		return
+	}
+	pathAddr := uintptr(arg1(h.regs))
+	source, ok := h.mountTargetAt(dirfd, pathAddr)
+	if !ok {
+		return
+	}
+
+	resolved := h.tracer.resolver.redirect(source)
+	m := &virtualMount{source: resolved}
+	if attached := h.tracer.findMount(source); attached != nil && !attached.resolved {
+		// A clone shows the same host directory.
+		m.source = attached.hostDir()
+	}
+
+	openPath := resolved
+	if h.tracer.resolver.ShouldIntercept(resolved) {
+		realPath, err := h.tracer.vfs.ResolvePath(h.tracer.resolver.TranslatePath(resolved))
+		if err != nil {
+			h.skipSyscall(errnoFromError(err))
+			return
+		}
+		openPath = realPath
+	}
+	newAddr, err := h.rewritePath(pathAddr, openPath)
+	if err != nil {
+		return
+	}
+	openFlags := uint64(unix.O_PATH)
+	if flags&syscall.O_CLOEXEC != 0 {
+		openFlags |= syscall.O_CLOEXEC
+	}
+	setSysno(h.regs, SYS_OPENAT)
+	setArg0(h.regs, AT_FDCWD_U64)
+	setArg1(h.regs, uint64(newAddr))
+	setArg2(h.regs, openFlags)
+	setArg3(h.regs, 0)
+	ptraceSetRegs(h.proc.pid, h.regs)
+	h.proc.pendingMountFd = m
+}
+
+func (h *SyscallHandler) handleFsopenEntry() {
+	fstype, err := ReadString(h.proc.pid, uintptr(arg0(h.regs)), 256)
+	if err != nil {
+		return
+	}
+	if _, ok := hostFilesystems[fstype]; !ok && fstype != "tmpfs" {
+		return
+	}
+	nameAddr, err := h.rewritePath(0, "fuss-"+fstype)
+	if err != nil {
+		return
+	}
+	var memfdFlags uint64
+	if arg1(h.regs)&FSOPEN_CLOEXEC != 0 {
+		memfdFlags = MFD_CLOEXEC
+	}
+	setSysno(h.regs, SYS_MEMFD_CREATE)
+	setArg0(h.regs, uint64(nameAddr))
+	setArg1(h.regs, memfdFlags)
+	ptraceSetRegs(h.proc.pid, h.regs)
+	h.proc.pendingMountFd = &virtualMount{fstype: fstype}
+}
+
+func (h *SyscallHandler) handleFsconfigEntry() {
+	m := h.proc.mountFds[int(int32(arg0(h.regs)))]
+	if m == nil {
+		return
+	}
+	if arg1(h.regs) == FSCONFIG_SET_FLAG {
+		key, err := ReadString(h.proc.pid, uintptr(arg2(h.regs)), 256)
+		if err != nil {
+			h.skipSyscall(negErrno(syscall.EFAULT))
+			return
+		}
+		if key == "ro" {
+			h.skipSyscall(negErrno(syscall.EPERM))
+			return
+		}
+	}
+	if arg1(h.regs) == FSCONFIG_SET_STRING {
+		key, err := ReadString(h.proc.pid, uintptr(arg2(h.regs)), 256)
+		value, err2 := ReadString(h.proc.pid, uintptr(arg3(h.regs)), 4096)
+		if err != nil || err2 != nil {
+			h.skipSyscall(negErrno(syscall.EFAULT))
+			return
+		}
+		if key != "source" {
+			if m.data != "" {
+				m.data += ","
+			}
+			m.data += key + "=" + value
+		}
+	}
+	h.skipSyscall(0)
+}
+
+func (h *SyscallHandler) handleFsmountEntry() {
+	fd := int(int32(arg0(h.regs)))
+	m := h.proc.mountFds[fd]
+	if m == nil {
+		return
+	}
+	if arg2(h.regs)&MOUNT_ATTR_RDONLY != 0 {
+		h.skipSyscall(negErrno(syscall.EPERM))
+		return
+	}
+	cmd := uint64(F_DUPFD)
+	if arg1(h.regs)&FSMOUNT_CLOEXEC != 0 {
+		cmd = F_DUPFD_CLOEXEC
+	}
+	setSysno(h.regs, SYS_FCNTL)
+	setArg1(h.regs, cmd)
+	setArg2(h.regs, 0)
+	ptraceSetRegs(h.proc.pid, h.regs)
+	mount := *m
+	h.proc.pendingMountFd = &mount
+}
+
+func (h *SyscallHandler) handleMountFdExit() {
+	m := h.proc.pendingMountFd
+	if m == nil {
+		return
+	}
+	h.proc.pendingMountFd = nil
+	fd := int(int64(retval(h.regs)))
+	if fd < 0 {
+		return
+	}
+	if h.proc.mountFds == nil {
+		h.proc.mountFds = make(map[int]*virtualMount)
+	}
+	h.proc.mountFds[fd] = m
+}
+
+func (h *SyscallHandler) handleMoveMountEntry() {
+	fromFd := int(int32(arg0(h.regs)))
+	flags := arg4(h.regs)
+
+	var target string
+	if flags&MOVE_MOUNT_T_EMPTY_PATH != 0 {
+		var ok bool
+		toFd := int(int32(arg2(h.regs)))
+		if target, ok = h.proc.fdPaths[toFd]; !ok {
+			if target, ok = h.resolveDirfdPath(toFd); !ok {
+				return
+			}
+		}
+	} else {
+		var ok bool
+		if target, ok = h.mountTargetAt(int(int32(arg2(h.regs))), uintptr(arg3(h.regs))); !ok {
+			return
+		}
+	}
+
+	if m := h.proc.mountFds[fromFd]; m != nil && flags&MOVE_MOUNT_F_EMPTY_PATH != 0 {
+		err := h.attachMount(m, target)
+		if err == errNotEmulated {
+			err = syscall.EPERM
+		}
+		if err == nil {
+			delete(h.proc.mountFds, fromFd)
+		}
+		h.finishMount(err)
+		return
+	}
+
+	from, ok := h.mountTargetAt(fromFd, uintptr(arg1(h.regs)))
+	if !ok {
+		return
+	}
+	h.finishMount(h.moveMount(from, target))
+}
@@ -0,0 +1,214 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+)
+
+// A mountpoint need not exist on the host: its paths are intercepted all
+// the same. Nothing lists it though, so fuss appends an entry for it to the
+// getdents results of its parent directory, once the real entries are
+// exhausted, and counts it in the parent's link count.
+
+const (
+	DT_DIR = 4
+
+	STATX_NLINK     = 0x4
+	statxMaskOffset = 0
+	statxNlinkOff   = 16
+
+	// d_off of the appended entries, as ext4 reports for its last one.
+	direntEOF = 0x7fffffffffffffff
+)
+
+type pendingMountParent struct {
+	fd      int
+	bufAddr uintptr
+	count   int
+	format  direntFormat
+	statx   bool
+	names   []string
+}
+
+// mountEntries returns the names of mount targets directly below dir that
+// do not exist on the host: the mountpoint and those of emulated mounts.
+func (t *Tracer) mountEntries(dir string) []string {
+	targets := []string{t.resolver.Mountpoint()}
+	for _, m := range t.mounts {
+		targets = append(targets, m.target)
+	}
+
+	var names []string
+	for _, target := range targets {
+		if target == "/" || filepath.Dir(target) != dir {
+			continue
+		}
+		name := filepath.Base(target)
+		if slices.Contains(names, name) {
+			continue
+		}
+		if _, err := os.Lstat(target); !os.IsNotExist(err) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func (h *SyscallHandler) handleMountParentGetdentsEntry(fd int, bufAddr uintptr, count int, format direntFormat) {
+	if h.proc.splicedDirs[fd] {
+		return
+	}
+	dir, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", h.proc.pid, fd))
+	if err != nil {
+		return
+	}
+	names := h.tracer.mountEntries(dir)
+	if len(names) == 0 {
+		return
+	}
+	h.proc.pendingMountParent = &pendingMountParent{fd: fd, bufAddr: bufAddr, count: count, format: format, names: names}
+}
+
+// handleMountParentGetdentsExit appends the mount entries when the kernel
+// reports the end of the directory, and lets the next call report it.
+func (h *SyscallHandler) handleMountParentGetdentsExit() {
+	pending := h.proc.pendingMountParent
+	if pending == nil {
+		return
+	}
+	h.proc.pendingMountParent = nil
+	if retval(h.regs) != 0 {
+		return
+	}
+
+	ino := uint64(1)
+	if realPath, err := h.tracer.vfs.ResolvePath("/"); err == nil {
+		var st syscall.Stat_t
+		if syscall.Stat(realPath, &st) == nil {
+			ino = st.Ino
+		}
+	}
+
+	buf := make([]byte, pending.count)
+	offset := 0
+	for _, name := range pending.names {
+		reclen := direntLen(name, pending.format)
+		if offset+reclen > len(buf) {
+			break
+		}
+		putDirent(buf[offset:], ino, direntEOF, DT_DIR, name, pending.format)
+		offset += reclen
+	}
+	if offset == 0 {
+		return
+	}
+	if err := WriteBytes(h.proc.pid, pending.bufAddr, buf[:offset]); err != nil {
+		return
+	}
+
+	if h.proc.splicedDirs == nil {
+		h.proc.splicedDirs = make(map[int]bool)
+	}
+	h.proc.splicedDirs[pending.fd] = true
+	setRetval(h.regs, uint64(offset))
+	ptraceSetRegs(h.proc.pid, h.regs)
+}
+
+// handleMountParentStatEntry notes a stat of a directory holding mount
+// targets, whose link count has to include them. The directory is given by
+// a path relative to dirfd, or for fstat and an empty path by dirfd itself.
+func (h *SyscallHandler) handleMountParentStatEntry(dirfd int, pathAddr uintptr) {
+	var bufAddr uintptr
+	statx := false
+	switch h.proc.entryNr {
+	case SYS_STAT, SYS_LSTAT, SYS_FSTAT:
+		bufAddr = uintptr(arg1(h.regs))
+	case SYS_NEWFSTATAT:
+		bufAddr = uintptr(arg2(h.regs))
+	case SYS_STATX:
+		bufAddr = uintptr(arg4(h.regs))
+		statx = true
+	default:
+		return
+	}
+
+	var dir string
+	if h.proc.entryNr == SYS_FSTAT {
+		var ok bool
+		if dir, ok = h.dirfdPath(dirfd); !ok {
+			return
+		}
+	} else {
+		path, err := ReadString(h.proc.pid, pathAddr, 4096)
+		if err != nil {
+			return
+		}
+		switch {
+		case path == "":
+			var ok bool
+			if dir, ok = h.dirfdPath(dirfd); !ok {
+				return
+			}
+		case filepath.IsAbs(path) || dirfd == AT_FDCWD:
+			dir = h.resolvePath(path)
+		default:
+			base, ok := h.dirfdPath(dirfd)
+			if !ok {
+				return
+			}
+			dir = h.tracer.resolver.ResolveAt(dirfd, path, h.proc.root, h.proc.cwd, map[int]string{dirfd: base})
+		}
+	}
+	names := h.tracer.mountEntries(dir)
+	if len(names) == 0 {
+		return
+	}
+	h.proc.pendingMountParent = &pendingMountParent{bufAddr: bufAddr, statx: statx, names: names}
+}
+
+// dirfdPath returns the host path of the directory open as dirfd.
+func (h *SyscallHandler) dirfdPath(dirfd int) (string, bool) {
+	if path, ok := h.proc.fdPaths[dirfd]; ok {
+		return path, true
+	}
+	return h.resolveDirfdPath(dirfd)
+}
+
+func (h *SyscallHandler) handleMountParentStatExit() {
+	pending := h.proc.pendingMountParent
+	if pending == nil {
+		return
+	}
+	h.proc.pendingMountParent = nil
+	if retval(h.regs) != 0 {
+		return
+	}
+
+	if pending.statx {
+		buf := make([]byte, statxNlinkOff+4)
+		if _, err := ReadBytes(h.proc.pid, pending.bufAddr, buf); err != nil {
+			return
+		}
+		if binary.LittleEndian.Uint32(buf[statxMaskOffset:])&STATX_NLINK == 0 {
+			return
+		}
+		nlink := binary.LittleEndian.Uint32(buf[statxNlinkOff:]) + uint32(len(pending.names))
+		binary.LittleEndian.PutUint32(buf[statxNlinkOff:], nlink)
+		WriteBytes(h.proc.pid, pending.bufAddr+statxNlinkOff, buf[statxNlinkOff:])
+		return
+	}
+
+	off, size := statNlink(h.regs)
+	buf := make([]byte, size)
+	addr := pending.bufAddr + off
+	if _, err := ReadBytes(h.proc.pid, addr, buf); err != nil {
+		return
+	}
+	putUint(buf, getUint(buf)+uint64(len(pending.names)))
+	WriteBytes(h.proc.pid, addr, buf)
+}
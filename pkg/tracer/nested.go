@@ -0,0 +1,850 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Every process under fuss is already traced by fuss, so a tracee calling
+// ptrace() itself (gdb, strace) would get EPERM. Instead fuss plays the
+// kernel's part: it records which tracee "traces" which, keeps an emulated
+// tracee parked in its real ptrace-stop whenever its emulated tracer should
+// see a stop, and answers the emulated tracer's ptrace() and wait calls on
+// its behalf. Requests touching registers or memory are proxied through
+// fuss's own ptrace access.
+
+const (
+	PTRACE_GETREGS          = 12
+	PTRACE_SETREGS          = 13
+	PTRACE_GETFPREGS        = 14
+	PTRACE_SETFPREGS        = 15
+	PTRACE_GETREGSET        = 0x4204
+	PTRACE_SETREGSET        = 0x4205
+	PTRACE_PEEKSIGINFO      = 0x4209
+	PTRACE_GETSIGMASK       = 0x420a
+	PTRACE_SETSIGMASK       = 0x420b
+	PTRACE_EVENT_FORK       = 1
+	PTRACE_EVENT_VFORK      = 2
+	PTRACE_EVENT_CLONE      = 3
+	PTRACE_EVENT_EXEC       = 4
+	PTRACE_PEEKSIGINFO_ARGS = 16
+
+	CLD_EXITED  = 1
+	CLD_KILLED  = 2
+	CLD_DUMPED  = 3
+	CLD_TRAPPED = 4
+
+	P_PID   = 1
+	WNOWAIT = 0x01000000
+
+	siginfoSize  = 128
+	fpregsSize   = 512
+	maxRegsetLen = 16384
+)
+
+type parkKind int
+
+const (
+	parkNone parkKind = iota
+	parkStop
+	parkGroupStop
+	parkSyscallEntry
+	parkSyscallExit
+)
+
+// nestedTracee is a tracee that another tracee believes it is tracing.
+type nestedTracee struct {
+	pid        int
+	tracer     int // thread group of the emulated tracer
+	realParent int
+	seized     bool
+	options    int
+	eventMsg   uint64
+
+	syscalls    bool // last resumed with PTRACE_SYSCALL
+	stepping    bool // single-stepping over a syscall instruction
+	interrupt   bool // PTRACE_INTERRUPT requested
+	listening   bool // PTRACE_LISTEN in a group-stop
+	initialStop bool // auto-attached child, its first stop is reported
+	execTrap    bool // legacy SIGTRAP owed at the end of execve
+	park        parkKind
+}
+
+// nestedReport is a wait status the emulated tracer has not collected yet.
+type nestedReport struct {
+	pid    int
+	status int
+}
+
+// pendingWait is a wait4 or waitid of an emulated tracer that was forced to
+// WNOHANG so that fuss can block it itself.
+type pendingWait struct {
+	waitid  bool
+	options uint64
+}
+
+func stopStatus(sig syscall.Signal, event int) int {
+	return event<<16 | int(sig)<<8 | 0x7f
+}
+
+func forkOption(event int) int {
+	switch event {
+	case PTRACE_EVENT_FORK:
+		return PTRACE_O_TRACEFORK
+	case PTRACE_EVENT_VFORK:
+		return PTRACE_O_TRACEVFORK
+	case PTRACE_EVENT_CLONE:
+		return PTRACE_O_TRACECLONE
+	}
+	return 0
+}
+
+func (p *ProcessState) threadGroup() int {
+	if p.tgid == 0 {
+		p.tgid = p.pid
+		if tgid, err := statusField(p.pid, "Tgid:"); err == nil && tgid > 0 {
+			p.tgid = tgid
+		}
+	}
+	return p.tgid
+}
+
+func (t *Tracer) hasNested(tgid int) bool {
+	if len(t.nestedReports[tgid]) > 0 {
+		return true
+	}
+	for _, nt := range t.nested {
+		if nt.tracer == tgid {
+			return true
+		}
+	}
+	return false
+}
+
+// park leaves proc in its current ptrace-stop and tells the emulated tracer.
+func (t *Tracer) park(proc *ProcessState, nt *nestedTracee, kind parkKind, status int) {
+	debugf("nested: parking pid=%d for tracer %d status=%#x", proc.pid, nt.tracer, status)
+	proc.parked = true
+	nt.park = kind
+	t.queueReport(nt.tracer, nestedReport{pid: proc.pid, status: status})
+}
+
+func (t *Tracer) queueReport(tracer int, r nestedReport) {
+	t.dropReports(tracer, r.pid)
+	t.nestedReports[tracer] = append(t.nestedReports[tracer], r)
+	syscall.Kill(tracer, syscall.SIGCHLD)
+	t.wakeWaiters(tracer, false)
+}
+
+func (t *Tracer) dropReports(tracer int, pid int) {
+	reports := t.nestedReports[tracer]
+	kept := reports[:0]
+	for _, r := range reports {
+		if r.pid != pid {
+			kept = append(kept, r)
+		}
+	}
+	t.nestedReports[tracer] = kept
+}
+
+func (t *Tracer) takeReport(tracer int, match func(pid int) bool, consume bool) (nestedReport, bool) {
+	reports := t.nestedReports[tracer]
+	for i, r := range reports {
+		if !match(r.pid) {
+			continue
+		}
+		if consume {
+			t.nestedReports[tracer] = append(reports[:i], reports[i+1:]...)
+		}
+		return r, true
+	}
+	return nestedReport{}, false
+}
+
+// nestedStop reports a non-syscall stop of an emulated tracee. It returns
+// false if the stop is fuss's own business and the tracee should be resumed
+// as usual.
+func (t *Tracer) nestedStop(proc *ProcessState, sig syscall.Signal, event int) bool {
+	nt := t.nested[proc.pid]
+	if nt == nil {
+		return false
+	}
+
+	kind := parkStop
+	var status int
+	switch {
+	case event == PTRACE_EVENT_STOP && isStopSignal(sig):
+		kind = parkGroupStop
+		nt.listening = false
+		status = stopStatus(sig, 0)
+		if nt.seized {
+			status = stopStatus(sig, PTRACE_EVENT_STOP)
+		}
+	case event == PTRACE_EVENT_STOP:
+		switch {
+		case nt.initialStop:
+			nt.initialStop = false
+			status = stopStatus(syscall.SIGSTOP, 0)
+			if nt.seized {
+				status = stopStatus(syscall.SIGTRAP, PTRACE_EVENT_STOP)
+			}
+		case nt.interrupt, nt.listening:
+			nt.interrupt = false
+			nt.listening = false
+			status = stopStatus(syscall.SIGTRAP, PTRACE_EVENT_STOP)
+		default:
+			return false
+		}
+	case event == PTRACE_EVENT_EXEC:
+		switch {
+		case nt.options&PTRACE_O_TRACEEXEC != 0:
+			nt.eventMsg = uint64(proc.pid)
+			status = stopStatus(syscall.SIGTRAP, PTRACE_EVENT_EXEC)
+		case !nt.seized:
+			// Legacy tracees get a SIGTRAP after a successful execve, which
+			// the kernel delivers only once the syscall has returned.
+			nt.execTrap = true
+			return false
+		default:
+			return false
+		}
+	case event != 0:
+		if nt.options&forkOption(event) == 0 {
+			return false
+		}
+		status = stopStatus(syscall.SIGTRAP, event)
+	default:
+		if sig == wakeSignal && t.detachRequested.Load() {
+			return false
+		}
+		nt.stepping = false
+		status = stopStatus(sig, 0)
+	}
+
+	t.park(proc, nt, kind, status)
+	return true
+}
+
+// nestedSyscallStop handles a syscall stop of an emulated tracee. Entry
+// stops the emulated tracer asked for are reported before fuss touches the
+// registers; exit stops after fuss has finished and put the arguments back.
+func (t *Tracer) nestedSyscallStop(proc *ProcessState) bool {
+	nt := t.nested[proc.pid]
+	if nt == nil {
+		return false
+	}
+	if proc.injecting() {
+		// Syscalls injected by fuss, and the restart of the syscall they
+		// were injected into, stay hidden.
+		t.handleSyscall(proc)
+		return true
+	}
+
+	entry := !proc.inSyscall
+	if !t.noSyscallInfo {
+		if info, err := getSyscallInfo(proc.pid); err == nil {
+			entry = info.op != PTRACE_SYSCALL_INFO_EXIT
+		}
+	}
+	if entry && nt.syscalls && !nt.stepping {
+		t.park(proc, nt, parkSyscallEntry, t.syscallStopStatus(nt))
+		return true
+	}
+
+	t.handleSyscall(proc)
+	if entry || proc.parked {
+		return true
+	}
+	t.hideInterception(proc)
+
+	switch {
+	case nt.execTrap:
+		nt.execTrap = false
+		t.park(proc, nt, parkSyscallExit, stopStatus(syscall.SIGTRAP, 0))
+	case nt.stepping:
+		nt.stepping = false
+		t.park(proc, nt, parkSyscallExit, stopStatus(syscall.SIGTRAP, 0))
+	case nt.syscalls:
+		t.park(proc, nt, parkSyscallExit, t.syscallStopStatus(nt))
+	}
+	return true
+}
+
+func (t *Tracer) syscallStopStatus(nt *nestedTracee) int {
+	sig := syscall.SIGTRAP
+	if nt.options&PTRACE_O_TRACESYSGOOD != 0 {
+		sig |= SIGTRAP_MASK
+	}
+	return stopStatus(sig, 0)
+}
+
+// hideInterception puts back the syscall number and arguments fuss may have
+// rewritten at entry, so the emulated tracer sees what the tracee passed.
+func (t *Tracer) hideInterception(proc *ProcessState) {
+	var regs syscall.PtraceRegs
+	if err := ptraceGetRegs(proc.pid, &regs); err != nil {
+		return
+	}
+	restoreEntryArgs(&regs, proc.entryNr, proc.entryArgs)
+	ptraceSetRegs(proc.pid, &regs)
+}
+
+// nestedFork makes a new child of an emulated tracee an emulated tracee too
+// if the emulated tracer asked for it with PTRACE_O_TRACE{FORK,VFORK,CLONE}.
+// seen means the child's own first stop has already gone by.
+func (t *Tracer) nestedFork(parent *ProcessState, child int, event int, seen bool) {
+	nt := t.nested[parent.pid]
+	if nt == nil || nt.options&forkOption(event) == 0 {
+		return
+	}
+	nt.eventMsg = uint64(child)
+	t.nested[child] = &nestedTracee{
+		pid:         child,
+		tracer:      nt.tracer,
+		realParent:  parent.threadGroup(),
+		seized:      nt.seized,
+		options:     nt.options,
+		initialStop: true,
+	}
+	if seen {
+		ptraceInterrupt(child)
+	}
+}
+
+// nestedExited forgets an exited tracee. The exit is reported to its
+// emulated tracer unless that is the real parent, which gets it from the
+// kernel anyway.
+func (t *Tracer) nestedExited(pid int, ws syscall.WaitStatus) {
+	if nt := t.nested[pid]; nt != nil {
+		delete(t.nested, pid)
+		t.dropReports(nt.tracer, pid)
+		if nt.tracer != nt.realParent {
+			t.queueReport(nt.tracer, nestedReport{pid: pid, status: int(ws)})
+		}
+	}
+
+	// An exiting tracer implicitly detaches from its tracees.
+	for _, nt := range t.nested {
+		if nt.tracer != pid {
+			continue
+		}
+		delete(t.nested, nt.pid)
+		proc := t.procs[nt.pid]
+		if nt.options&PTRACE_O_EXITKILL != 0 {
+			syscall.Kill(nt.pid, syscall.SIGKILL)
+		}
+		if proc != nil && nt.park != parkNone {
+			t.resumeNested(proc, nt, syscall.PTRACE_CONT, 0)
+		}
+	}
+	delete(t.nestedReports, pid)
+
+	// Any exit may be a real child some blocked waiter is interested in.
+	t.wakeWaiters(0, true)
+}
+
+// resumeNested restarts a parked emulated tracee on behalf of its emulated
+// tracer.
+func (t *Tracer) resumeNested(proc *ProcessState, nt *nestedTracee, req int, sig int) error {
+	kind := nt.park
+	nt.park = parkNone
+	nt.syscalls = req == syscall.PTRACE_SYSCALL
+	nt.stepping = false
+	proc.parked = false
+	t.dropReports(nt.tracer, proc.pid)
+
+	if kind == parkSyscallEntry {
+		// Our own entry handling was deferred until now, so it sees any
+		// register changes the emulated tracer made.
+		t.handleSyscall(proc)
+	}
+
+	if req == syscall.PTRACE_SINGLESTEP {
+		// Stepping over a syscall instruction would bypass our syscall
+		// stops; run to the syscall exit instead and report that as the
+		// end of the step.
+		if kind != parkSyscallEntry && !atSyscallInsn(proc.pid) {
+			if _, errno := ptraceRequest(syscall.PTRACE_SINGLESTEP, proc.pid, 0, uintptr(sig)); errno != 0 {
+				return errno
+			}
+			return nil
+		}
+		nt.stepping = true
+	}
+	return syscall.PtraceSyscall(proc.pid, sig)
+}
+
+func atSyscallInsn(pid int) bool {
+	var regs syscall.PtraceRegs
+	if err := ptraceGetRegs(pid, &regs); err != nil {
+		return false
+	}
+	code := make([]byte, len(syscallInsn))
+	if n, err := ReadBytes(pid, uintptr(pc(&regs)), code); err != nil || n < len(code) {
+		return false
+	}
+	return string(code) == string(syscallInsn)
+}
+
+// wakeWaiters completes blocked wait calls of tracer (or of everyone if
+// tracer is 0) that now have a nested report to collect. With restart set,
+// waiters with nothing to collect re-issue their wait so that they can see
+// real children that changed state.
+func (t *Tracer) wakeWaiters(tracer int, restart bool) {
+	for _, proc := range t.procs {
+		pw := proc.pendingWait
+		if !proc.parked || pw == nil || (tracer != 0 && proc.threadGroup() != tracer) {
+			continue
+		}
+
+		var regs syscall.PtraceRegs
+		if err := ptraceGetRegs(proc.pid, &regs); err != nil {
+			continue
+		}
+		h := &SyscallHandler{tracer: t, proc: proc, regs: &regs}
+		if result, ok := h.collectNestedReport(pw.waitid); ok {
+			setRetval(&regs, uint64(result))
+		} else if restart {
+			rewindSyscall(&regs, proc.entryNr, proc.entryArgs)
+		} else {
+			continue
+		}
+		h.restoreWaitOptions(pw)
+
+		proc.pendingWait = nil
+		proc.parked = false
+		ptraceSetRegs(proc.pid, &regs)
+		syscall.PtraceSyscall(proc.pid, 0)
+	}
+}
+
+// releaseParked lets a parked tracee go before fuss detaches from it. A
+// blocked wait is re-issued so the tracee blocks in the kernel instead.
+func (t *Tracer) releaseParked(proc *ProcessState) {
+	if pw := proc.pendingWait; pw != nil {
+		var regs syscall.PtraceRegs
+		if err := ptraceGetRegs(proc.pid, &regs); err == nil {
+			h := &SyscallHandler{tracer: t, proc: proc, regs: &regs}
+			rewindSyscall(&regs, proc.entryNr, proc.entryArgs)
+			h.restoreWaitOptions(pw)
+			ptraceSetRegs(proc.pid, &regs)
+		}
+		proc.pendingWait = nil
+	}
+	proc.parked = false
+	delete(t.nested, proc.pid)
+}
+
+func (h *SyscallHandler) handlePtraceEntry() {
+	t := h.tracer
+	args := h.proc.entryArgs
+	req := int(args[0])
+	pid := int(int32(args[1]))
+	addr := uintptr(args[2])
+	data := uintptr(args[3])
+	tgid := h.proc.threadGroup()
+
+	switch req {
+	case syscall.PTRACE_TRACEME:
+		ppid, ok := parentOf(tgid)
+		if !ok || t.nested[h.proc.pid] != nil || t.procs[ppid] == nil {
+			h.skipSyscall(negErrno(syscall.EPERM))
+			return
+		}
+		debugf("nested: pid=%d PTRACE_TRACEME by parent %d", h.proc.pid, ppid)
+		t.nested[h.proc.pid] = &nestedTracee{pid: h.proc.pid, tracer: ppid, realParent: ppid}
+		h.skipSyscall(0)
+		return
+
+	case syscall.PTRACE_ATTACH, PTRACE_SEIZE:
+		target, ok := t.procs[pid]
+		if !ok {
+			// Not one of ours; the kernel decides.
+			return
+		}
+		if t.nested[pid] != nil || target.threadGroup() == tgid {
+			h.skipSyscall(negErrno(syscall.EPERM))
+			return
+		}
+		nt := &nestedTracee{pid: pid, tracer: tgid}
+		nt.realParent, _ = parentOf(target.threadGroup())
+		if req == PTRACE_SEIZE {
+			nt.seized = true
+			nt.options = int(data)
+		} else {
+			syscall.Kill(pid, syscall.SIGSTOP)
+		}
+		debugf("nested: pid=%d traced by %d", pid, tgid)
+		t.nested[pid] = nt
+		h.skipSyscall(0)
+		return
+	}
+
+	nt := t.nested[pid]
+	if nt == nil {
+		if _, ok := t.procs[pid]; ok {
+			h.skipSyscall(negErrno(syscall.ESRCH))
+		}
+		return
+	}
+	if nt.tracer != tgid {
+		h.skipSyscall(negErrno(syscall.ESRCH))
+		return
+	}
+
+	switch req {
+	case syscall.PTRACE_KILL:
+		syscall.Kill(pid, syscall.SIGKILL)
+		h.skipSyscall(0)
+		return
+	case PTRACE_INTERRUPT:
+		if !nt.seized {
+			h.skipSyscall(negErrno(syscall.EIO))
+			return
+		}
+		if nt.park == parkNone {
+			nt.interrupt = true
+			ptraceInterrupt(pid)
+		}
+		h.skipSyscall(0)
+		return
+	}
+
+	target := t.procs[pid]
+	if target == nil || nt.park == parkNone {
+		h.skipSyscall(negErrno(syscall.ESRCH))
+		return
+	}
+	h.skipSyscall(h.nestedRequest(req, target, nt, addr, data))
+}
+
+// nestedRequest performs a ptrace request on a parked emulated tracee.
+func (h *SyscallHandler) nestedRequest(req int, target *ProcessState, nt *nestedTracee, addr, data uintptr) int64 {
+	t := h.tracer
+	pid := target.pid
+
+	switch req {
+	case syscall.PTRACE_PEEKTEXT, syscall.PTRACE_PEEKDATA, syscall.PTRACE_PEEKUSR:
+		return h.ptraceOut(req, pid, addr, data, 8)
+	case syscall.PTRACE_POKETEXT, syscall.PTRACE_POKEDATA, syscall.PTRACE_POKEUSR:
+		if _, errno := ptraceRequest(req, pid, addr, data); errno != 0 {
+			return negErrno(errno)
+		}
+		return 0
+	case syscall.PTRACE_CONT, syscall.PTRACE_SYSCALL, syscall.PTRACE_SINGLESTEP:
+		if err := t.resumeNested(target, nt, req, int(data)); err != nil {
+			return errnoFromError(err)
+		}
+		return 0
+	case syscall.PTRACE_DETACH:
+		delete(t.nested, pid)
+		if err := t.resumeNested(target, nt, syscall.PTRACE_CONT, int(data)); err != nil {
+			return errnoFromError(err)
+		}
+		return 0
+	case PTRACE_LISTEN:
+		if !nt.seized || nt.park != parkGroupStop {
+			return negErrno(syscall.EIO)
+		}
+		nt.park = parkNone
+		nt.listening = true
+		target.parked = false
+		t.dropReports(nt.tracer, pid)
+		if err := ptraceListen(pid); err != nil {
+			return errnoFromError(err)
+		}
+		return 0
+	case syscall.PTRACE_SETOPTIONS:
+		nt.options = int(data)
+		return 0
+	case syscall.PTRACE_GETEVENTMSG:
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], nt.eventMsg)
+		if err := WriteBytes(h.proc.pid, data, buf[:]); err != nil {
+			return negErrno(syscall.EFAULT)
+		}
+		return 0
+	case syscall.PTRACE_GETSIGINFO:
+		return h.ptraceOut(req, pid, addr, data, siginfoSize)
+	case syscall.PTRACE_SETSIGINFO:
+		return h.ptraceIn(req, pid, addr, data, siginfoSize)
+	case PTRACE_GETREGS:
+		return h.ptraceOut(req, pid, addr, data, int(unsafe.Sizeof(syscall.PtraceRegs{})))
+	case PTRACE_SETREGS:
+		return h.ptraceIn(req, pid, addr, data, int(unsafe.Sizeof(syscall.PtraceRegs{})))
+	case PTRACE_GETFPREGS:
+		return h.ptraceOut(req, pid, addr, data, fpregsSize)
+	case PTRACE_SETFPREGS:
+		return h.ptraceIn(req, pid, addr, data, fpregsSize)
+	case PTRACE_GETSIGMASK:
+		return h.ptraceOut(req, pid, addr, data, int(addr))
+	case PTRACE_SETSIGMASK:
+		return h.ptraceIn(req, pid, addr, data, int(addr))
+	case PTRACE_GETREGSET, PTRACE_SETREGSET:
+		return h.ptraceRegset(req, pid, addr, data)
+	case PTRACE_GET_SYSCALL_INFO:
+		return h.ptraceSyscallInfo(pid, addr, data)
+	case PTRACE_PEEKSIGINFO:
+		return h.ptracePeekSiginfo(pid, addr, data)
+	}
+	return negErrno(syscall.EIO)
+}
+
+func ptraceRequest(req int, pid int, addr, data uintptr) (uintptr, syscall.Errno) {
+	r, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, uintptr(req), uintptr(pid), addr, data, 0, 0)
+	return r, errno
+}
+
+func ptraceBuffer(req int, pid int, addr uintptr, buf []byte) (uintptr, syscall.Errno) {
+	r, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, uintptr(req), uintptr(pid), addr, uintptr(unsafe.Pointer(&buf[0])), 0, 0)
+	return r, errno
+}
+
+// ptraceOut runs a request that fills a buffer and copies up to size bytes
+// of it to dst in the emulated tracer.
+func (h *SyscallHandler) ptraceOut(req int, pid int, addr uintptr, dst uintptr, size int) int64 {
+	if size <= 0 || size > maxRegsetLen {
+		return negErrno(syscall.EINVAL)
+	}
+	buf := make([]byte, max(size, syscallInfoSize))
+	r, errno := ptraceBuffer(req, pid, addr, buf)
+	if errno != 0 {
+		return negErrno(errno)
+	}
+	if err := WriteBytes(h.proc.pid, dst, buf[:size]); err != nil {
+		return negErrno(syscall.EFAULT)
+	}
+	return int64(r)
+}
+
+// ptraceSyscallInfo copies as much of the syscall info as the emulated
+// tracer has room for. Like the kernel, it returns the full size, so that a
+// size of 0 asks for it without copying anything.
+func (h *SyscallHandler) ptraceSyscallInfo(pid int, size uintptr, dst uintptr) int64 {
+	buf := make([]byte, syscallInfoSize)
+	r, errno := ptraceBuffer(PTRACE_GET_SYSCALL_INFO, pid, uintptr(len(buf)), buf)
+	if errno != 0 {
+		return negErrno(errno)
+	}
+	if n := min(size, r); n > 0 {
+		if err := WriteBytes(h.proc.pid, dst, buf[:n]); err != nil {
+			return negErrno(syscall.EFAULT)
+		}
+	}
+	return int64(r)
+}
+
+// ptraceIn copies size bytes from src in the emulated tracer and runs a
+// request that consumes them.
+func (h *SyscallHandler) ptraceIn(req int, pid int, addr uintptr, src uintptr, size int) int64 {
+	if size <= 0 || size > maxRegsetLen {
+		return negErrno(syscall.EINVAL)
+	}
+	buf := make([]byte, size)
+	if n, err := ReadBytes(h.proc.pid, src, buf); err != nil || n < size {
+		return negErrno(syscall.EFAULT)
+	}
+	r, errno := ptraceBuffer(req, pid, addr, buf)
+	if errno != 0 {
+		return negErrno(errno)
+	}
+	return int64(r)
+}
+
+func (h *SyscallHandler) ptraceRegset(req int, pid int, regset uintptr, iovAddr uintptr) int64 {
+	var iov [16]byte
+	if n, err := ReadBytes(h.proc.pid, iovAddr, iov[:]); err != nil || n < len(iov) {
+		return negErrno(syscall.EFAULT)
+	}
+	base := uintptr(binary.LittleEndian.Uint64(iov[0:]))
+	size := int(binary.LittleEndian.Uint64(iov[8:]))
+	if size <= 0 || size > maxRegsetLen {
+		return negErrno(syscall.EINVAL)
+	}
+
+	buf := make([]byte, size)
+	if req == PTRACE_SETREGSET {
+		if n, err := ReadBytes(h.proc.pid, base, buf); err != nil || n < size {
+			return negErrno(syscall.EFAULT)
+		}
+	}
+	local := syscall.Iovec{Base: &buf[0]}
+	local.SetLen(size)
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, uintptr(req), uintptr(pid), regset, uintptr(unsafe.Pointer(&local)), 0, 0)
+	if errno != 0 {
+		return negErrno(errno)
+	}
+	if req == PTRACE_SETREGSET {
+		return 0
+	}
+
+	if err := WriteBytes(h.proc.pid, base, buf[:local.Len]); err != nil {
+		return negErrno(syscall.EFAULT)
+	}
+	binary.LittleEndian.PutUint64(iov[8:], uint64(local.Len))
+	if err := WriteBytes(h.proc.pid, iovAddr+8, iov[8:]); err != nil {
+		return negErrno(syscall.EFAULT)
+	}
+	return 0
+}
+
+func (h *SyscallHandler) ptracePeekSiginfo(pid int, argsAddr uintptr, dst uintptr) int64 {
+	args := make([]byte, PTRACE_PEEKSIGINFO_ARGS)
+	if n, err := ReadBytes(h.proc.pid, argsAddr, args); err != nil || n < len(args) {
+		return negErrno(syscall.EFAULT)
+	}
+	nr := int(int32(binary.LittleEndian.Uint32(args[12:])))
+	if nr <= 0 {
+		return 0
+	}
+	nr = min(nr, maxRegsetLen/siginfoSize)
+	binary.LittleEndian.PutUint32(args[12:], uint32(nr))
+
+	buf := make([]byte, nr*siginfoSize)
+	r, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, PTRACE_PEEKSIGINFO, uintptr(pid),
+		uintptr(unsafe.Pointer(&args[0])), uintptr(unsafe.Pointer(&buf[0])), 0, 0)
+	if errno != 0 {
+		return negErrno(errno)
+	}
+	if err := WriteBytes(h.proc.pid, dst, buf[:int(r)*siginfoSize]); err != nil {
+		return negErrno(syscall.EFAULT)
+	}
+	return int64(r)
+}
+
+// handleWaitEntry answers wait4/waitid from an emulated tracer with a
+// pending nested report. Otherwise a blocking wait is turned into WNOHANG so
+// fuss can block it at the exit stop and still complete it with a report
+// arriving later.
+func (h *SyscallHandler) handleWaitEntry(waitid bool) {
+	if !h.tracer.hasNested(h.proc.threadGroup()) {
+		return
+	}
+	if result, ok := h.collectNestedReport(waitid); ok {
+		h.skipSyscall(result)
+		return
+	}
+
+	pw := &pendingWait{waitid: waitid, options: h.proc.entryArgs[2]}
+	if waitid {
+		pw.options = h.proc.entryArgs[3]
+	}
+	if pw.options&syscall.WNOHANG != 0 {
+		return
+	}
+	h.proc.pendingWait = pw
+	if waitid {
+		setArg3(h.regs, pw.options|syscall.WNOHANG)
+	} else {
+		setArg2(h.regs, pw.options|syscall.WNOHANG)
+	}
+	ptraceSetRegs(h.proc.pid, h.regs)
+}
+
+func (h *SyscallHandler) handleWaitExit() {
+	pw := h.proc.pendingWait
+	if pw == nil {
+		return
+	}
+	h.proc.pendingWait = nil
+	h.restoreWaitOptions(pw)
+
+	ret := int64(retval(h.regs))
+	found := ret > 0
+	if pw.waitid && ret == 0 {
+		found = h.waitidFoundChild()
+	}
+	if !found {
+		if result, ok := h.collectNestedReport(pw.waitid); ok {
+			setRetval(h.regs, uint64(result))
+		} else if ret != negErrno(syscall.ECHILD) || h.tracer.hasNested(h.proc.threadGroup()) {
+			// Nothing to collect yet: block here until a report arrives or
+			// a real child changes state.
+			debugf("nested: pid=%d blocked in wait", h.proc.pid)
+			h.proc.pendingWait = pw
+			h.proc.parked = true
+		}
+	}
+	ptraceSetRegs(h.proc.pid, h.regs)
+}
+
+func (h *SyscallHandler) restoreWaitOptions(pw *pendingWait) {
+	if pw.waitid {
+		setArg3(h.regs, pw.options)
+	} else {
+		setArg2(h.regs, pw.options)
+	}
+}
+
+func (h *SyscallHandler) waitidFoundChild() bool {
+	infop := uintptr(h.proc.entryArgs[2])
+	if infop == 0 {
+		return false
+	}
+	var pid [4]byte
+	if n, err := ReadBytes(h.proc.pid, infop+16, pid[:]); err != nil || n < len(pid) {
+		return false
+	}
+	return binary.LittleEndian.Uint32(pid[:]) != 0
+}
+
+// collectNestedReport takes a report matching the wait arguments recorded
+// at entry and stores it where the caller expects it. It returns the
+// syscall result.
+func (h *SyscallHandler) collectNestedReport(waitid bool) (int64, bool) {
+	args := h.proc.entryArgs
+	match := func(int) bool { return true }
+	options := args[2]
+	if waitid {
+		options = args[3]
+		if args[0] == P_PID {
+			match = func(pid int) bool { return pid == int(args[1]) }
+		}
+	} else if want := int(int32(args[0])); want > 0 {
+		match = func(pid int) bool { return pid == want }
+	}
+
+	r, ok := h.tracer.takeReport(h.proc.threadGroup(), match, options&WNOWAIT == 0)
+	if !ok {
+		return 0, false
+	}
+	debugf("nested: pid=%d collects status %#x of %d", h.proc.pid, r.status, r.pid)
+
+	if !waitid {
+		if addr := uintptr(args[1]); addr != 0 {
+			var buf [4]byte
+			binary.LittleEndian.PutUint32(buf[:], uint32(r.status))
+			if err := WriteBytes(h.proc.pid, addr, buf[:]); err != nil {
+				return negErrno(syscall.EFAULT), true
+			}
+		}
+		return int64(r.pid), true
+	}
+
+	infop := uintptr(args[2])
+	if infop == 0 {
+		return 0, true
+	}
+	ws := syscall.WaitStatus(r.status)
+	code, status := CLD_TRAPPED, r.status>>8&0xffff
+	switch {
+	case ws.Exited():
+		code, status = CLD_EXITED, ws.ExitStatus()
+	case ws.Signaled() && ws.CoreDump():
+		code, status = CLD_DUMPED, int(ws.Signal())
+	case ws.Signaled():
+		code, status = CLD_KILLED, int(ws.Signal())
+	}
+	info := make([]byte, siginfoSize)
+	binary.LittleEndian.PutUint32(info[0:], uint32(syscall.SIGCHLD))
+	binary.LittleEndian.PutUint32(info[8:], uint32(code))
+	binary.LittleEndian.PutUint32(info[16:], uint32(r.pid))
+	binary.LittleEndian.PutUint32(info[20:], uint32(os.Getuid()))
+	binary.LittleEndian.PutUint32(info[24:], uint32(status))
+	if err := WriteBytes(h.proc.pid, infop, info); err != nil {
+		return negErrno(syscall.EFAULT), true
+	}
+	return 0, true
+}
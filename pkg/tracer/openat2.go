@@ -0,0 +1,284 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// openat2 takes its flags in a struct open_how and can restrict path
+// resolution with RESOLVE_* flags. The kernel would apply those to the
+// rewritten layer path, where they mean something else entirely, so fuss
+// walks the path itself in the namespace the tracee sees, following
+// symlinks through the overlay, and hands the kernel the result without
+// them.
+
+const (
+	RESOLVE_NO_XDEV       = 0x01
+	RESOLVE_NO_MAGICLINKS = 0x02
+	RESOLVE_NO_SYMLINKS   = 0x04
+	RESOLVE_BENEATH       = 0x08
+	RESOLVE_IN_ROOT       = 0x10
+
+	resolveEmulated = RESOLVE_NO_XDEV | RESOLVE_NO_MAGICLINKS | RESOLVE_NO_SYMLINKS |
+		RESOLVE_BENEATH | RESOLVE_IN_ROOT
+
+	// flags, mode and resolve, all u64.
+	openHowSize = 24
+	// Larger structs are extensions the kernel validates itself.
+	maxOpenHowSize = 4096
+
+	maxSymlinkFollows = 40
+)
+
+// errNotEmulated makes the walk give up and leave the syscall to the kernel.
+var errNotEmulated = syscall.ENOSYS
+
+func (h *SyscallHandler) handleOpenat2Entry() {
+	dirfd := int(int32(arg0(h.regs)))
+	pathAddr := uintptr(arg1(h.regs))
+	howAddr := uintptr(arg2(h.regs))
+	size := int(arg3(h.regs))
+	if size < openHowSize || size > maxOpenHowSize {
+		return
+	}
+
+	how := make([]byte, size)
+	if n, err := ReadBytes(h.proc.pid, howAddr, how); err != nil || n < size {
+		return
+	}
+	flags := int(binary.LittleEndian.Uint64(how[0:]))
+	mode := uint32(binary.LittleEndian.Uint64(how[8:]))
+	resolve := binary.LittleEndian.Uint64(how[16:])
+
+	rawPath, err := ReadString(h.proc.pid, pathAddr, 4096)
+	if err != nil || rawPath == "" {
+		return
+	}
+	debugf("openat2: dirfd=%d path=%q flags=0x%x mode=0%o resolve=0x%x", dirfd, rawPath, flags, mode, resolve)
+
+	base, ok := h.proc.cwd, true
+	if dirfd != AT_FDCWD {
+		base, ok = h.proc.fdPaths[dirfd]
+		if !ok {
+			base, ok = h.resolveDirfdPath(dirfd)
+		}
+	}
+	if !ok {
+		return
+	}
+
+	lexical := h.tracer.resolver.ResolveAt(dirfd, rawPath, h.proc.root, h.proc.cwd, map[int]string{dirfd: base})
+	scoped := resolve&(RESOLVE_BENEATH|RESOLVE_IN_ROOT) != 0
+	if !h.tracer.resolver.ShouldIntercept(lexical) &&
+		!(scoped && h.tracer.resolver.ShouldIntercept(base)) {
+		return
+	}
+
+	// O_CREAT|O_EXCL fails with EEXIST on a final symlink rather than
+	// following it.
+	path, err := h.walkOpenat2(base, rawPath, resolve, openFollows(uint64(flags)))
+	if err == errNotEmulated {
+		debugf("openat2: leaving %q to the kernel", rawPath)
+		return
+	}
+	if err != nil {
+		debugf("openat2: resolving %q failed: %v", rawPath, err)
+		h.skipSyscall(errnoFromError(err))
+		return
+	}
+
+	realPath := path
+	var pending *pendingOpen
+	if h.tracer.resolver.ShouldIntercept(path) {
+		vfsPath := h.tracer.resolver.TranslatePath(path)
+		logIntercept(h.proc.entryNr, rawPath, path, vfsPath)
+
+		writeMode := h.deferWriteOpen(vfsPath, flags)
+		if writeMode != 0 {
+			debugf("openat2: deferring copy-up of %q", vfsPath)
+			flags = flags&^syscall.O_ACCMODE | syscall.O_RDONLY
+			binary.LittleEndian.PutUint64(how[0:], uint64(flags))
+		}
+
+		realPath, err = h.resolveForOpen(vfsPath, flags, mode)
+		if err != nil {
+			debugf("openat2: ResolveForOpen failed: %v", err)
+			h.skipSyscall(errnoFromError(err))
+			return
+		}
+		pending = &pendingOpen{
+			path:      path,
+			isDir:     flags&O_DIRECTORY != 0 && flags&O_TMPFILE != O_TMPFILE,
+			vfsPath:   vfsPath,
+			realPath:  realPath,
+			writeMode: writeMode,
+		}
+	}
+	debugf("openat2: resolved to real path %q", realPath)
+
+	newPath, err := h.rewritePathSlot(realPath, 0)
+	if err != nil {
+		return
+	}
+	binary.LittleEndian.PutUint64(how[16:], resolve&^resolveEmulated)
+	newHow := h.scratchAddrFor(len(how), 1)
+	if err := WriteBytes(h.proc.pid, newHow, how); err != nil {
+		debugf("openat2: writing open_how failed: %v", err)
+		return
+	}
+
+	setArg0(h.regs, AT_FDCWD_U64)
+	setArg1(h.regs, uint64(newPath))
+	setArg2(h.regs, uint64(newHow))
+	ptraceSetRegs(h.proc.pid, h.regs)
+	h.proc.pendingOpen = pending
+}
+
+// walkOpenat2 resolves path relative to base the way openat2 would with the
+// given RESOLVE_* flags, and returns the path, as the tracee sees it, that
+// it ends at. A final component that does not exist is fine, as it may be
+// about to be created.
+func (h *SyscallHandler) walkOpenat2(base, path string, resolve uint64, followFinal bool) (string, error) {
+	root := joinRoot(h.proc.root, "/")
+	if resolve&(RESOLVE_BENEATH|RESOLVE_IN_ROOT) != 0 {
+		root = base
+	}
+
+	cur := base
+	if filepath.IsAbs(path) {
+		if resolve&RESOLVE_BENEATH != 0 {
+			return "", syscall.EXDEV
+		}
+		cur = root
+	}
+
+	rest := strings.Split(path, "/")
+	follows := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+
+		var next string
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if cur == root {
+				if resolve&RESOLVE_BENEATH != 0 {
+					return "", syscall.EXDEV
+				}
+				// RESOLVE_IN_ROOT clamps at the root, as does "/".
+				continue
+			}
+			next = filepath.Dir(cur)
+		default:
+			next = filepath.Join(cur, name)
+		}
+
+		if next == "/proc" || strings.HasPrefix(next, "/proc/") {
+			// Magic links can only be followed from the tracee.
+			return "", errNotEmulated
+		}
+		if resolve&RESOLVE_NO_XDEV != 0 && h.crossesMount(cur, next) {
+			return "", syscall.EXDEV
+		}
+		if name == ".." {
+			cur = next
+			continue
+		}
+
+		last := allEmpty(rest)
+		if last && !followFinal {
+			cur = next
+			continue
+		}
+
+		target, isLink, err := h.readlinkVirtual(next)
+		if err != nil {
+			if err == syscall.ENOENT && last {
+				cur = next
+				continue
+			}
+			return "", err
+		}
+		if !isLink {
+			cur = next
+			continue
+		}
+
+		if resolve&RESOLVE_NO_SYMLINKS != 0 {
+			return "", syscall.ELOOP
+		}
+		follows++
+		if follows > maxSymlinkFollows {
+			return "", syscall.ELOOP
+		}
+		if filepath.IsAbs(target) {
+			if resolve&RESOLVE_BENEATH != 0 {
+				return "", syscall.EXDEV
+			}
+			if resolve&RESOLVE_NO_XDEV != 0 && h.crossesMount(cur, root) {
+				return "", syscall.EXDEV
+			}
+			cur = root
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return cur, nil
+}
+
+func allEmpty(components []string) bool {
+	for _, c := range components {
+		if c != "" && c != "." {
+			return false
+		}
+	}
+	return true
+}
+
+// readlinkVirtual reads the symlink at path, looking it up through the
+// overlay if path is under the mountpoint.
+func (h *SyscallHandler) readlinkVirtual(path string) (string, bool, error) {
+	realPath := path
+	if h.tracer.resolver.ShouldIntercept(path) {
+		var err error
+		realPath, err = h.tracer.vfs.ResolveForStat(h.tracer.resolver.TranslatePath(path), false)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(realPath, &st); err != nil {
+		return "", false, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return "", false, nil
+	}
+	buf := make([]byte, 4096)
+	n, err := syscall.Readlink(realPath, buf)
+	if err != nil {
+		return "", false, err
+	}
+	return string(buf[:n]), true, nil
+}
+
+// crossesMount reports whether going from one directory to another crosses
+// a mount in the tracee's view. The whole overlay counts as a single mount,
+// and emulated mounts as the mounts they stand for.
+func (h *SyscallHandler) crossesMount(from, to string) bool {
+	if h.tracer.mountAt(from) != h.tracer.mountAt(to) {
+		return true
+	}
+	fromOverlay := h.tracer.resolver.ShouldIntercept(from)
+	toOverlay := h.tracer.resolver.ShouldIntercept(to)
+	if fromOverlay || toOverlay {
+		return fromOverlay != toOverlay
+	}
+	var a, b syscall.Stat_t
+	if syscall.Stat(from, &a) != nil || syscall.Stat(to, &b) != nil {
+		return false
+	}
+	return a.Dev != b.Dev
+}
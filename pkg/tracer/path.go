@@ -8,6 +8,17 @@ import (
 type PathResolver struct {
 	mountpoint string
 	backing    []string
+	// Bind mounts of paths under the mountpoint, elsewhere or onto other
+	// paths under it, the last one on top.
+	binds []bindMount
+	// Paths under the mountpoint left to the host, as /proc is when the
+	// mountpoint is /.
+	passthrough []string
+}
+
+type bindMount struct {
+	target string
+	source string
 }
 
 func normalizeRoot(path string) string {
@@ -46,6 +57,16 @@ func NewPathResolver(mountpoint string, backing ...string) *PathResolver {
 	return &PathResolver{mountpoint: mp, backing: normalizedBacking}
 }
 
+// Passthrough leaves the given paths, and everything below them, to the
+// host.
+func (r *PathResolver) Passthrough(paths ...string) {
+	for _, path := range paths {
+		if n := normalizeRoot(path); n != "" && n != "/" {
+			r.passthrough = append(r.passthrough, n)
+		}
+	}
+}
+
 func pathWithinRoot(path, root string) (string, bool) {
 	if path == root {
 		return "/", true
@@ -72,6 +93,12 @@ func (r *PathResolver) ShouldIntercept(path string) bool {
 	}
 	absPath = filepath.Clean(absPath)
 
+	for _, root := range r.passthrough {
+		if _, ok := pathWithinRoot(absPath, root); ok {
+			return false
+		}
+	}
+
 	mp := strings.TrimSuffix(r.mountpoint, "/")
 	if absPath == mp {
 		return true
@@ -122,31 +149,128 @@ func (r *PathResolver) TranslatePath(path string) string {
 	return path
 }
 
+// VirtualPath maps a path inside one of the backing roots to where it
+// appears under the mountpoint.
+func (r *PathResolver) VirtualPath(path string) (string, bool) {
+	for _, root := range r.backing {
+		if rel, ok := pathWithinRoot(path, root); ok {
+			return filepath.Join(r.Mountpoint(), rel), true
+		}
+	}
+	return "", false
+}
+
 func (r *PathResolver) Mountpoint() string {
+	if r.mountpoint == "/" {
+		return r.mountpoint
+	}
 	return strings.TrimSuffix(r.mountpoint, "/")
 }
 
-func (r *PathResolver) ResolvePath(cwd string, path string) string {
+// ResolvePath makes path absolute for a process whose root directory is
+// root ("" for the host's) and whose working directory is cwd. ".." does not
+// climb above root, unless cwd is outside it already.
+func (r *PathResolver) ResolvePath(root, cwd, path string) string {
 	if filepath.IsAbs(path) {
-		return filepath.Clean(path)
+		return r.redirect(joinRoot(root, path))
 	}
-	return filepath.Clean(filepath.Join(cwd, path))
+	return r.redirect(r.resolveBelow(root, cwd, path))
 }
 
-func (r *PathResolver) ResolveAt(dirfd int, path string, cwd string, fdPaths map[int]string) string {
+func (r *PathResolver) ResolveAt(dirfd int, path string, root, cwd string, fdPaths map[int]string) string {
 	const AT_FDCWD = -100
 
 	if filepath.IsAbs(path) {
-		return filepath.Clean(path)
+		return r.redirect(joinRoot(root, path))
 	}
 
 	if dirfd == AT_FDCWD {
-		return r.ResolvePath(cwd, path)
+		return r.ResolvePath(root, cwd, path)
 	}
 
 	if basePath, ok := fdPaths[dirfd]; ok {
-		return filepath.Clean(filepath.Join(basePath, path))
+		return r.redirect(r.resolveBelow(root, basePath, path))
+	}
+
+	return r.ResolvePath(root, cwd, path)
+}
+
+func (r *PathResolver) resolveBelow(root, base, path string) string {
+	if root != "" {
+		// Directories opened in a backing layer stand for the path under the
+		// mountpoint, which is where root is.
+		if virtual, ok := r.VirtualPath(base); ok {
+			base = virtual
+		}
+		if rel, ok := pathWithinRoot(base, root); ok {
+			return joinRoot(root, filepath.Join(rel, path))
+		}
+	}
+	return filepath.Clean(filepath.Join(base, path))
+}
+
+// joinRoot returns where the absolute path of a process with the given root
+// directory is on the host.
+func joinRoot(root, path string) string {
+	if root == "" {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(root, filepath.Clean("/"+path))
+}
+
+// rootedPath returns path as a process with the given root directory sees
+// it. Paths outside root are returned as they are.
+func rootedPath(root, path string) string {
+	if root == "" {
+		return path
+	}
+	if rel, ok := pathWithinRoot(path, root); ok {
+		return rel
+	}
+	return path
+}
+
+// ResolveMountTarget resolves path like ResolvePath, except that a bind
+// mount at path itself is not followed.
+func (r *PathResolver) ResolveMountTarget(root, cwd, path string) string {
+	var lexical string
+	if filepath.IsAbs(path) {
+		lexical = joinRoot(root, path)
+	} else {
+		lexical = r.resolveBelow(root, cwd, path)
+	}
+	if lexical == "/" {
+		return lexical
 	}
+	return filepath.Join(r.redirect(filepath.Dir(lexical)), filepath.Base(lexical))
+}
 
-	return r.ResolvePath(cwd, path)
+// Bind shows source at target.
+func (r *PathResolver) Bind(target, source string) {
+	r.binds = append(r.binds, bindMount{target: target, source: source})
+}
+
+// Unbind removes the last bind mount at target.
+func (r *PathResolver) Unbind(target string) {
+	for i := len(r.binds) - 1; i >= 0; i-- {
+		if r.binds[i].target == target {
+			r.binds = append(r.binds[:i], r.binds[i+1:]...)
+			return
+		}
+	}
+}
+
+// redirect maps a path at or below a bind mount target to its source.
+func (r *PathResolver) redirect(path string) string {
+	best := -1
+	for i, b := range r.binds {
+		if _, ok := pathWithinRoot(path, b.target); ok && (best < 0 || len(b.target) >= len(r.binds[best].target)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return path
+	}
+	rel, _ := pathWithinRoot(path, r.binds[best].target)
+	return filepath.Join(r.binds[best].source, rel)
 }
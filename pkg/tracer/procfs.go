@@ -0,0 +1,271 @@
+package tracer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The mount table and memory maps of a traced process are served from a
+// memfd with synthesized content: the mount tables gain an entry for the
+// mountpoint and mapped files are shown under the mountpoint. The open is
+// turned into a memfd_create, and at its exit fuss takes a copy of the new
+// fd with pidfd_getfd, fills it in and seals it. The tracee needs no access
+// to anything of fuss for that.
+
+const (
+	MFD_ALLOW_SEALING = 0x2
+
+	F_ADD_SEALS   = 1033
+	F_SEAL_SEAL   = 0x1
+	F_SEAL_SHRINK = 0x2
+	F_SEAL_GROW   = 0x4
+	F_SEAL_WRITE  = 0x8
+)
+
+// pendingProcFile is the content of a synthesized /proc file the tracee is
+// getting a memfd for.
+type pendingProcFile struct {
+	path string
+	data []byte
+}
+
+// mountDescriber is implemented by filesystems that describe themselves in
+// the synthesized mount tables.
+type mountDescriber interface {
+	MountOptions() string
+}
+
+// procFile returns the content a traced process sees in path, if fuss
+// synthesizes it.
+func (h *SyscallHandler) procFile(path string) ([]byte, bool) {
+	switch path {
+	case "/proc/mounts":
+		path = "/proc/self/mounts"
+	case "/etc/mtab":
+		target, err := os.Readlink(path)
+		if err != nil || !strings.HasSuffix(target, "proc/self/mounts") && !strings.HasSuffix(target, "proc/mounts") {
+			return nil, false
+		}
+		path = "/proc/self/mounts"
+	}
+
+	dir, rest, ok := h.procDir(path)
+	if !ok || len(rest) != 1 {
+		return nil, false
+	}
+	var synthesize func([]byte) []byte
+	switch rest[0] {
+	case "mountinfo":
+		synthesize = h.mountinfo
+	case "mounts":
+		synthesize = h.mounts
+	case "maps":
+		synthesize = h.maps
+	default:
+		return nil, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, rest[0]))
+	if err != nil {
+		return nil, false
+	}
+	return synthesize(data), true
+}
+
+// serveProcFile turns an open of a synthesized /proc file into the
+// memfd_create of one to hold its content. It returns false if path is not
+// one.
+func (h *SyscallHandler) serveProcFile(dirfd int, pathAddr uintptr, flags int) bool {
+	rawPath, err := ReadString(h.proc.pid, pathAddr, 4096)
+	if err != nil || rawPath == "" || (!filepath.IsAbs(rawPath) && dirfd != AT_FDCWD) {
+		return false
+	}
+	path := h.resolvePath(rawPath)
+	data, ok := h.procFile(path)
+	if !ok {
+		return false
+	}
+
+	nameAddr, err := h.rewritePath(pathAddr, "fuss"+strings.ReplaceAll(path, "/", "-"))
+	if err != nil {
+		return false
+	}
+	memfdFlags := uint64(MFD_ALLOW_SEALING)
+	if flags&syscall.O_CLOEXEC != 0 {
+		memfdFlags |= MFD_CLOEXEC
+	}
+	debugf("proc file: serving %q from a memfd", path)
+	setSysno(h.regs, SYS_MEMFD_CREATE)
+	setArg0(h.regs, uint64(nameAddr))
+	setArg1(h.regs, memfdFlags)
+	ptraceSetRegs(h.proc.pid, h.regs)
+	h.proc.pendingProcFile = &pendingProcFile{path: path, data: data}
+	return true
+}
+
+// handleProcFileExit fills in the memfd the tracee got. Writing at an
+// offset leaves the file position the tracee shares with fuss's copy at 0.
+func (h *SyscallHandler) handleProcFileExit() {
+	pending := h.proc.pendingProcFile
+	if pending == nil {
+		return
+	}
+	h.proc.pendingProcFile = nil
+	fd := int(int64(retval(h.regs)))
+	if fd < 0 {
+		return
+	}
+
+	pidfd, err := unix.PidfdOpen(h.proc.pid, 0)
+	if err != nil {
+		debugf("proc file: pidfd_open failed: %v", err)
+		return
+	}
+	defer unix.Close(pidfd)
+	memfd, err := unix.PidfdGetfd(pidfd, fd, 0)
+	if err != nil {
+		debugf("proc file: pidfd_getfd failed: %v", err)
+		return
+	}
+	defer unix.Close(memfd)
+	if _, err := unix.Pwrite(memfd, pending.data, 0); err != nil {
+		debugf("proc file: writing %q failed: %v", pending.path, err)
+		return
+	}
+	unix.FcntlInt(uintptr(memfd), F_ADD_SEALS, F_SEAL_SEAL|F_SEAL_SHRINK|F_SEAL_GROW|F_SEAL_WRITE)
+}
+
+func (h *SyscallHandler) mountOptions() string {
+	opts := "rw"
+	if d, ok := h.tracer.vfs.(mountDescriber); ok {
+		opts += "," + d.MountOptions()
+	}
+	return opts
+}
+
+// mountDev returns the device of the overlay root, which is what stat
+// reports for the mountpoint.
+func (h *SyscallHandler) mountDev() (major, minor uint32) {
+	realPath, err := h.tracer.vfs.ResolvePath("/")
+	if err != nil {
+		return 0, 0
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(realPath, &st); err != nil {
+		return 0, 0
+	}
+	return unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev))
+}
+
+// mountinfo appends the overlay to a mountinfo table, below the mount that
+// contains the mountpoint.
+func (h *SyscallHandler) mountinfo(data []byte) []byte {
+	mountpoint := h.tracer.resolver.Mountpoint()
+	maxID, parentID, parentLen := 0, 0, -1
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		maxID = max(maxID, id)
+		target := unescapeMountPath(fields[4])
+		if _, ok := pathWithinRoot(mountpoint, strings.TrimSuffix(target, "/")); ok && len(target) > parentLen {
+			parentID, parentLen = id, len(target)
+		}
+	}
+
+	major, minor := h.mountDev()
+	entry := fmt.Sprintf("%d %d %d:%d / %s rw,relatime - overlay fuss %s\n",
+		maxID+1, parentID, major, minor, escapeMountPath(mountpoint), escapeMountPath(h.mountOptions()))
+	data = append(data, entry...)
+
+	// Emulated mounts are stacked on the overlay in the order they were made.
+	for i, m := range h.tracer.mounts {
+		fstype, source, root := h.tracer.describeMount(m)
+		entry := fmt.Sprintf("%d %d 0:0 %s %s rw,relatime - %s %s %s\n",
+			maxID+2+i, maxID+1, escapeMountPath(root), escapeMountPath(rootedPath(h.proc.root, m.target)),
+			fstype, escapeMountPath(source), escapeMountPath(m.options()))
+		data = append(data, entry...)
+	}
+	return data
+}
+
+func (h *SyscallHandler) mounts(data []byte) []byte {
+	entry := fmt.Sprintf("fuss %s overlay %s 0 0\n",
+		escapeMountPath(h.tracer.resolver.Mountpoint()), escapeMountPath(h.mountOptions()))
+	data = append(data, entry...)
+	for _, m := range h.tracer.mounts {
+		fstype, source, _ := h.tracer.describeMount(m)
+		entry := fmt.Sprintf("%s %s %s %s 0 0\n", escapeMountPath(source),
+			escapeMountPath(rootedPath(h.proc.root, m.target)), fstype, escapeMountPath(m.options()))
+		data = append(data, entry...)
+	}
+	return data
+}
+
+// maps shows files mapped from a backing layer under the mountpoint.
+func (h *SyscallHandler) maps(data []byte) []byte {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, " /"); i >= 0 {
+			realPath, deleted := strings.CutSuffix(line[i+1:], " (deleted)")
+			if virtual, ok := h.tracer.resolver.VirtualPath(realPath); ok {
+				line = line[:i+1] + rootedPath(h.proc.root, virtual)
+				if deleted {
+					line += " (deleted)"
+				}
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// escapeMountPath escapes the characters the kernel escapes in mount
+// tables.
+func escapeMountPath(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch c {
+		case ' ', '\t', '\n', '\\':
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,128 @@
+package tracer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The kernel answers readlink of /proc/<pid>/fd/N, cwd and exe with the
+// real path in the upper or a lower layer, which lets a tracee compute paths
+// outside the mountpoint. For traced processes fuss answers with the path
+// under the mountpoint instead, and paths continuing below such a link are
+// resolved through the overlay. The links themselves are left to the kernel
+// when opened, so reopening an fd keeps working.
+
+// procDir splits path into the /proc directory of a traced process it
+// starts with, rewritten in terms of the tracee's pid, and the components
+// after it.
+func (h *SyscallHandler) procDir(path string) (dir string, rest []string, ok bool) {
+	after, ok := strings.CutPrefix(path, "/proc/")
+	if !ok {
+		return "", nil, false
+	}
+	parts := strings.Split(after, "/")
+
+	switch parts[0] {
+	case "self":
+		dir = fmt.Sprintf("/proc/%d", h.proc.pid)
+	case "thread-self":
+		dir = fmt.Sprintf("/proc/%d/task/%d", h.proc.pid, h.proc.pid)
+	default:
+		pid, err := strconv.Atoi(parts[0])
+		if err != nil || h.tracer.procs[pid] == nil {
+			return "", nil, false
+		}
+		dir = "/proc/" + parts[0]
+	}
+	parts = parts[1:]
+	if len(parts) >= 2 && parts[0] == "task" {
+		tid, err := strconv.Atoi(parts[1])
+		if err != nil || h.tracer.procs[tid] == nil {
+			return "", nil, false
+		}
+		dir += "/task/" + parts[1]
+		parts = parts[2:]
+	}
+	return dir, parts, true
+}
+
+// procLink splits path into the /proc magic link of a traced process it
+// starts with, rewritten in terms of the tracee's pid, and the rest.
+func (h *SyscallHandler) procLink(path string) (link, rest string, ok bool) {
+	base, parts, ok := h.procDir(path)
+	if !ok {
+		return "", "", false
+	}
+
+	n := 1
+	switch {
+	case len(parts) >= 1 && (parts[0] == "cwd" || parts[0] == "exe"):
+	case len(parts) >= 2 && parts[0] == "fd":
+		if _, err := strconv.Atoi(parts[1]); err != nil {
+			return "", "", false
+		}
+		n = 2
+	default:
+		return "", "", false
+	}
+
+	link = base + "/" + strings.Join(parts[:n], "/")
+	if len(parts) > n {
+		rest = "/" + strings.Join(parts[n:], "/")
+	}
+	return link, rest, true
+}
+
+// procLinkTarget returns the target of link under the mountpoint, if it
+// points into a backing layer.
+func (h *SyscallHandler) procLinkTarget(link string) (target string, deleted, ok bool) {
+	realPath, err := os.Readlink(link)
+	if err != nil {
+		return "", false, false
+	}
+	realPath, deleted = strings.CutSuffix(realPath, " (deleted)")
+	target, ok = h.tracer.resolver.VirtualPath(realPath)
+	return target, deleted, ok
+}
+
+// readProcLink answers readlink of a magic link whose target is in a
+// backing layer. It returns false if the kernel should handle the call.
+func (h *SyscallHandler) readProcLink(spec syscallSpec) bool {
+	path, err := ReadString(h.proc.pid, uintptr(argN(h.regs, spec.path)), 4096)
+	if err != nil || !filepath.IsAbs(path) {
+		return false
+	}
+	link, rest, ok := h.procLink(filepath.Clean(path))
+	if !ok || rest != "" {
+		return false
+	}
+	target, deleted, ok := h.procLinkTarget(link)
+	if !ok {
+		return false
+	}
+	target = rootedPath(h.proc.root, target)
+	if deleted {
+		target += " (deleted)"
+	}
+
+	bufAddr := uintptr(argN(h.regs, spec.path+1))
+	size := int(int32(argN(h.regs, spec.path+2)))
+	if size <= 0 {
+		return false
+	}
+	data := []byte(target)
+	if len(data) > size {
+		data = data[:size]
+	}
+	if err := WriteBytes(h.proc.pid, bufAddr, data); err != nil {
+		h.skipSyscall(negErrno(syscall.EFAULT))
+		return true
+	}
+	debugf("readlink: %q -> %q", path, target)
+	h.skipSyscall(int64(len(data)))
+	return true
+}
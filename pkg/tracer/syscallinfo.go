@@ -0,0 +1,65 @@
+package tracer
+
+import (
+	"encoding/binary"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	PTRACE_GET_SYSCALL_INFO = 0x420e
+
+	PTRACE_SYSCALL_INFO_NONE    = 0
+	PTRACE_SYSCALL_INFO_ENTRY   = 1
+	PTRACE_SYSCALL_INFO_EXIT    = 2
+	PTRACE_SYSCALL_INFO_SECCOMP = 3
+
+	// sizeof(struct ptrace_syscall_info) including the seccomp variant.
+	syscallInfoSize = 88
+)
+
+// syscallInfo mirrors the parts of struct ptrace_syscall_info fuss relies on.
+type syscallInfo struct {
+	op      uint8
+	arch    uint32
+	nr      uint64
+	args    [6]uint64
+	rval    int64
+	isError bool
+}
+
+func getSyscallInfo(pid int) (*syscallInfo, error) {
+	var buf [syscallInfoSize]byte
+	n, _, errno := syscall.Syscall6(
+		syscall.SYS_PTRACE,
+		PTRACE_GET_SYSCALL_INFO,
+		uintptr(pid),
+		uintptr(len(buf)),
+		uintptr(unsafe.Pointer(&buf[0])),
+		0, 0,
+	)
+	if errno != 0 {
+		return nil, errno
+	}
+	if n < 24 {
+		return nil, syscall.EIO
+	}
+
+	info := &syscallInfo{
+		op:   buf[0],
+		arch: binary.LittleEndian.Uint32(buf[4:]),
+	}
+
+	switch info.op {
+	case PTRACE_SYSCALL_INFO_ENTRY, PTRACE_SYSCALL_INFO_SECCOMP:
+		info.nr = binary.LittleEndian.Uint64(buf[24:])
+		for i := range info.args {
+			info.args[i] = binary.LittleEndian.Uint64(buf[32+8*i:])
+		}
+	case PTRACE_SYSCALL_INFO_EXIT:
+		info.rval = int64(binary.LittleEndian.Uint64(buf[24:]))
+		info.isError = buf[32] != 0
+	}
+
+	return info, nil
+}
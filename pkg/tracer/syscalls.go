@@ -0,0 +1,182 @@
+package tracer
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// The per-arch syscallDefs name every syscall fuss knows, for logging.
+// Those whose only job for fuss is to resolve one path argument through the
+// VFS also carry a syscallSpec and are handled by handlePathEntry; everything
+// else has a dedicated handler. syscallTable and syscallNames are built from
+// the one list.
+
+type pathOp int
+
+const (
+	opResolve  pathOp = iota // ResolvePath
+	opReadlink               // ResolvePath, answering /proc magic links itself
+	opStat                   // ResolveForStat, following symlinks
+	opLstat                  // ResolveForStat, not following symlinks
+	opCreate                 // PrepareCreate
+	opWrite                  // PrepareWrite
+	opSymlink                // PrepareSymlink
+	opWatch                  // WatchPaths, or ResolveForStat like opStat
+)
+
+// none marks an argument a syscall does not have.
+const none = -1
+
+const (
+	IN_DONT_FOLLOW       = 0x02000000
+	FAN_MARK_ADD         = 0x01
+	FAN_MARK_REMOVE      = 0x02
+	FAN_MARK_DONT_FOLLOW = 0x04
+	FAN_MARK_FLUSH       = 0x80
+)
+
+type syscallSpec struct {
+	dirfd int // argument holding the dirfd, or none for AT_FDCWD
+	path  int
+	flags int
+	// Flag that inverts the op's symlink handling, e.g. AT_SYMLINK_NOFOLLOW
+	// for opStat or AT_SYMLINK_FOLLOW for opLstat.
+	symlink uint64
+	op      pathOp
+	// A NULL path, or an empty one with AT_EMPTY_PATH, makes the syscall
+	// modify dirfd itself.
+	onFd bool
+}
+
+type syscallDef struct {
+	nr   uint64
+	name string
+	spec *syscallSpec // nil unless handlePathEntry serves the syscall
+}
+
+var syscallTable, syscallNames = indexSyscalls(syscallDefs)
+
+func indexSyscalls(defs []syscallDef) (map[uint64]syscallSpec, map[uint64]string) {
+	table := make(map[uint64]syscallSpec)
+	names := make(map[uint64]string, len(defs))
+	for _, def := range defs {
+		names[def.nr] = def.name
+		if def.spec != nil {
+			table[def.nr] = *def.spec
+		}
+	}
+	return table, names
+}
+
+func syscallName(nr uint64) string {
+	if name, ok := syscallNames[nr]; ok {
+		return name
+	}
+	return fmt.Sprintf("sys_%d", nr)
+}
+
+func (h *SyscallHandler) handlePathEntry(spec syscallSpec) {
+	dirfd := AT_FDCWD
+	if spec.dirfd != none {
+		dirfd = int(int32(argN(h.regs, spec.dirfd)))
+	}
+	pathAddr := uintptr(argN(h.regs, spec.path))
+	var flags uint64
+	if spec.flags != none {
+		flags = argN(h.regs, spec.flags)
+	}
+
+	if spec.op == opReadlink && h.readProcLink(spec) {
+		return
+	}
+	if spec.onFd && h.fdOnly(pathAddr, int(flags)) {
+		h.handleFdMutationEntry(dirfd)
+		return
+	}
+
+	vfsPath, intercept := h.readPathAt(dirfd, pathAddr)
+	if !intercept {
+		if spec.op == opStat || spec.op == opLstat {
+			h.handleMountParentStatEntry(dirfd, pathAddr)
+		}
+		return
+	}
+
+	inverted := spec.symlink != 0 && flags&spec.symlink != 0
+	var realPath string
+	var paths []string
+	var upperMissing bool
+	var err error
+	switch spec.op {
+	case opResolve, opReadlink:
+		realPath, err = h.tracer.vfs.ResolvePath(vfsPath)
+	case opStat:
+		realPath, err = h.tracer.vfs.ResolveForStat(vfsPath, !inverted)
+	case opLstat:
+		realPath, err = h.tracer.vfs.ResolveForStat(vfsPath, inverted)
+	case opCreate:
+		realPath, err = h.tracer.vfs.PrepareCreate(vfsPath)
+	case opWrite:
+		realPath, err = h.tracer.vfs.PrepareWrite(vfsPath)
+	case opSymlink:
+		realPath, err = h.tracer.vfs.PrepareSymlink(vfsPath)
+	case opWatch:
+		paths, upperMissing, err = h.watchPaths(vfsPath, !inverted)
+		if err == nil {
+			realPath = paths[0]
+		}
+	}
+	if err != nil {
+		h.skipSyscall(errnoFromError(err))
+		return
+	}
+
+	newAddr, err := h.rewritePath(pathAddr, realPath)
+	if err != nil {
+		return
+	}
+	setArgN(h.regs, spec.path, uint64(newAddr))
+	if spec.dirfd != none {
+		setArgN(h.regs, spec.dirfd, AT_FDCWD_U64)
+	}
+	ptraceSetRegs(h.proc.pid, h.regs)
+
+	if spec.op == opWatch {
+		h.startWatch(spec, vfsPath, paths, upperMissing)
+	}
+}
+
+func argN(regs *syscall.PtraceRegs, n int) uint64 {
+	switch n {
+	case 0:
+		return arg0(regs)
+	case 1:
+		return arg1(regs)
+	case 2:
+		return arg2(regs)
+	case 3:
+		return arg3(regs)
+	case 4:
+		return arg4(regs)
+	case 5:
+		return arg5(regs)
+	}
+	return 0
+}
+
+func setArgN(regs *syscall.PtraceRegs, n int, v uint64) {
+	switch n {
+	case 0:
+		setArg0(regs, v)
+	case 1:
+		setArg1(regs, v)
+	case 2:
+		setArg2(regs, v)
+	case 3:
+		setArg3(regs, v)
+	case 4:
+		setArg4(regs, v)
+	case 5:
+		setArg5(regs, v)
+	}
+}
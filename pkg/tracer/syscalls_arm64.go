@@ -0,0 +1,92 @@
+package tracer
+
+var syscallDefs = []syscallDef{
+	{nr: SYS_SETXATTR, name: "setxattr"},
+	{nr: SYS_LSETXATTR, name: "lsetxattr"},
+	{nr: SYS_FSETXATTR, name: "fsetxattr"},
+	{nr: SYS_GETXATTR, name: "getxattr"},
+	{nr: SYS_GETCWD, name: "getcwd"},
+	{nr: SYS_LGETXATTR, name: "lgetxattr"},
+	{nr: SYS_FGETXATTR, name: "fgetxattr"},
+	{nr: SYS_LISTXATTR, name: "listxattr"},
+	{nr: SYS_LLISTXATTR, name: "llistxattr"},
+	{nr: SYS_FLISTXATTR, name: "flistxattr"},
+	{nr: SYS_REMOVEXATTR, name: "removexattr"},
+	{nr: SYS_LREMOVEXATTR, name: "lremovexattr"},
+	{nr: SYS_FREMOVEXATTR, name: "fremovexattr"},
+	{nr: SYS_DUP, name: "dup"},
+	{nr: SYS_DUP3, name: "dup3"},
+	{nr: SYS_FCNTL, name: "fcntl"},
+	{nr: SYS_INOTIFY_ADD_WATCH, name: "inotify_add_watch", spec: &syscallSpec{dirfd: none, path: 1, flags: 2, symlink: IN_DONT_FOLLOW, op: opWatch}},
+	{nr: SYS_INOTIFY_RM_WATCH, name: "inotify_rm_watch"},
+	{nr: SYS_MKNODAT, name: "mknodat", spec: &syscallSpec{dirfd: 0, path: 1, flags: none, op: opCreate}},
+	{nr: SYS_MKDIRAT, name: "mkdirat", spec: &syscallSpec{dirfd: 0, path: 1, flags: none, op: opCreate}},
+	{nr: SYS_UNLINKAT, name: "unlinkat"},
+	{nr: SYS_SYMLINKAT, name: "symlinkat", spec: &syscallSpec{dirfd: 1, path: 2, flags: none, op: opSymlink}},
+	{nr: SYS_LINKAT, name: "linkat"},
+	{nr: SYS_RENAMEAT, name: "renameat"},
+	{nr: SYS_UMOUNT2, name: "umount2"},
+	{nr: SYS_MOUNT, name: "mount"},
+	{nr: SYS_PIVOT_ROOT, name: "pivot_root"},
+	{nr: SYS_CHROOT, name: "chroot"},
+	{nr: SYS_BIND, name: "bind"},
+	{nr: SYS_ACCEPT, name: "accept"},
+	{nr: SYS_CONNECT, name: "connect"},
+	{nr: SYS_GETSOCKNAME, name: "getsockname"},
+	{nr: SYS_GETPEERNAME, name: "getpeername"},
+	{nr: SYS_SENDTO, name: "sendto"},
+	{nr: SYS_RECVFROM, name: "recvfrom"},
+	{nr: SYS_SENDMSG, name: "sendmsg"},
+	{nr: SYS_RECVMSG, name: "recvmsg"},
+	{nr: SYS_ACCEPT4, name: "accept4"},
+	{nr: SYS_RENAMEAT2, name: "renameat2"},
+	{nr: SYS_FTRUNCATE, name: "ftruncate"},
+	{nr: SYS_FALLOCATE, name: "fallocate"},
+	{nr: SYS_STATFS, name: "statfs", spec: &syscallSpec{dirfd: none, path: 0, flags: none, op: opStat}},
+	{nr: SYS_CHDIR, name: "chdir"},
+	{nr: SYS_FCHDIR, name: "fchdir"},
+	{nr: SYS_FACCESSAT, name: "faccessat", spec: &syscallSpec{dirfd: 0, path: 1, flags: none, op: opResolve}},
+	{nr: SYS_FCHMOD, name: "fchmod"},
+	{nr: SYS_FCHMODAT, name: "fchmodat", spec: &syscallSpec{dirfd: 0, path: 1, flags: none, op: opWrite}},
+	{nr: SYS_FCHOWNAT, name: "fchownat", spec: &syscallSpec{dirfd: 0, path: 1, flags: 4, op: opWrite, onFd: true}},
+	{nr: SYS_FCHOWN, name: "fchown"},
+	{nr: SYS_OPENAT, name: "openat"},
+	{nr: SYS_CLOSE, name: "close"},
+	{nr: SYS_GETDENTS64, name: "getdents64"},
+	{nr: SYS_LSEEK, name: "lseek"},
+	{nr: SYS_READ, name: "read"},
+	{nr: SYS_WRITE, name: "write"},
+	{nr: SYS_WRITEV, name: "writev"},
+	{nr: SYS_PWRITE64, name: "pwrite64"},
+	{nr: SYS_PWRITEV, name: "pwritev"},
+	{nr: SYS_SENDFILE, name: "sendfile"},
+	{nr: SYS_VMSPLICE, name: "vmsplice"},
+	{nr: SYS_SPLICE, name: "splice"},
+	{nr: SYS_READLINKAT, name: "readlinkat", spec: &syscallSpec{dirfd: 0, path: 1, flags: none, op: opReadlink}},
+	{nr: SYS_NEWFSTATAT, name: "newfstatat", spec: &syscallSpec{dirfd: 0, path: 1, flags: 3, symlink: AT_SYMLINK_NOFOLLOW, op: opStat}},
+	{nr: SYS_FSTAT, name: "fstat"},
+	{nr: SYS_UTIMENSAT, name: "utimensat", spec: &syscallSpec{dirfd: 0, path: 1, flags: 3, op: opWrite, onFd: true}},
+	{nr: SYS_WAITID, name: "waitid"},
+	{nr: SYS_PTRACE, name: "ptrace"},
+	{nr: SYS_GETPID, name: "getpid"},
+	{nr: SYS_EXECVE, name: "execve"},
+	{nr: SYS_MMAP, name: "mmap"},
+	{nr: SYS_MPROTECT, name: "mprotect"},
+	{nr: SYS_WAIT4, name: "wait4"},
+	{nr: SYS_FANOTIFY_MARK, name: "fanotify_mark", spec: &syscallSpec{dirfd: 3, path: 4, flags: 1, symlink: FAN_MARK_DONT_FOLLOW, op: opWatch}},
+	{nr: SYS_NAME_TO_HANDLE_AT, name: "name_to_handle_at", spec: &syscallSpec{dirfd: 0, path: 1, flags: 4, symlink: AT_SYMLINK_FOLLOW, op: opLstat}},
+	{nr: SYS_MEMFD_CREATE, name: "memfd_create"},
+	{nr: SYS_EXECVEAT, name: "execveat"},
+	{nr: SYS_COPY_FILE_RANGE, name: "copy_file_range"},
+	{nr: SYS_PWRITEV2, name: "pwritev2"},
+	{nr: SYS_PKEY_MPROTECT, name: "pkey_mprotect"},
+	{nr: SYS_STATX, name: "statx", spec: &syscallSpec{dirfd: 0, path: 1, flags: 2, symlink: AT_SYMLINK_NOFOLLOW, op: opStat}},
+	{nr: SYS_OPEN_TREE, name: "open_tree"},
+	{nr: SYS_MOVE_MOUNT, name: "move_mount"},
+	{nr: SYS_FSOPEN, name: "fsopen"},
+	{nr: SYS_FSCONFIG, name: "fsconfig"},
+	{nr: SYS_FSMOUNT, name: "fsmount"},
+	{nr: SYS_OPENAT2, name: "openat2"},
+	{nr: SYS_FACCESSAT2, name: "faccessat2", spec: &syscallSpec{dirfd: 0, path: 1, flags: 3, op: opResolve}},
+	{nr: SYS_FCHMODAT2, name: "fchmodat2", spec: &syscallSpec{dirfd: 0, path: 1, flags: 3, op: opWrite, onFd: true}},
+}
@@ -0,0 +1,152 @@
+package tracer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/psarna/fuss/pkg/vfs"
+)
+
+// Atomic writes create an anonymous file with O_TMPFILE and give it a name
+// with linkat(fd, "", ..., AT_EMPTY_PATH) or by linking /proc/self/fd/N.
+// The anonymous file is created in the upper copy of its directory, so it
+// only takes translating the new name into the upper layer to link it.
+
+const (
+	AT_SYMLINK_FOLLOW = 0x400
+	O_TMPFILE         = 020000000 | syscall.O_DIRECTORY
+)
+
+// resolveForOpen resolves an open or openat of vfsPath. For O_TMPFILE the
+// path names the directory the file is created in, which is copied up.
+func (h *SyscallHandler) resolveForOpen(vfsPath string, flags int, mode uint32) (string, error) {
+	if flags&O_TMPFILE == O_TMPFILE {
+		return h.tracer.vfs.PrepareWrite(vfsPath)
+	}
+	return h.tracer.vfs.ResolveForOpen(vfsPath, vfs.OpenFlags(flags), mode)
+}
+
+// handleLinkFdEntry handles a linkat whose source is an open fd rather than
+// a path. It returns false if the source is a path.
+func (h *SyscallHandler) handleLinkFdEntry(oldDirfd int, oldPathAddr uintptr, newDirfd int, newPathAddr uintptr, flags int) bool {
+	fd, ok := h.linkSourceFd(oldDirfd, oldPathAddr, flags)
+	if !ok {
+		return false
+	}
+
+	newVfsPath, newIntercept, newReadable := h.readPathAtDetailed(newDirfd, newPathAddr)
+	if !newReadable {
+		return true
+	}
+	path, tracked := h.proc.fdPaths[fd]
+	oldIntercept := tracked && h.tracer.resolver.ShouldIntercept(path)
+	if !oldIntercept && !newIntercept {
+		return true
+	}
+	if oldIntercept != newIntercept {
+		h.skipSyscall(negErrno(syscall.EXDEV))
+		return true
+	}
+
+	target, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", h.proc.pid, fd))
+	if err != nil {
+		return true
+	}
+
+	if isTmpfile(target) {
+		// Already in the upper layer.
+		if _, err := h.tracer.vfs.ResolvePath(newVfsPath); err == nil {
+			h.skipSyscall(negErrno(syscall.EEXIST))
+			return true
+		}
+		newReal, err := h.tracer.vfs.PrepareCreate(newVfsPath)
+		if err != nil {
+			h.skipSyscall(errnoFromError(err))
+			return true
+		}
+		debugf("linkat: materializing fd=%d at %q", fd, newReal)
+		newAddr, err := h.rewritePathSlot(newReal, 1)
+		if err != nil {
+			return true
+		}
+		setArg2(h.regs, AT_FDCWD_U64)
+		setArg3(h.regs, uint64(newAddr))
+		ptraceSetRegs(h.proc.pid, h.regs)
+		return true
+	}
+
+	// A named file, which may still be in a lower layer: link it by path.
+	oldVfsPath := h.tracer.resolver.TranslatePath(path)
+	oldReal, newReal, err := h.tracer.vfs.PrepareLink(oldVfsPath, newVfsPath)
+	if err != nil {
+		h.skipSyscall(errnoFromError(err))
+		return true
+	}
+	oldAddr, err := h.rewritePathSlot(oldReal, 0)
+	if err != nil {
+		return true
+	}
+	newAddr, err := h.rewritePathSlot(newReal, 1)
+	if err != nil {
+		return true
+	}
+	setArg0(h.regs, AT_FDCWD_U64)
+	setArg1(h.regs, uint64(oldAddr))
+	setArg2(h.regs, AT_FDCWD_U64)
+	setArg3(h.regs, uint64(newAddr))
+	setArg4(h.regs, uint64(flags&^(AT_EMPTY_PATH|AT_SYMLINK_FOLLOW)))
+	ptraceSetRegs(h.proc.pid, h.regs)
+	return true
+}
+
+// linkSourceFd returns the fd a linkat source refers to: dirfd itself with
+// an empty path and AT_EMPTY_PATH, or N for /proc/self/fd/N.
+func (h *SyscallHandler) linkSourceFd(dirfd int, pathAddr uintptr, flags int) (int, bool) {
+	path, err := ReadString(h.proc.pid, pathAddr, 4096)
+	if err != nil {
+		return 0, false
+	}
+	if path == "" {
+		return dirfd, flags&AT_EMPTY_PATH != 0
+	}
+	if flags&AT_SYMLINK_FOLLOW == 0 {
+		return 0, false
+	}
+
+	rest, ok := strings.CutPrefix(path, "/proc/")
+	if !ok {
+		return 0, false
+	}
+	owner, rest, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, false
+	}
+	switch owner {
+	case "self", "thread-self":
+	default:
+		pid, err := strconv.Atoi(owner)
+		if err != nil || (pid != h.proc.pid && pid != h.proc.threadGroup()) {
+			return 0, false
+		}
+	}
+	num, ok := strings.CutPrefix(rest, "fd/")
+	if !ok {
+		return 0, false
+	}
+	fd, err := strconv.Atoi(num)
+	if err != nil || fd < 0 {
+		return 0, false
+	}
+	return fd, true
+}
+
+// isTmpfile reports whether an fd link target is an anonymous O_TMPFILE
+// file, which the kernel names "#<inode>" inside its directory.
+func isTmpfile(target string) bool {
+	target, ok := strings.CutSuffix(target, " (deleted)")
+	return ok && strings.HasPrefix(filepath.Base(target), "#")
+}
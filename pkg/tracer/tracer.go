@@ -4,10 +4,14 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/psarna/fuss/pkg/vfs"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -17,6 +21,12 @@ const (
 	PTRACE_O_TRACECLONE   = 0x00000008
 	PTRACE_O_TRACEEXEC    = 0x00000010
 
+	PTRACE_SEIZE     = 0x4206
+	PTRACE_INTERRUPT = 0x4207
+	PTRACE_LISTEN    = 0x4208
+
+	PTRACE_EVENT_STOP = 128
+
 	SIGTRAP_MASK = 0x80
 )
 
@@ -25,6 +35,45 @@ type Tracer struct {
 	resolver *PathResolver
 	fdTable  *FDTable
 	procs    map[int]*ProcessState
+
+	// Set when the kernel lacks PTRACE_GET_SYSCALL_INFO (pre-5.3); entry and
+	// exit stops are then told apart by toggling ProcessState.inSyscall.
+	noSyscallInfo bool
+
+	// Mirror group-stops of the main child onto fuss itself (run mode only;
+	// an attached tree belongs to someone else's job).
+	followStops bool
+	// Set when the main child was made the terminal's foreground job.
+	ownsTerminal bool
+
+	waitPolicy WaitPolicy
+	killing    bool
+
+	// Serve write-opens of lower-layer files read-only and copy them up on
+	// the first write through the fd.
+	deferCopyUp bool
+
+	// Directories of unix sockets whose real path is too long for
+	// sun_path, with the symlinks to them in sockLinkDir.
+	sockDirs    map[string]string
+	sockLinkDir string
+
+	// Mounts emulated for tracees, in the order they were made.
+	mounts []*virtualMount
+	// Directories of unmounted tmpfs mounts that were still shown
+	// elsewhere, removed at the end of the session.
+	unmountedTmpDirs []string
+	// Set once tracees are released alive, by a detach or the main wait
+	// policy. The directories backing their mounts are then kept.
+	detached bool
+
+	// Emulated ptrace relationships between tracees, and wait statuses
+	// their emulated tracers have yet to collect, keyed by tracer tgid.
+	nested        map[int]*nestedTracee
+	nestedReports map[int][]nestedReport
+
+	detachRequested atomic.Bool
+	wakePid         atomic.Int64
 }
 
 type ChildExitError struct {
@@ -47,9 +96,11 @@ func (e *ChildExitError) ExitCode() int {
 }
 
 type pendingOpen struct {
-	path    string
-	isDir   bool
-	vfsPath string
+	path      string
+	isDir     bool
+	vfsPath   string
+	realPath  string
+	writeMode int
 }
 
 type pendingDup struct {
@@ -67,6 +118,7 @@ type pendingGetdents struct {
 	bufAddr uintptr
 	count   int
 	vfsPath string
+	format  direntFormat
 }
 
 type pendingRemove struct {
@@ -75,27 +127,99 @@ type pendingRemove struct {
 	needsWhiteout bool
 }
 
+type pendingRename struct {
+	oldVfsPath string
+	newVfsPath string
+	flags      uint
+}
+
+type pendingXattrList struct {
+	bufAddr uintptr
+	size    uint64
+}
+
 type ProcessState struct {
-	pid             int
-	inSyscall       bool
-	cwd             string
-	fdPaths         map[int]string
-	pendingOpen     *pendingOpen
-	pendingDup      *pendingDup
-	pendingChdir    *pendingChdir
-	pendingGetdents *pendingGetdents
-	pendingRemove   *pendingRemove
-	attached        bool
-	skipResult      *int64
+	pid       int
+	inSyscall bool
+	entryNr   uint64
+	entryArgs [6]uint64
+	cwd       string
+	// Root directory set by an emulated chroot or pivot_root, "" for the
+	// host's. cwd and fdPaths are host paths all the same.
+	root    string
+	fdPaths map[int]string
+	// Backing file each intercepted fd was opened on.
+	fdReal map[int]string
+	// Access mode originally requested for fds opened read-only pending a
+	// deferred copy-up.
+	fdWriteMode map[int]int
+	// Watch descriptors of inotify fds with watches on overlay paths.
+	inotify map[int]*inotifyWatches
+	// Marks of fanotify fds still to be placed on upper copies.
+	fanotify           map[int]*fanotifyMarks
+	pendingOpen        *pendingOpen
+	pendingDup         *pendingDup
+	pendingChdir       *pendingChdir
+	pendingGetdents    *pendingGetdents
+	pendingRemove      *pendingRemove
+	pendingRename      *pendingRename
+	pendingXattrList   *pendingXattrList
+	skipResult         *int64
+	fdSwap             *fdSwap
+	pendingWatch       *watchSpread
+	watchSpread        *watchSpread
+	pendingInotifyRead *pendingInotifyRead
+	// Synthesized /proc content the tracee is getting a memfd for.
+	pendingProcFile    *pendingProcFile
+	pendingMountParent *pendingMountParent
+	// Directory fds that have had the mount entries appended since the
+	// last seek.
+	splicedDirs     map[int]bool
+	pendingSockaddr *pendingSockaddr
+	// fds standing for mounts created with the new mount API that are not
+	// attached yet.
+	mountFds       map[int]*virtualMount
+	pendingMountFd *virtualMount
+	pendingWait    *pendingWait
+	// The arguments of a socketcall expanded into the direct syscall.
+	socketcallArgs *[6]uint64
+	// Scratch space below 4GB for i386 syscalls made from 64-bit code,
+	// mapped for the process by lowScratchMap, and whether that was tried.
+	lowScratch      uintptr
+	lowScratchTried bool
+	lowScratchMap   *lowScratchMap
+	tgid            int
+	// Left in its ptrace-stop on behalf of an emulated tracer or a blocked
+	// wait; the trace loop must not resume it.
+	parked bool
 }
 
 func NewTracer(v vfs.VFS, mountpoint string, backingPaths ...string) *Tracer {
-	return &Tracer{
+	t := &Tracer{
 		vfs:      v,
 		resolver: NewPathResolver(mountpoint, backingPaths...),
 		fdTable:  NewFDTable(),
 		procs:    make(map[int]*ProcessState),
+		sockDirs: make(map[string]string),
+
+		nested:        make(map[int]*nestedTracee),
+		nestedReports: make(map[int][]nestedReport),
+	}
+	if n, ok := v.(copyUpNotifier); ok {
+		n.OnCopyUp(t.watchCopyUp)
 	}
+	return t
+}
+
+// SetDeferCopyUp makes write-opens of lower-layer files copy up lazily, on
+// the first write, mmap(PROT_WRITE, MAP_SHARED) or truncation through the fd.
+func (t *Tracer) SetDeferCopyUp(on bool) {
+	t.deferCopyUp = on
+}
+
+// SetPassthrough leaves paths under the mountpoint to the host.
+func (t *Tracer) SetPassthrough(paths ...string) {
+	t.resolver.Passthrough(paths...)
 }
 
 func (t *Tracer) Run(args []string) error {
@@ -106,8 +230,13 @@ func (t *Tracer) Run(args []string) error {
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	// The child gets its own process group so signals can be forwarded to
+	// it as a whole. If fuss owns the terminal, the child takes it over.
+	t.ownsTerminal = isForeground()
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Ptrace: true,
+		Ptrace:     true,
+		Setpgid:    true,
+		Foreground: t.ownsTerminal,
 	}
 
 	if err := cmd.Start(); err != nil {
@@ -115,35 +244,74 @@ func (t *Tracer) Run(args []string) error {
 	}
 
 	pid := cmd.Process.Pid
+	t.followStops = true
+
+	// Terminal stop signals are the child's business; fuss follows it via
+	// stopWithChild. Ignoring SIGTTOU also lets fuss hand the terminal back
+	// from the background.
+	signal.Ignore(syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU)
+	defer t.restoreTerminal(pid)
 
 	var ws syscall.WaitStatus
 	if _, err := syscall.Wait4(pid, &ws, 0, nil); err != nil {
 		return fmt.Errorf("initial wait failed: %w", err)
 	}
 
-	opts := PTRACE_O_TRACESYSGOOD | PTRACE_O_TRACECLONE | PTRACE_O_TRACEFORK | PTRACE_O_TRACEVFORK | PTRACE_O_TRACEEXEC
-	if err := syscall.PtraceSetOptions(pid, opts); err != nil {
-		return fmt.Errorf("ptrace setoptions failed: %w", err)
+	// The child is stopped right after execve, before running a single
+	// instruction of the new program. Hand it over from PTRACE_TRACEME to
+	// PTRACE_SEIZE so group-stops can be told apart from signal deliveries:
+	// detach into a plain SIGSTOP, seize the stopped child and continue it.
+	if err := ptraceDetach(pid, int(syscall.SIGSTOP)); err != nil {
+		return fmt.Errorf("ptrace detach failed: %w", err)
+	}
+	for !ws.Stopped() || ws.StopSignal() != syscall.SIGSTOP {
+		if _, err := syscall.Wait4(pid, &ws, syscall.WUNTRACED, nil); err != nil {
+			return fmt.Errorf("wait for stopped child failed: %w", err)
+		}
+		if ws.Exited() || ws.Signaled() {
+			return fmt.Errorf("child exited before it could be traced")
+		}
+	}
+
+	if err := ptraceSeize(pid, t.ptraceOptions()); err != nil {
+		return fmt.Errorf("ptrace seize failed: %w", err)
+	}
+	if _, err := syscall.Wait4(pid, &ws, syscall.WALL, nil); err != nil {
+		return fmt.Errorf("initial wait failed: %w", err)
+	}
+	if err := ptraceListen(pid); err != nil {
+		return fmt.Errorf("ptrace listen failed: %w", err)
 	}
 
 	cwd, _ := os.Getwd()
 	t.procs[pid] = &ProcessState{
-		pid:      pid,
-		cwd:      cwd,
-		fdPaths:  make(map[int]string),
-		attached: true,
+		pid:     pid,
+		cwd:     cwd,
+		fdPaths: make(map[int]string),
+		fdReal:  make(map[int]string),
+	}
+	t.wakePid.Store(int64(pid))
+
+	stopForwarding := forwardSignals(pid)
+	defer stopForwarding()
+
+	if err := syscall.Kill(pid, syscall.SIGCONT); err != nil {
+		return fmt.Errorf("failed to continue child: %w", err)
 	}
 
 	return t.traceLoop(pid)
 }
 
 func (t *Tracer) traceLoop(initialPid int) error {
+	defer func() {
+		if !t.detached {
+			t.releaseMounts()
+		}
+	}()
+	defer t.releaseSockDirs()
 	var childErr error
 
-	if err := syscall.PtraceSyscall(initialPid, 0); err != nil {
-		return fmt.Errorf("initial ptrace syscall failed: %w", err)
-	}
-
 	for len(t.procs) > 0 {
 		var ws syscall.WaitStatus
 		pid, err := syscall.Wait4(-1, &ws, syscall.WALL, nil)
@@ -154,6 +322,13 @@ func (t *Tracer) traceLoop(initialPid int) error {
 			return fmt.Errorf("wait4 failed: %w", err)
 		}
 
+		if t.detachRequested.Load() {
+			if err := t.detachAll(pid, ws, true); err != nil {
+				return err
+			}
+			return childErr
+		}
+
 		if ws.Exited() || ws.Signaled() {
 			if pid == initialPid {
 				if ws.Exited() && ws.ExitStatus() != 0 {
@@ -162,8 +337,18 @@ func (t *Tracer) traceLoop(initialPid int) error {
 				if ws.Signaled() {
 					childErr = &ChildExitError{signal: ws.Signal()}
 				}
+				t.removeProc(pid)
+				t.nestedExited(pid, ws)
+				if done, err := t.mainExited(pid, ws); done {
+					if err != nil {
+						return err
+					}
+					return childErr
+				}
+				continue
 			}
-			delete(t.procs, pid)
+			t.removeProc(pid)
+			t.nestedExited(pid, ws)
 			continue
 		}
 
@@ -177,44 +362,62 @@ func (t *Tracer) traceLoop(initialPid int) error {
 				pid:     pid,
 				cwd:     cwd,
 				fdPaths: make(map[int]string),
+				fdReal:  make(map[int]string),
 			}
 			t.procs[pid] = proc
 
-			opts := PTRACE_O_TRACESYSGOOD | PTRACE_O_TRACECLONE | PTRACE_O_TRACEFORK | PTRACE_O_TRACEVFORK | PTRACE_O_TRACEEXEC
-			syscall.PtraceSetOptions(pid, opts)
+			syscall.PtraceSetOptions(pid, t.ptraceOptions())
+		}
+
+		if ws.Stopped() && t.killing {
+			syscall.Kill(pid, syscall.SIGKILL)
+			continue
 		}
 
 		if ws.Stopped() {
 			sig := ws.StopSignal()
+			event := int(ws>>16) & 0xff
+			if sig == syscall.SIGTRAP && event == PTRACE_EVENT_EXEC {
+				// The new program has none of the old mappings.
+				proc.lowScratch, proc.lowScratchTried = 0, false
+			}
 
 			if sig == syscall.SIGTRAP|SIGTRAP_MASK {
-				t.handleSyscall(proc)
-				syscall.PtraceSyscall(pid, 0)
-			} else if sig == syscall.SIGTRAP {
-				event := int(ws>>16) & 0xff
-				if event == 1 || event == 2 || event == 3 {
-					childPid, err := syscall.PtraceGetEventMsg(pid)
-					if err == nil {
-						fdCopy := make(map[int]string, len(proc.fdPaths))
-						for k, v := range proc.fdPaths {
-							fdCopy[k] = v
-						}
-						t.procs[int(childPid)] = &ProcessState{
-							pid:     int(childPid),
-							cwd:     proc.cwd,
-							fdPaths: fdCopy,
-						}
+				if !t.nestedSyscallStop(proc) {
+					t.handleSyscall(proc)
+				}
+				if !proc.parked {
+					syscall.PtraceSyscall(pid, 0)
+				}
+			} else if sig == syscall.SIGTRAP && (event == 1 || event == 2 || event == 3) {
+				childPid, err := syscall.PtraceGetEventMsg(pid)
+				if err == nil {
+					_, seen := t.procs[int(childPid)]
+					t.registerChild(proc, int(childPid))
+					t.nestedFork(proc, int(childPid), event, seen)
+				}
+				if !t.nestedStop(proc, sig, event) {
+					syscall.PtraceSyscall(pid, 0)
+				}
+			} else if t.nestedStop(proc, sig, event) {
+				// Parked until the emulated tracer resumes it.
+			} else if event == PTRACE_EVENT_STOP {
+				if isStopSignal(sig) {
+					// Group-stop: keep the tracee stopped but let us see SIGCONT.
+					ptraceListen(pid)
+					if pid == initialPid && t.followStops {
+						t.stopWithChild(pid)
 					}
+				} else {
+					// PTRACE_INTERRUPT, a new auto-attached child, or the end of
+					// a group-stop being listened to.
+					syscall.PtraceSyscall(pid, 0)
 				}
-				syscall.PtraceSyscall(pid, 0)
-			} else if sig == syscall.SIGSTOP && !proc.attached {
-				proc.attached = true
-				syscall.PtraceSyscall(pid, 0)
-			} else if sig == syscall.SIGTTIN || sig == syscall.SIGTTOU || sig == syscall.SIGTSTP {
-				// Suppress terminal job control signals to allow interactive shells to work.
-				// Limitation: these signals cannot be manually delivered to traced processes.
+			} else if sig == syscall.SIGTRAP && event != 0 {
 				syscall.PtraceSyscall(pid, 0)
 			} else {
+				// Signal-delivery-stop. Stop signals are delivered too; the
+				// kernel then puts the tracee into a group-stop reported above.
 				syscall.PtraceSyscall(pid, int(sig))
 			}
 		}
@@ -223,22 +426,183 @@ func (t *Tracer) traceLoop(initialPid int) error {
 	return childErr
 }
 
+// stopWithChild stops fuss itself while its main child is group-stopped, so
+// a job-control shell sees the whole job stop. Once fuss is continued, the
+// child's process group is continued too, and gets the terminal back if the
+// shell resumed fuss in the foreground.
+func (t *Tracer) stopWithChild(pid int) {
+	debugf("child %d stopped, stopping fuss", pid)
+	syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+	if t.ownsTerminal && isForeground() {
+		setForeground(pid)
+	}
+	syscall.Kill(-pid, syscall.SIGCONT)
+}
+
+// restoreTerminal takes the terminal back from the child's process group
+// once tracing is over.
+func (t *Tracer) restoreTerminal(pgid int) {
+	if !t.ownsTerminal {
+		return
+	}
+	if fg, err := unix.IoctlGetInt(0, unix.TIOCGPGRP); err == nil && fg == pgid {
+		setForeground(syscall.Getpgrp())
+	}
+}
+
+func isStopSignal(sig syscall.Signal) bool {
+	switch sig {
+	case syscall.SIGSTOP, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU:
+		return true
+	}
+	return false
+}
+
+func (t *Tracer) registerChild(parent *ProcessState, childPid int) {
+	fdCopy := make(map[int]string, len(parent.fdPaths))
+	for k, v := range parent.fdPaths {
+		fdCopy[k] = v
+	}
+	realCopy := make(map[int]string, len(parent.fdReal))
+	for k, v := range parent.fdReal {
+		realCopy[k] = v
+	}
+	var modeCopy map[int]int
+	if len(parent.fdWriteMode) > 0 {
+		modeCopy = make(map[int]int, len(parent.fdWriteMode))
+		for k, v := range parent.fdWriteMode {
+			modeCopy[k] = v
+		}
+	}
+	var inotifyCopy map[int]*inotifyWatches
+	if len(parent.inotify) > 0 {
+		inotifyCopy = make(map[int]*inotifyWatches, len(parent.inotify))
+		for k, v := range parent.inotify {
+			inotifyCopy[k] = v
+		}
+	}
+	var fanotifyCopy map[int]*fanotifyMarks
+	if len(parent.fanotify) > 0 {
+		fanotifyCopy = make(map[int]*fanotifyMarks, len(parent.fanotify))
+		for k, v := range parent.fanotify {
+			fanotifyCopy[k] = v
+		}
+	}
+	var mountFdsCopy map[int]*virtualMount
+	if len(parent.mountFds) > 0 {
+		mountFdsCopy = make(map[int]*virtualMount, len(parent.mountFds))
+		for k, v := range parent.mountFds {
+			mountFdsCopy[k] = v
+		}
+	}
+	t.procs[childPid] = &ProcessState{
+		pid:         childPid,
+		cwd:         parent.cwd,
+		root:        parent.root,
+		fdPaths:     fdCopy,
+		fdReal:      realCopy,
+		fdWriteMode: modeCopy,
+		inotify:     inotifyCopy,
+		fanotify:    fanotifyCopy,
+		mountFds:    mountFdsCopy,
+	}
+}
+
+func (t *Tracer) removeProc(pid int) {
+	delete(t.procs, pid)
+	unmarkSyscallArch(pid)
+	if t.wakePid.Load() != int64(pid) {
+		return
+	}
+	t.wakePid.Store(0)
+	for other := range t.procs {
+		t.wakePid.Store(int64(other))
+		break
+	}
+}
+
 func (t *Tracer) handleSyscall(proc *ProcessState) {
 	var regs syscall.PtraceRegs
-	if err := syscall.PtraceGetRegs(proc.pid, &regs); err != nil {
+	if err := ptraceGetRegs(proc.pid, &regs); err != nil {
 		return
 	}
 
+	if !t.noSyscallInfo {
+		info, err := getSyscallInfo(proc.pid)
+		if err == nil {
+			t.dispatchSyscallInfo(proc, info, &regs)
+			return
+		}
+		if err == syscall.EIO || err == syscall.EINVAL {
+			debugf("PTRACE_GET_SYSCALL_INFO unsupported (%v), falling back to entry/exit toggling", err)
+			t.noSyscallInfo = true
+		} else {
+			debugf("PTRACE_GET_SYSCALL_INFO failed: pid=%d err=%v", proc.pid, err)
+			return
+		}
+	}
+
 	if !proc.inSyscall {
 		proc.inSyscall = true
-		t.handleSyscallEntry(proc, &regs)
+		args := [6]uint64{arg0(&regs), arg1(&regs), arg2(&regs), arg3(&regs), arg4(&regs), arg5(&regs)}
+		t.handleSyscallEntry(proc, &regs, sysno(&regs), args)
 	} else {
 		proc.inSyscall = false
 		t.handleSyscallExit(proc, &regs)
 	}
 }
 
-func (t *Tracer) handleSyscallEntry(proc *ProcessState, regs *syscall.PtraceRegs) {
+func (t *Tracer) dispatchSyscallInfo(proc *ProcessState, info *syscallInfo, regs *syscall.PtraceRegs) {
+	markSyscallArch(proc.pid, regs, info.arch)
+	if info.op == PTRACE_SYSCALL_INFO_EXIT {
+		defer unmarkSyscallArch(proc.pid)
+	}
+	switch info.op {
+	case PTRACE_SYSCALL_INFO_ENTRY, PTRACE_SYSCALL_INFO_SECCOMP:
+		proc.inSyscall = true
+		t.handleSyscallEntry(proc, regs, nativeSysno(regs, info.nr), info.args)
+	case PTRACE_SYSCALL_INFO_EXIT:
+		if !proc.inSyscall {
+			// Exit without a matching entry: the tracee was attached mid-syscall
+			// or the entry stop was consumed elsewhere. Nothing of ours is pending.
+			debugf("syscall exit without entry: pid=%d", proc.pid)
+			return
+		}
+		proc.inSyscall = false
+		t.handleSyscallExit(proc, regs)
+	default:
+		debugf("unexpected syscall info op %d for pid=%d", info.op, proc.pid)
+	}
+}
+
+func (t *Tracer) handleSyscallEntry(proc *ProcessState, regs *syscall.PtraceRegs, nr uint64, args [6]uint64) {
+	if proc.fdSwap != nil {
+		if proc.fdSwap.step != swapReplay {
+			// One of our injected syscalls.
+			return
+		}
+		proc.fdSwap = nil
+	}
+	if proc.watchSpread != nil {
+		return
+	}
+	if t.startLowScratch(proc, regs, nr, args) {
+		return
+	}
+
+	proc.socketcallArgs = nil
+	if expandSocketcall(proc.pid, regs) {
+		socketcallArgs := args
+		proc.socketcallArgs = &socketcallArgs
+		nr = sysno(regs)
+		args = [6]uint64{arg0(regs), arg1(regs), arg2(regs), arg3(regs), arg4(regs), arg5(regs)}
+	}
+
+	// A new entry supersedes anything left over from an exit we never saw.
+	proc.skipResult = nil
+	proc.entryNr = nr
+	proc.entryArgs = args
+
 	h := &SyscallHandler{
 		tracer: t,
 		proc:   proc,
@@ -248,10 +612,60 @@ func (t *Tracer) handleSyscallEntry(proc *ProcessState, regs *syscall.PtraceRegs
 }
 
 func (t *Tracer) handleSyscallExit(proc *ProcessState, regs *syscall.PtraceRegs) {
+	if proc.fdSwap != nil {
+		t.advanceFdSwap(proc, regs)
+		return
+	}
+	if proc.watchSpread != nil {
+		t.advanceWatchSpread(proc, regs)
+		return
+	}
+	if proc.lowScratchMap != nil {
+		t.finishLowScratch(proc, regs)
+		return
+	}
+
 	h := &SyscallHandler{
 		tracer: t,
 		proc:   proc,
 		regs:   regs,
 	}
 	h.HandleExit()
+
+	if proc.socketcallArgs != nil {
+		restoreSocketcall(proc.pid, regs, *proc.socketcallArgs)
+		proc.socketcallArgs = nil
+	}
+}
+
+func ptraceSeize(pid int, opts int) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, PTRACE_SEIZE, uintptr(pid), 0, uintptr(opts), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func ptraceListen(pid int) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, PTRACE_LISTEN, uintptr(pid), 0, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func ptraceInterrupt(pid int) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, PTRACE_INTERRUPT, uintptr(pid), 0, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func ptraceDetach(pid int, sig int) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_DETACH, uintptr(pid), 0, uintptr(sig), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
 }
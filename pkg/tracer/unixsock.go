@@ -0,0 +1,287 @@
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Unix domain sockets are named by a path in their sockaddr_un rather than
+// a path argument. fuss rewrites the sun_path of bind, connect, sendto and
+// sendmsg like any other path, and maps the addresses the kernel reports
+// back to paths under the mountpoint. A real path that does not fit in
+// sun_path is reached through a symlink to its directory, in a temporary
+// directory fuss creates for the session, so that the tracee follows it with
+// its own credentials.
+
+const (
+	AF_UNIX = 1
+
+	sunPathMax    = 108
+	sockaddrUnLen = 2 + sunPathMax
+)
+
+// A struct msghdr is seven words, msg_namelen taking the second.
+func msghdrSize(regs *syscall.PtraceRegs) int    { return 7 * wordSize(regs) }
+func msgNamelenOff(regs *syscall.PtraceRegs) int { return wordSize(regs) }
+
+// pendingSockaddr is a buffer the kernel fills with a socket address, with
+// the length it is to report in at lenAddr.
+type pendingSockaddr struct {
+	addr    uintptr
+	lenAddr uintptr
+	size    int
+}
+
+// readSunPath returns the path of the sockaddr_un of addrlen bytes at addr,
+// if it is a path at all.
+func (h *SyscallHandler) readSunPath(addr uintptr, addrlen int) (string, bool) {
+	if addr == 0 || addrlen <= 2 {
+		return "", false
+	}
+	buf := make([]byte, min(addrlen, sockaddrUnLen))
+	n, err := ReadBytes(h.proc.pid, addr, buf)
+	if err != nil || n < len(buf) {
+		return "", false
+	}
+	if binary.LittleEndian.Uint16(buf) != AF_UNIX || buf[2] == 0 {
+		return "", false
+	}
+	path := buf[2:]
+	if i := bytes.IndexByte(path, 0); i >= 0 {
+		path = path[:i]
+	}
+	return string(path), true
+}
+
+// handleSockaddrEntry rewrites the sockaddr_un at argument addrArg, of the
+// length at lenArg, through the VFS. bind creates the socket in the upper
+// layer; everything else resolves an existing one.
+func (h *SyscallHandler) handleSockaddrEntry(addrArg, lenArg int) {
+	addr := uintptr(argN(h.regs, addrArg))
+	path, ok := h.readSunPath(addr, int(int32(argN(h.regs, lenArg))))
+	if !ok {
+		return
+	}
+	realPath, ok := h.resolveSunPath(path)
+	if !ok {
+		return
+	}
+
+	newAddr, newLen, err := h.writeSockaddr(realPath)
+	if err != nil {
+		return
+	}
+	setArgN(h.regs, addrArg, uint64(newAddr))
+	setArgN(h.regs, lenArg, uint64(newLen))
+	ptraceSetRegs(h.proc.pid, h.regs)
+}
+
+// handleSendmsgEntry rewrites the msg_name of a sendmsg. The msghdr is
+// copied so that the tracee's own is left untouched.
+func (h *SyscallHandler) handleSendmsgEntry() {
+	msgAddr := uintptr(arg1(h.regs))
+	msg := make([]byte, msghdrSize(h.regs))
+	if _, err := ReadBytes(h.proc.pid, msgAddr, msg); err != nil {
+		return
+	}
+	namelenOff := msgNamelenOff(h.regs)
+	addr := uintptr(getUint(msg[:namelenOff]))
+	path, ok := h.readSunPath(addr, int(int32(binary.LittleEndian.Uint32(msg[namelenOff:]))))
+	if !ok {
+		return
+	}
+	realPath, ok := h.resolveSunPath(path)
+	if !ok {
+		return
+	}
+
+	newAddr, newLen, err := h.writeSockaddr(realPath)
+	if err != nil {
+		return
+	}
+	putUint(msg[:namelenOff], uint64(newAddr))
+	binary.LittleEndian.PutUint32(msg[namelenOff:], uint32(newLen))
+	newMsg := h.scratchAddrFor(len(msg), 1)
+	if err := WriteBytes(h.proc.pid, newMsg, msg); err != nil {
+		return
+	}
+	setArg1(h.regs, uint64(newMsg))
+	ptraceSetRegs(h.proc.pid, h.regs)
+}
+
+// resolveSunPath returns the real path a socket path names, or false if it
+// is not intercepted or the syscall has been failed.
+func (h *SyscallHandler) resolveSunPath(path string) (string, bool) {
+	resolved := h.resolvePath(path)
+	if !h.tracer.resolver.ShouldIntercept(resolved) {
+		return "", false
+	}
+	vfsPath := h.tracer.resolver.TranslatePath(resolved)
+	logIntercept(h.proc.entryNr, path, resolved, vfsPath)
+
+	var realPath string
+	var err error
+	if h.proc.entryNr == SYS_BIND {
+		if _, err := h.tracer.vfs.ResolvePath(vfsPath); err == nil {
+			h.skipSyscall(negErrno(syscall.EADDRINUSE))
+			return "", false
+		}
+		realPath, err = h.tracer.vfs.PrepareCreate(vfsPath)
+	} else {
+		realPath, err = h.tracer.vfs.ResolvePath(vfsPath)
+	}
+	if err != nil {
+		h.skipSyscall(errnoFromError(err))
+		return "", false
+	}
+
+	if len(realPath) >= sunPathMax {
+		short, err := h.tracer.shortSunPath(realPath)
+		if err != nil {
+			debugf("unix socket: no short path for %q: %v", realPath, err)
+			h.skipSyscall(negErrno(syscall.ENAMETOOLONG))
+			return "", false
+		}
+		realPath = short
+	}
+	return realPath, true
+}
+
+// writeSockaddr writes a sockaddr_un for path to scratch space.
+func (h *SyscallHandler) writeSockaddr(path string) (uintptr, int, error) {
+	buf := make([]byte, 2+len(path)+1)
+	binary.LittleEndian.PutUint16(buf, AF_UNIX)
+	copy(buf[2:], path)
+	addr := h.scratchAddrFor(len(buf), 0)
+	if err := WriteBytes(h.proc.pid, addr, buf); err != nil {
+		debugf("unix socket: WriteBytes failed: %v", err)
+		return 0, 0, err
+	}
+	return addr, len(buf), nil
+}
+
+// shortSunPath returns a path to realPath through a symlink to its
+// directory, creating one if need be. The symlinks are kept for the
+// session: a bound socket may be connected to at any later time.
+func (t *Tracer) shortSunPath(realPath string) (string, error) {
+	dir, name := filepath.Split(realPath)
+	dir = filepath.Clean(dir)
+	link, ok := t.sockDirs[dir]
+	if !ok {
+		if t.sockLinkDir == "" {
+			linkDir, err := os.MkdirTemp("", "fuss-sock")
+			if err != nil {
+				return "", err
+			}
+			if err := os.Chmod(linkDir, 0755); err != nil {
+				os.Remove(linkDir)
+				return "", err
+			}
+			t.sockLinkDir = linkDir
+		}
+		link = filepath.Join(t.sockLinkDir, strconv.Itoa(len(t.sockDirs)))
+		if err := os.Symlink(dir, link); err != nil {
+			return "", err
+		}
+		t.sockDirs[dir] = link
+	}
+	short := filepath.Join(link, name)
+	if len(short) >= sunPathMax {
+		return "", syscall.ENAMETOOLONG
+	}
+	return short, nil
+}
+
+// longSunPath undoes shortSunPath.
+func (t *Tracer) longSunPath(path string) string {
+	for dir, link := range t.sockDirs {
+		if name, ok := strings.CutPrefix(path, link+"/"); ok {
+			return filepath.Join(dir, name)
+		}
+	}
+	return path
+}
+
+// releaseSockDirs removes the symlinks of shortSunPath at the end of the
+// session.
+func (t *Tracer) releaseSockDirs() {
+	if t.sockLinkDir != "" {
+		os.RemoveAll(t.sockLinkDir)
+	}
+	t.sockLinkDir = ""
+	t.sockDirs = make(map[string]string)
+}
+
+// handleSockaddrResultEntry notes the address buffer at addrArg and its
+// length at lenArg for the syscall to fill in.
+func (h *SyscallHandler) handleSockaddrResultEntry(addrArg, lenArg int) {
+	h.noteSockaddrResult(uintptr(argN(h.regs, addrArg)), uintptr(argN(h.regs, lenArg)))
+}
+
+func (h *SyscallHandler) handleRecvmsgEntry() {
+	msgAddr := uintptr(arg1(h.regs))
+	msg := make([]byte, msghdrSize(h.regs))
+	if _, err := ReadBytes(h.proc.pid, msgAddr, msg); err != nil {
+		return
+	}
+	namelenOff := msgNamelenOff(h.regs)
+	h.noteSockaddrResult(uintptr(getUint(msg[:namelenOff])), msgAddr+uintptr(namelenOff))
+}
+
+func (h *SyscallHandler) noteSockaddrResult(addr, lenAddr uintptr) {
+	if addr == 0 || lenAddr == 0 {
+		return
+	}
+	buf := make([]byte, 4)
+	if _, err := ReadBytes(h.proc.pid, lenAddr, buf); err != nil {
+		return
+	}
+	size := int(int32(binary.LittleEndian.Uint32(buf)))
+	if size <= 2 {
+		return
+	}
+	h.proc.pendingSockaddr = &pendingSockaddr{addr: addr, lenAddr: lenAddr, size: size}
+}
+
+// handleSockaddrResultExit maps a socket path the kernel reported back to
+// the path under the mountpoint.
+func (h *SyscallHandler) handleSockaddrResultExit() {
+	pending := h.proc.pendingSockaddr
+	if pending == nil {
+		return
+	}
+	h.proc.pendingSockaddr = nil
+	if int64(retval(h.regs)) < 0 {
+		return
+	}
+
+	buf := make([]byte, 4)
+	if _, err := ReadBytes(h.proc.pid, pending.lenAddr, buf); err != nil {
+		return
+	}
+	addrlen := int(int32(binary.LittleEndian.Uint32(buf)))
+	path, ok := h.readSunPath(pending.addr, min(addrlen, pending.size))
+	if !ok {
+		return
+	}
+	virtual, ok := h.tracer.resolver.VirtualPath(h.tracer.longSunPath(path))
+	if !ok {
+		return
+	}
+	virtual = rootedPath(h.proc.root, virtual)
+
+	sa := make([]byte, 2+len(virtual)+1)
+	binary.LittleEndian.PutUint16(sa, AF_UNIX)
+	copy(sa[2:], virtual)
+	if err := WriteBytes(h.proc.pid, pending.addr, sa[:min(len(sa), pending.size)]); err != nil {
+		return
+	}
+	binary.LittleEndian.PutUint32(buf, uint32(len(sa)))
+	WriteBytes(h.proc.pid, pending.lenAddr, buf)
+	debugf("unix socket: reporting %q as %q", path, virtual)
+}
@@ -0,0 +1,435 @@
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// A directory in the overlay is made up of directories in several layers,
+// and an inotify or fanotify watch on just one of them misses changes in
+// the others. Watches on overlay paths are placed on every layer instead:
+// the syscall is rewritten for the topmost path, and once it succeeds the
+// tracee is made to repeat it for the other layers. inotify reports events
+// by watch descriptor, so reads from an inotify fd map the descriptor of
+// each layer back to the one the tracee got, and entry names back to the
+// names they have in the overlay. A directory only in lower layers is
+// watched there, and its upper copy is watched as well once a copy-up
+// creates it, through a copy of the tracee's fd.
+
+// watchLayers is implemented by filesystems that spread a path over several
+// real directories.
+type watchLayers interface {
+	WatchPaths(path string) (paths []string, upperMissing bool, err error)
+	WatchedName(path, realDir, name string) (overlayName string, whiteout, visible bool)
+}
+
+// copyUpNotifier is implemented by filesystems that report the directories
+// they copy up.
+type copyUpNotifier interface {
+	OnCopyUp(fn func(path, upperPath string))
+}
+
+const inotifyEventSize = 16
+
+// watchSpread is a watch syscall followed by the calls injected at its exit.
+type watchSpread struct {
+	nr    uint64
+	args  [6]uint64
+	calls [][6]uint64
+	// For inotify_add_watch and fanotify_mark, the layer paths. The first
+	// one is passed to the syscall itself, the others to calls at pathArg.
+	vfsPath string
+	paths   []string
+	pathArg int
+	// The path has no upper copy yet, which is to be watched once it does.
+	upperMissing bool
+
+	results []int64
+	// The state at the exit of the syscall, restored after the last call.
+	regs syscall.PtraceRegs
+}
+
+// inotifyWatches maps the watch descriptors of one inotify instance. Every
+// process holding an fd of the instance shares it.
+type inotifyWatches struct {
+	layers  map[int]watchLayer
+	copyUps []copyUpWatch
+}
+
+// fanotifyMarks holds the marks of one fanotify instance still to be placed
+// on upper copies.
+type fanotifyMarks struct {
+	copyUps []copyUpWatch
+}
+
+// copyUpWatch is a watch syscall to repeat for the upper copy of vfsPath
+// once there is one. args[0] is the tracee's fd.
+type copyUpWatch struct {
+	vfsPath string
+	nr      uint64
+	args    [6]uint64
+	pathArg int
+	// For inotify, the descriptor the tracee got for the watch.
+	primary int
+}
+
+type watchLayer struct {
+	primary int
+	vfsPath string
+	realDir string
+}
+
+type pendingInotifyRead struct {
+	fd      int
+	bufAddr uintptr
+}
+
+// watchPaths returns the real paths a watch on vfsPath is placed on.
+func (h *SyscallHandler) watchPaths(vfsPath string, follow bool) ([]string, bool, error) {
+	if layers, ok := h.tracer.vfs.(watchLayers); ok {
+		return layers.WatchPaths(vfsPath)
+	}
+	realPath, err := h.tracer.vfs.ResolveForStat(vfsPath, follow)
+	return []string{realPath}, false, err
+}
+
+// startWatch records the layers a watch syscall still has to be repeated
+// for, once the rewritten syscall has returned.
+func (h *SyscallHandler) startWatch(spec syscallSpec, vfsPath string, paths []string, upperMissing bool) {
+	spread := &watchSpread{
+		nr:           h.proc.entryNr,
+		args:         h.proc.entryArgs,
+		vfsPath:      vfsPath,
+		paths:        paths,
+		pathArg:      spec.path,
+		upperMissing: upperMissing,
+	}
+	for range paths[1:] {
+		args := h.proc.entryArgs
+		if spec.dirfd != none {
+			args[spec.dirfd] = AT_FDCWD_U64
+		}
+		spread.calls = append(spread.calls, args)
+	}
+	h.proc.pendingWatch = spread
+}
+
+// handleInotifyRmWatchEntry removes the watches on the other layers along
+// with the one the tracee knows about.
+func (h *SyscallHandler) handleInotifyRmWatchEntry() {
+	fd := int(int32(arg0(h.regs)))
+	wd := int(int32(arg1(h.regs)))
+	watches := h.proc.inotify[fd]
+	if watches == nil {
+		return
+	}
+	watches.dropCopyUps(wd)
+
+	spread := &watchSpread{nr: h.proc.entryNr, args: h.proc.entryArgs}
+	for other, layer := range watches.layers {
+		if layer.primary == wd && other != wd {
+			spread.calls = append(spread.calls, [6]uint64{uint64(fd), uint64(other)})
+		}
+	}
+	if len(spread.calls) > 0 {
+		h.proc.pendingWatch = spread
+	}
+}
+
+func (h *SyscallHandler) handleWatchExit() {
+	spread := h.proc.pendingWatch
+	if spread == nil {
+		return
+	}
+	h.proc.pendingWatch = nil
+	if spread.paths != nil && int64(retval(h.regs)) < 0 {
+		return
+	}
+
+	spread.regs = *h.regs
+	h.proc.watchSpread = spread
+	h.tracer.stepWatchSpread(h.proc, h.regs)
+}
+
+// advanceWatchSpread runs at the exit of each injected call.
+func (t *Tracer) advanceWatchSpread(proc *ProcessState, regs *syscall.PtraceRegs) {
+	spread := proc.watchSpread
+	ret := int64(retval(regs))
+	if ret < 0 {
+		debugf("watch: injected %s failed: %d", syscallName(spread.nr), ret)
+	}
+	spread.results = append(spread.results, ret)
+	t.stepWatchSpread(proc, regs)
+}
+
+// stepWatchSpread injects the next call, or completes the original syscall
+// once all are done.
+func (t *Tracer) stepWatchSpread(proc *ProcessState, regs *syscall.PtraceRegs) {
+	spread := proc.watchSpread
+	i := len(spread.results)
+	if i < len(spread.calls) {
+		args := spread.calls[i]
+		if spread.paths != nil {
+			h := &SyscallHandler{tracer: t, proc: proc, regs: regs}
+			addr, err := h.rewritePath(0, spread.paths[i+1])
+			if err != nil {
+				spread.calls = spread.calls[:i]
+				t.stepWatchSpread(proc, regs)
+				return
+			}
+			args[spread.pathArg] = uint64(addr)
+		}
+		next := *regs
+		rewindSyscall(&next, spread.nr, args)
+		ptraceSetRegs(proc.pid, &next)
+		return
+	}
+
+	proc.watchSpread = nil
+	next := spread.regs
+	ret := retval(&next)
+	switch spread.nr {
+	case SYS_INOTIFY_ADD_WATCH:
+		proc.addInotifyWatch(spread, int(int32(ret)))
+	case SYS_FANOTIFY_MARK:
+		if int64(ret) >= 0 {
+			proc.noteFanotifyMark(spread)
+		}
+	}
+	restoreEntryArgs(&next, spread.nr, spread.args)
+	setRetval(&next, ret)
+	ptraceSetRegs(proc.pid, &next)
+}
+
+func (p *ProcessState) addInotifyWatch(spread *watchSpread, primary int) {
+	fd := int(int32(spread.args[0]))
+	watches := p.inotify[fd]
+	if watches == nil {
+		watches = &inotifyWatches{layers: make(map[int]watchLayer)}
+		if p.inotify == nil {
+			p.inotify = make(map[int]*inotifyWatches)
+		}
+		p.inotify[fd] = watches
+	}
+
+	watches.layers[primary] = watchLayer{primary: primary, vfsPath: spread.vfsPath, realDir: spread.paths[0]}
+	for i, wd := range spread.results {
+		if wd < 0 || int(wd) == primary {
+			continue
+		}
+		watches.layers[int(wd)] = watchLayer{primary: primary, vfsPath: spread.vfsPath, realDir: spread.paths[i+1]}
+	}
+	if spread.upperMissing {
+		watches.copyUps = append(watches.copyUps, copyUpWatch{
+			vfsPath: spread.vfsPath,
+			nr:      spread.nr,
+			args:    spread.args,
+			pathArg: spread.pathArg,
+			primary: primary,
+		})
+	}
+}
+
+// dropCopyUps forgets the watches still to be placed for primary.
+func (w *inotifyWatches) dropCopyUps(primary int) {
+	w.copyUps = slices.DeleteFunc(w.copyUps, func(c copyUpWatch) bool { return c.primary == primary })
+}
+
+// noteFanotifyMark keeps track of the marks still to be placed on upper
+// copies: adding one on a path without one, removing or flushing drops them.
+func (p *ProcessState) noteFanotifyMark(spread *watchSpread) {
+	fd := int(int32(spread.args[0]))
+	flags := spread.args[1]
+	marks := p.fanotify[fd]
+	if marks == nil {
+		if flags&FAN_MARK_ADD == 0 || !spread.upperMissing {
+			return
+		}
+		marks = &fanotifyMarks{}
+		if p.fanotify == nil {
+			p.fanotify = make(map[int]*fanotifyMarks)
+		}
+		p.fanotify[fd] = marks
+	}
+
+	switch {
+	case flags&FAN_MARK_FLUSH != 0:
+		marks.copyUps = nil
+	case flags&FAN_MARK_REMOVE != 0:
+		marks.copyUps = slices.DeleteFunc(marks.copyUps, func(c copyUpWatch) bool { return c.vfsPath == spread.vfsPath })
+	case flags&FAN_MARK_ADD != 0 && spread.upperMissing:
+		marks.copyUps = append(marks.copyUps, copyUpWatch{
+			vfsPath: spread.vfsPath,
+			nr:      spread.nr,
+			args:    spread.args,
+			pathArg: spread.pathArg,
+		})
+	}
+}
+
+// watchCopyUp places the watches waiting for vfsPath to be copied up on
+// upperPath, from fuss through copies of the tracees' fds.
+func (t *Tracer) watchCopyUp(vfsPath, upperPath string) {
+	for _, proc := range t.procs {
+		for fd, watches := range proc.inotify {
+			watches.copyUps = slices.DeleteFunc(watches.copyUps, func(c copyUpWatch) bool {
+				if c.vfsPath != vfsPath {
+					return false
+				}
+				if wd, err := t.placeCopyUpWatch(proc, fd, c, upperPath); err != nil {
+					debugf("watch: %q on upper copy failed: %v", vfsPath, err)
+				} else {
+					watches.layers[wd] = watchLayer{primary: c.primary, vfsPath: vfsPath, realDir: upperPath}
+				}
+				return true
+			})
+		}
+		for fd, marks := range proc.fanotify {
+			marks.copyUps = slices.DeleteFunc(marks.copyUps, func(c copyUpWatch) bool {
+				if c.vfsPath != vfsPath {
+					return false
+				}
+				if _, err := t.placeCopyUpWatch(proc, fd, c, upperPath); err != nil {
+					debugf("watch: %q on upper copy failed: %v", vfsPath, err)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// placeCopyUpWatch repeats the watch syscall of c for upperPath on fuss's
+// copy of the tracee's fd, which refers to the same instance.
+func (t *Tracer) placeCopyUpWatch(proc *ProcessState, fd int, c copyUpWatch, upperPath string) (int, error) {
+	tgid, err := statusField(proc.pid, "Tgid:")
+	if err != nil {
+		return 0, err
+	}
+	pidfd, err := unix.PidfdOpen(tgid, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(pidfd)
+	watchFd, err := unix.PidfdGetfd(pidfd, fd, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(watchFd)
+
+	if c.nr == SYS_INOTIFY_ADD_WATCH {
+		return unix.InotifyAddWatch(watchFd, upperPath, uint32(c.args[2]))
+	}
+	return 0, unix.FanotifyMark(watchFd, uint(c.args[1]), c.args[2], unix.AT_FDCWD, upperPath)
+}
+
+func (h *SyscallHandler) handleInotifyReadEntry() {
+	fd := int(int32(arg0(h.regs)))
+	if h.proc.inotify[fd] == nil {
+		return
+	}
+	h.proc.pendingInotifyRead = &pendingInotifyRead{fd: fd, bufAddr: uintptr(arg1(h.regs))}
+}
+
+// handleInotifyReadExit rewrites the events read from an inotify fd in
+// terms of the overlay. If none is left, the read is restarted.
+func (h *SyscallHandler) handleInotifyReadExit() {
+	pending := h.proc.pendingInotifyRead
+	if pending == nil {
+		return
+	}
+	h.proc.pendingInotifyRead = nil
+
+	n := int64(retval(h.regs))
+	watches := h.proc.inotify[pending.fd]
+	if n <= 0 || watches == nil {
+		return
+	}
+	buf := make([]byte, n)
+	if _, err := ReadBytes(h.proc.pid, pending.bufAddr, buf); err != nil {
+		return
+	}
+
+	out := h.translateInotifyEvents(watches, buf)
+	if len(out) == 0 {
+		next := *h.regs
+		rewindSyscall(&next, SYS_READ, h.proc.entryArgs)
+		ptraceSetRegs(h.proc.pid, &next)
+		return
+	}
+	if err := WriteBytes(h.proc.pid, pending.bufAddr, out); err != nil {
+		debugf("inotify read: WriteBytes failed: %v", err)
+		return
+	}
+	setRetval(h.regs, uint64(len(out)))
+	ptraceSetRegs(h.proc.pid, h.regs)
+}
+
+func (h *SyscallHandler) translateInotifyEvents(watches *inotifyWatches, buf []byte) []byte {
+	layers, _ := h.tracer.vfs.(watchLayers)
+	out := make([]byte, 0, len(buf))
+	var lastDelete []byte
+
+	for off := 0; off+inotifyEventSize <= len(buf); {
+		wd := int(int32(binary.LittleEndian.Uint32(buf[off:])))
+		mask := binary.LittleEndian.Uint32(buf[off+4:])
+		nameLen := int(binary.LittleEndian.Uint32(buf[off+12:]))
+		end := off + inotifyEventSize + nameLen
+		if end > len(buf) {
+			break
+		}
+		ev := append([]byte(nil), buf[off:end]...)
+		off = end
+
+		layer, ok := watches.layers[wd]
+		if !ok {
+			out = append(out, ev...)
+			continue
+		}
+		if mask&syscall.IN_IGNORED != 0 {
+			delete(watches.layers, wd)
+			if wd != layer.primary {
+				continue
+			}
+			watches.dropCopyUps(wd)
+		}
+
+		name := ev[inotifyEventSize:]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		if len(name) > 0 && layers != nil {
+			overlayName, whiteout, visible := layers.WatchedName(layer.vfsPath, layer.realDir, string(name))
+			if !visible {
+				continue
+			}
+			if whiteout {
+				if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) == 0 {
+					continue
+				}
+				mask = syscall.IN_DELETE | mask&syscall.IN_ISDIR
+				binary.LittleEndian.PutUint32(ev[8:], 0)
+			}
+			clear(ev[inotifyEventSize:])
+			copy(ev[inotifyEventSize:], overlayName)
+		}
+		binary.LittleEndian.PutUint32(ev[0:], uint32(layer.primary))
+		binary.LittleEndian.PutUint32(ev[4:], mask)
+
+		// Removing a copied-up file deletes the upper copy and then creates
+		// a whiteout; report the deletion once.
+		if mask&^syscall.IN_ISDIR == syscall.IN_DELETE {
+			if bytes.Equal(ev, lastDelete) {
+				continue
+			}
+			lastDelete = ev
+		} else {
+			lastDelete = nil
+		}
+		out = append(out, ev...)
+	}
+	return out
+}
@@ -7,6 +7,7 @@ type VFS interface {
 
 	PrepareCreate(path string) (realPath string, err error)
 	PrepareWrite(path string) (realPath string, err error)
+	PrepareXattr(path string) (realPath string, err error)
 	PrepareUnlink(path string) error
 	PrepareRmdir(path string) error
 	PrepareRename(oldpath, newpath string) (oldReal, newReal string, err error)